@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pandodao/PAL9000/config"
+	"github.com/pandodao/PAL9000/internal/terminal"
+	"github.com/pandodao/PAL9000/service"
+	"github.com/pandodao/PAL9000/store"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// chatCmd represents the chat command
+var chatCmd = &cobra.Command{
+	Use:   "chat",
+	Short: "Chat with the bot in the terminal",
+	Long:  `Chat with the bot of the general config in the terminal, the messages are handled the same way as the adapters do`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Init(cfgFile)
+		if err != nil {
+			return err
+		}
+
+		botID, _ := cmd.Flags().GetUint64("bot-id")
+		lang, _ := cmd.Flags().GetString("lang")
+		convKey, _ := cmd.Flags().GetString("conv-key")
+		verbose, _ := cmd.Flags().GetBool("verbose")
+		if !verbose {
+			logrus.SetLevel(logrus.ErrorLevel)
+		}
+
+		// always use the memory store, the bolt file may be locked by a
+		// running instance
+		stores, err := store.Open(config.StoreConfig{Driver: "memory"})
+		if err != nil {
+			return err
+		}
+		defer stores.Close()
+
+		s, err := stores.Namespace("terminal")
+		if err != nil {
+			return err
+		}
+
+		b := terminal.New("terminal", terminal.Options{
+			BotID:   botID,
+			Lang:    lang,
+			ConvKey: convKey,
+		}, os.Stdin, os.Stdout)
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err = service.NewHandler(cfg.General, s, b).Start(ctx)
+		if err == context.Canceled {
+			err = nil
+		}
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(chatCmd)
+	chatCmd.Flags().Uint64("bot-id", 0, "override the bot id of the general config")
+	chatCmd.Flags().String("lang", "", "override the lang of the general config")
+	chatCmd.Flags().String("conv-key", "terminal", "conversation key, use another one to start a new conversation")
+	chatCmd.Flags().BoolP("verbose", "v", false, "show the logs")
+}
@@ -4,6 +4,10 @@ import (
 	"fmt"
 
 	"github.com/pandodao/PAL9000/config"
+	"github.com/pandodao/PAL9000/internal/discord"
+	"github.com/pandodao/PAL9000/internal/mixin"
+	"github.com/pandodao/PAL9000/internal/telegram"
+	"github.com/pandodao/PAL9000/internal/wechat"
 	"github.com/spf13/cobra"
 )
 
@@ -14,7 +18,7 @@ var configCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		showExample, _ := cmd.Flags().GetBool("example")
 		if showExample {
-			fmt.Println(config.ExampleConfig())
+			fmt.Println(exampleConfig())
 		} else {
 			fmt.Println(config.DefaultConfig())
 		}
@@ -25,3 +29,80 @@ func init() {
 	rootCmd.AddCommand(configCmd)
 	configCmd.Flags().BoolP("example", "e", false, "Display example config")
 }
+
+// exampleConfig shows the config of an adapter of the first drivers.
+func exampleConfig() *config.Config {
+	return &config.Config{
+		General: config.GeneralConfig{
+			Bot: &config.BotConfig{
+				BotID: 1,
+				Lang:  "en",
+			},
+			Botastic: &config.BotasticConfig{
+				AppId: "cab1582e-9c30-4d1e-9246-a5c80f74f8f9",
+				Host:  "https://botastic-api.pando.im",
+				Debug: true,
+			},
+		},
+		Store: config.StoreConfig{
+			Driver: "bolt",
+			Path:   "pal9000.db",
+		},
+		Adapters: config.AdaptersConfig{
+			Enabled: []string{"test_mixin", "test_telegram", "test_discord", "test_wechat"},
+			Items: map[string]config.AdapterConfig{
+				"test_mixin": {
+					Driver: "mixin",
+					Config: &mixin.Config{
+						Keystore:               "base64 encoded keystore",
+						Whitelist:              []string{"7000104111", "a8d4e38e-9317-4529-8ca9-4289d4668111"},
+						MessageCacheExpiration: 60 * 60 * 24,
+					},
+				},
+				"test_telegram": {
+					Driver: "telegram",
+					Config: &telegram.Config{
+						Debug:     true,
+						Token:     "1234567890:ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+						Whitelist: []string{"-10540154212", "xx"},
+						GeneralConfig: config.GeneralConfig{
+							Bot: &config.BotConfig{
+								BotID: 2,
+								Lang:  "zh",
+							},
+							Botastic: &config.BotasticConfig{
+								AppId: "cab1582e-9c30-4d1e-9246-a5c80f74f8f9",
+								Host:  "https://botastic-api.pando.im",
+							},
+						},
+					},
+				},
+				"test_discord": {
+					Driver: "discord",
+					Config: &discord.Config{
+						Token:     "1234567890",
+						Whitelist: []string{"1093104389113266186"},
+						GeneralConfig: config.GeneralConfig{
+							Backend: &config.BackendConfig{
+								Driver: "openai",
+								OpenAI: &config.OpenAIConfig{
+									BaseURL:      "http://localhost:8000/v1",
+									Model:        "llama-2-7b-chat",
+									SystemPrompt: "You are a helpful assistant.",
+								},
+							},
+						},
+					},
+				},
+				"test_wechat": {
+					Driver: "wechat",
+					Config: &wechat.Config{
+						Address: ":8080",
+						Path:    "/wechat",
+						Token:   "123456",
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,16 @@
+package cmd
+
+// the adapter drivers built in, they register themselves on import
+import (
+	_ "github.com/pandodao/PAL9000/internal/dingtalk"
+	_ "github.com/pandodao/PAL9000/internal/discord"
+	_ "github.com/pandodao/PAL9000/internal/feishu"
+	_ "github.com/pandodao/PAL9000/internal/httpapi"
+	_ "github.com/pandodao/PAL9000/internal/line"
+	_ "github.com/pandodao/PAL9000/internal/matrix"
+	_ "github.com/pandodao/PAL9000/internal/mixin"
+	_ "github.com/pandodao/PAL9000/internal/slack"
+	_ "github.com/pandodao/PAL9000/internal/telegram"
+	_ "github.com/pandodao/PAL9000/internal/wechat"
+	_ "github.com/pandodao/PAL9000/internal/wecom"
+)
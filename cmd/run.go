@@ -3,96 +3,273 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/pandodao/PAL9000/config"
-	"github.com/pandodao/PAL9000/internal/discord"
-	"github.com/pandodao/PAL9000/internal/mixin"
-	"github.com/pandodao/PAL9000/internal/telegram"
-	"github.com/pandodao/PAL9000/internal/wechat"
 	"github.com/pandodao/PAL9000/service"
 	"github.com/pandodao/PAL9000/store"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"golang.org/x/sync/errgroup"
 )
 
 type configKey struct{}
 
+// how often the config file is checked for changes
+const watchInterval = 3 * time.Second
+
 // runCmd represents the run command
 var runCmd = &cobra.Command{
 	Use:   "run",
 	Short: "Run all bots by config",
+	Long:  `Run all bots by config, the config is reloaded when the file changes or on SIGHUP. On SIGINT or SIGTERM the adapters stop receiving and the messages in progress are finished before exiting`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cfg, err := config.Init(cfgFile)
 		if err != nil {
 			return err
 		}
 		cmd.SetContext(context.WithValue(cmd.Context(), configKey{}, cfg))
-		ctx := cmd.Context()
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
 
-		startHandler := func(h *service.Handler, name string, adapterCfg config.AdapterConfig) error {
-			fmt.Printf("Starting adapter, name: %s, driver: %s\n", name, adapterCfg.Driver)
-			return h.Start(ctx)
+		stores, err := store.Open(cfg.Store)
+		if err != nil {
+			return err
 		}
+		defer stores.Close()
 
-		g := errgroup.Group{}
-		for _, name := range cfg.Adapters.Enabled {
-			name := name
-			adapter := cfg.Adapters.Items[name]
-			switch adapter.Driver {
-			case "mixin":
-				g.Go(func() error {
-					b, err := mixin.Init(ctx, name, *adapter.Mixin)
-					if err != nil {
-						return err
-					}
-
-					h := service.NewHandler(getGeneralConfig(cfg.General, adapter.Mixin.GeneralConfig), store.NewMemoryStore(), b)
-					return startHandler(h, name, adapter)
-				})
-			case "telegram":
-				g.Go(func() error {
-					b, err := telegram.Init(name, *adapter.Telegram)
-					if err != nil {
-						return err
-					}
-
-					h := service.NewHandler(getGeneralConfig(cfg.General, adapter.Telegram.GeneralConfig), store.NewMemoryStore(), b)
-					return startHandler(h, name, adapter)
-				})
-			case "discord":
-				g.Go(func() error {
-					b := discord.New(name, *adapter.Discord)
-					h := service.NewHandler(getGeneralConfig(cfg.General, adapter.Discord.GeneralConfig), store.NewMemoryStore(), b)
-					return startHandler(h, name, adapter)
-				})
-			case "wechat":
-				g.Go(func() error {
-					b := wechat.New(name, *adapter.WeChat)
-					h := service.NewHandler(getGeneralConfig(cfg.General, adapter.WeChat.GeneralConfig), store.NewMemoryStore(), b)
-					return startHandler(h, name, adapter)
-				})
-			}
+		r := &runner{
+			cfg:     cfg,
+			stores:  stores,
+			running: make(map[string]*runningAdapter),
+			logger:  logrus.WithField("component", "runner"),
 		}
+		if err := r.startAll(ctx); err != nil {
+			r.stopAll()
+			return err
+		}
+		defer r.stopAll()
 
-		return g.Wait()
+		watch, _ := cmd.Flags().GetBool("watch")
+		err = r.watch(ctx, watch)
+		// a second signal kills the process while draining
+		stop()
+		r.logger.Info("shutting down, waiting for the messages in progress")
+		return err
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(runCmd)
+	runCmd.Flags().Bool("watch", true, "reload the config when the file changes")
+}
+
+type runningAdapter struct {
+	cfg config.AdapterConfig
+	// the default general config the adapter config is merged with
+	general config.GeneralConfig
+	adapter service.Adapter
+	handler *service.Handler
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// runner runs the enabled adapters and applies the changes of the config.
+type runner struct {
+	cfg     *config.Config
+	stores  store.Provider
+	logger  *logrus.Entry
+	mu      sync.Mutex
+	running map[string]*runningAdapter
+}
+
+func (r *runner) startAll(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, name := range r.cfg.Adapters.Enabled {
+		if err := r.start(ctx, name, r.cfg.Adapters.Items[name]); err != nil {
+			return fmt.Errorf("start adapter %s error: %w", name, err)
+		}
+	}
+	return nil
 }
 
-func getGeneralConfig(defaultCfg, overrideCfg config.GeneralConfig) config.GeneralConfig {
-	cfg := defaultCfg
-	if overrideCfg.Bot != nil {
-		cfg.Bot = overrideCfg.Bot
+// stopAll stops all the adapters at the same time and waits for them.
+func (r *runner) stopAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, ra := range r.running {
+		ra.cancel()
+	}
+	for name := range r.running {
+		r.stop(name)
 	}
-	if overrideCfg.Botastic != nil {
-		cfg.Botastic = overrideCfg.Botastic
+}
+
+// watch reloads the config on SIGHUP, and when the file changes if
+// watchFile is true, until ctx is done.
+func (r *runner) watch(ctx context.Context, watchFile bool) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	lastMod := modTime(cfgFile)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			r.logger.Info("SIGHUP received, reloading config")
+			r.reload(ctx)
+		case <-ticker.C:
+			if !watchFile {
+				continue
+			}
+			if mod := modTime(cfgFile); !mod.Equal(lastMod) {
+				lastMod = mod
+				r.logger.Info("config file changed, reloading config")
+				r.reload(ctx)
+			}
+		}
+	}
+}
+
+func modTime(fp string) time.Time {
+	info, err := os.Stat(fp)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reload applies the new config: the adapters removed from the enabled list
+// are stopped, the new ones are started, and the changed ones are reloaded
+// in place if possible or restarted otherwise. The invalid config is ignored.
+func (r *runner) reload(ctx context.Context) {
+	cfg, err := config.Init(cfgFile)
+	if err != nil {
+		r.logger.WithError(err).Error("reload config error, keep running with the old one")
+		return
 	}
-	if overrideCfg.Options != nil {
-		cfg.Options = overrideCfg.Options
+	if !reflect.DeepEqual(cfg.Store, r.cfg.Store) {
+		r.logger.Warn("store config changed, it only applies after restarting")
 	}
 
-	return cfg
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cfg = cfg
+
+	enabled := make(map[string]bool)
+	for _, name := range cfg.Adapters.Enabled {
+		enabled[name] = true
+	}
+	for name := range r.running {
+		if !enabled[name] {
+			r.logger.WithField("name", name).Info("stopping disabled adapter")
+			r.stop(name)
+		}
+	}
+
+	for _, name := range cfg.Adapters.Enabled {
+		logger := r.logger.WithField("name", name)
+		adapterCfg := cfg.Adapters.Items[name]
+		ra, ok := r.running[name]
+		switch {
+		case !ok:
+			logger.Info("starting enabled adapter")
+		case ra.cfg.Equal(adapterCfg):
+			if !reflect.DeepEqual(ra.general, cfg.General) {
+				r.updateGeneral(ra)
+				logger.Info("general config reloaded")
+			}
+			continue
+		case ra.cfg.Driver == adapterCfg.Driver && r.reloadInPlace(ra, adapterCfg):
+			logger.Info("adapter reloaded")
+			continue
+		default:
+			logger.Info("restarting changed adapter")
+			r.stop(name)
+		}
+
+		if err := r.start(ctx, name, adapterCfg); err != nil {
+			logger.WithError(err).Error("start adapter error")
+		}
+	}
+}
+
+func (r *runner) reloadInPlace(ra *runningAdapter, adapterCfg config.AdapterConfig) bool {
+	reloader, ok := ra.adapter.(service.ReloadableAdapter)
+	if !ok || !reloader.Reload(adapterCfg) {
+		return false
+	}
+
+	ra.cfg = adapterCfg
+	r.updateGeneral(ra)
+	return true
+}
+
+func (r *runner) updateGeneral(ra *runningAdapter) {
+	ra.general = r.cfg.General
+	ra.handler.UpdateConfig(config.MergeGeneralConfig(ra.general, ra.cfg.General()))
+}
+
+// start runs the adapter in the background, r.mu must be held.
+func (r *runner) start(ctx context.Context, name string, adapterCfg config.AdapterConfig) error {
+	ctx, cancel := context.WithCancel(ctx)
+	b, err := service.NewAdapter(ctx, name, adapterCfg)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	s, err := r.stores.Namespace(name)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	h := service.NewHandler(config.MergeGeneralConfig(r.cfg.General, adapterCfg.General()), s, b)
+	ra := &runningAdapter{
+		cfg:     adapterCfg,
+		general: r.cfg.General,
+		adapter: b,
+		handler: h,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	r.running[name] = ra
+
+	fmt.Printf("Starting adapter, name: %s, driver: %s\n", name, adapterCfg.Driver)
+	go func() {
+		defer close(ra.done)
+		logger := r.logger.WithField("name", name)
+		if err := h.Start(ctx); err != nil && err != context.Canceled {
+			logger.WithError(err).Error("adapter stopped")
+		}
+		if err := b.Close(); err != nil {
+			logger.WithError(err).Error("close adapter error")
+		}
+	}()
+	return nil
+}
+
+// stop stops the adapter and waits for the messages in progress, r.mu must
+// be held.
+func (r *runner) stop(name string) {
+	ra, ok := r.running[name]
+	if !ok {
+		return
+	}
+	ra.cancel()
+	<-ra.done
+	delete(r.running, name)
 }
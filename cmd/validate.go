@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/pandodao/PAL9000/config"
+	"github.com/spf13/cobra"
+)
+
+// validateCmd represents the validate command
+var validateCmd = &cobra.Command{
+	Use:          "validate",
+	Short:        "Validate the config file",
+	Long:         `Check the config file and report all the problems with their line numbers, it exits non-zero if there is any`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		data, err := ioutil.ReadFile(cfgFile)
+		if err != nil {
+			return fmt.Errorf("ioutil.ReadFile error: %w", err)
+		}
+
+		_, problems, err := config.Lint(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", cfgFile, err)
+		}
+
+		for _, p := range problems {
+			msg := p.Message
+			if p.Path != "" {
+				msg = p.Path + ": " + msg
+			}
+			// the warnings don't stop run, but the config is not valid
+			if p.Warning {
+				msg = "warning: " + msg
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s:%d: %s\n", cfgFile, p.Line, msg)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("%d problems found", len(problems))
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "%s is valid\n", cfgFile)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
@@ -3,12 +3,15 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"sort"
 
+	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
 	General  GeneralConfig  `yaml:"general"`
+	Store    StoreConfig    `yaml:"store"`
 	Adapters AdaptersConfig `yaml:"adapters"`
 }
 
@@ -17,6 +20,11 @@ func (s *Config) String() string {
 	return string(data)
 }
 
+type StoreConfig struct {
+	Driver string `yaml:"driver"` // memory or bolt
+	Path   string `yaml:"path"`   // database file path of the bolt driver
+}
+
 type BotConfig struct {
 	BotID uint64 `yaml:"bot_id"`
 	Lang  string `yaml:"lang"`
@@ -28,15 +36,71 @@ type BotasticConfig struct {
 	Debug bool   `yaml:"debug"`
 }
 
+type BackendConfig struct {
+	Driver string        `yaml:"driver"` // botastic or openai, defaults to botastic
+	OpenAI *OpenAIConfig `yaml:"openai,omitempty"`
+}
+
+// OpenAIConfig is the config of an OpenAI compatible chat completions API.
+type OpenAIConfig struct {
+	BaseURL      string `yaml:"base_url"` // e.g. https://api.openai.com/v1
+	APIKey       string `yaml:"api_key"`
+	Model        string `yaml:"model"`
+	SystemPrompt string `yaml:"system_prompt"`
+	MaxHistory   int    `yaml:"max_history"` // turns sent as context, defaults to 10, negative means all
+	Timeout      int64  `yaml:"timeout"`     // seconds of a request, defaults to 60
+}
+
 type GeneralOptionsConfig struct {
 	IgnoreIfError bool `yaml:"ignore_if_error"`
 	FormatLinks   bool `yaml:"format_links"`
+	// max number of conversations handled in parallel, messages of the same
+	// conversation are always handled in order. defaults to 10.
+	Concurrency int `yaml:"concurrency"`
+	// seconds of inactivity after which a new conversation is created for
+	// the user, zero means conversations never expire.
+	ConversationIdleTimeout int64 `yaml:"conversation_idle_timeout"`
+	TurnTimeout             int64 `yaml:"turn_timeout"`       // seconds to wait for a pending turn, defaults to 120
+	TurnPollInterval        int64 `yaml:"turn_poll_interval"` // milliseconds between polls of a pending turn, defaults to 1000
+
+	Retry RetryConfig `yaml:"retry"`
+
+	// stream the reply by editing the sent message, only works with backends
+	// and adapters supporting it, others fall back to the final text.
+	Stream             bool  `yaml:"stream"`
+	StreamEditInterval int64 `yaml:"stream_edit_interval"` // min milliseconds between edits, defaults to 1000
+
+	// show a typing indicator while waiting for the reply
+	ShowTyping bool `yaml:"show_typing"`
+	// append "(1/3)" like markers when a long reply is split into messages
+	NumberParts bool `yaml:"number_parts"`
+
+	// seconds to wait for the messages being handled on shutdown, defaults to 30
+	ShutdownGracePeriod int64 `yaml:"shutdown_grace_period"`
+
+	// user facing messages replied instead of the raw errors, indexed by the
+	// error kind (upstream_unavailable, rate_limited, timeout, not_allowed,
+	// invalid_input or unknown) and then the language, "default" matches any
+	// language. the messages are go templates with .Kind and .Lang.
+	ErrorMessages map[string]map[string]string `yaml:"error_messages,omitempty"`
+}
+
+// RetryConfig is the retry policy of the botastic calls, the wait between
+// attempts grows exponentially with jitter.
+type RetryConfig struct {
+	MaxAttempts    int   `yaml:"max_attempts"`    // 0 or 1 disables retrying
+	InitialBackoff int64 `yaml:"initial_backoff"` // milliseconds, defaults to 500
+	MaxBackoff     int64 `yaml:"max_backoff"`     // milliseconds, defaults to 10000
+	Timeout        int64 `yaml:"timeout"`         // seconds, deadline of handling a message including all attempts, zero means no deadline
+	// error classes to retry on: upstream_unavailable, rate_limited and timeout, defaults to all
+	RetryOn []string `yaml:"retry_on"`
 }
 
 type GeneralConfig struct {
 	Options  *GeneralOptionsConfig `yaml:"options,omitempty"`
 	Bot      *BotConfig            `yaml:"bot,omitempty"`
 	Botastic *BotasticConfig       `yaml:"botastic,omitempty"`
+	Backend  *BackendConfig        `yaml:"backend,omitempty"`
 }
 
 type AdaptersConfig struct {
@@ -44,43 +108,17 @@ type AdaptersConfig struct {
 	Items   map[string]AdapterConfig `yaml:"items"`
 }
 
+// AdapterConfig is the driver and its section named after it, e.g.
+//
+//	driver: telegram
+//	telegram:
+//	  token: xxx
 type AdapterConfig struct {
-	Driver   string          `yaml:"driver"`
-	Mixin    *MixinConfig    `yaml:"mixin,omitempty"`
-	Telegram *TelegramConfig `yaml:"telegram,omitempty"`
-	Discord  *DiscordConfig  `yaml:"discord,omitempty"`
-	WeChat   *WeChatConfig   `yaml:"wechat,omitempty"`
-}
-
-type WeChatConfig struct {
-	GeneralConfig `yaml:",inline"`
-
-	Address string `yaml:"address"`
-	Path    string `yaml:"path"`
-	Token   string `yaml:"token"`
-}
-
-type MixinConfig struct {
-	GeneralConfig `yaml:",inline"`
-
-	Keystore               string   `yaml:"keystore"` // base64 encoded keystore (json format)
-	Whitelist              []string `yaml:"whitelist"`
-	MessageCacheExpiration int64    `yaml:"message_cache_expiration"`
-}
-
-type TelegramConfig struct {
-	GeneralConfig `yaml:",inline"`
-
-	Debug     bool     `yaml:"debug"`
-	Token     string   `yaml:"token"`
-	Whitelist []string `yaml:"whitelist"`
-}
-
-type DiscordConfig struct {
-	GeneralConfig `yaml:",inline"`
-
-	Token     string   `yaml:"token"`
-	Whitelist []string `yaml:"whitelist"`
+	Driver string `yaml:"driver"`
+	// Raw is the section of the driver, with the env vars applied
+	Raw *yaml.Node `yaml:"-"`
+	// Config is the section decoded by the registered driver
+	Config DriverConfig `yaml:"-"`
 }
 
 func DefaultConfig() *Config {
@@ -88,122 +126,49 @@ func DefaultConfig() *Config {
 		General: GeneralConfig{
 			Options: &GeneralOptionsConfig{
 				IgnoreIfError: true,
+				Concurrency:   10,
+				Retry: RetryConfig{
+					MaxAttempts: 3,
+				},
 			},
 			Bot: &BotConfig{
 				Lang: "en",
 			},
 		},
-	}
-}
-
-func ExampleConfig() *Config {
-	return &Config{
-		General: GeneralConfig{
-			Bot: &BotConfig{
-				BotID: 1,
-				Lang:  "en",
-			},
-			Botastic: &BotasticConfig{
-				AppId: "cab1582e-9c30-4d1e-9246-a5c80f74f8f9",
-				Host:  "https://botastic-api.pando.im",
-				Debug: true,
-			},
-		},
-		Adapters: AdaptersConfig{
-			Enabled: []string{"test_mixin", "test_telegram", "test_discord", "test_wechat"},
-			Items: map[string]AdapterConfig{
-				"test_mixin": {
-					Driver: "mixin",
-					Mixin: &MixinConfig{
-						Keystore:               "base64 encoded keystore",
-						Whitelist:              []string{"7000104111", "a8d4e38e-9317-4529-8ca9-4289d4668111"},
-						MessageCacheExpiration: 60 * 60 * 24,
-					},
-				},
-				"test_telegram": {
-					Driver: "telegram",
-					Telegram: &TelegramConfig{
-						Debug:     true,
-						Token:     "1234567890:ABCDEFGHIJKLMNOPQRSTUVWXYZ",
-						Whitelist: []string{"-10540154212", "xx"},
-						GeneralConfig: GeneralConfig{
-							Bot: &BotConfig{
-								BotID: 2,
-								Lang:  "zh",
-							},
-							Botastic: &BotasticConfig{
-								AppId: "cab1582e-9c30-4d1e-9246-a5c80f74f8f9",
-								Host:  "https://botastic-api.pando.im",
-							},
-						},
-					},
-				},
-				"test_discord": {
-					Driver: "discord",
-					Discord: &DiscordConfig{
-						Token:     "1234567890",
-						Whitelist: []string{"1093104389113266186"},
-					},
-				},
-				"test_wechat": {
-					Driver: "wechat",
-					WeChat: &WeChatConfig{
-						Address: ":8080",
-						Path:    "/wechat",
-						Token:   "123456",
-					},
-				},
-			},
+		Store: StoreConfig{
+			Driver: "memory",
 		},
 	}
 }
 
-func (c Config) validate() error {
-	for _, name := range c.Adapters.Enabled {
-		if _, ok := c.Adapters.Items[name]; !ok {
-			return fmt.Errorf("adapter not found: %s", name)
-		}
-	}
-	for name, c := range c.Adapters.Items {
-		switch c.Driver {
-		case "mixin":
-			if c.Mixin == nil {
-				return fmt.Errorf("config not found, name: %s, driver: %s", name, c.Driver)
-			}
-		case "telegram":
-			if c.Telegram == nil {
-				return fmt.Errorf("config not found, name: %s, driver: %s", name, c.Driver)
-			}
-		case "discord":
-			if c.Discord == nil {
-				return fmt.Errorf("config not found, name: %s, driver: %s", name, c.Driver)
-			}
-		case "wechat":
-			if c.WeChat == nil {
-				return fmt.Errorf("config not found, name: %s, driver: %s", name, c.Driver)
-			}
-		default:
-			return fmt.Errorf("invalid driver, name: %s, driver: %s", name, c.Driver)
-		}
-	}
-	return nil
-}
-
+// Init reads the config of the file, it fails only if the config has any
+// problem affecting the adapters enabled.
 func Init(fp string) (*Config, error) {
-	c := DefaultConfig()
-
 	data, err := ioutil.ReadFile(fp)
 	if err != nil {
 		return nil, fmt.Errorf("ioutil.ReadFile error: %w", err)
 	}
 
-	if err := yaml.Unmarshal(data, c); err != nil {
+	c, problems, err := Lint(data)
+	if err != nil {
 		return nil, fmt.Errorf("yaml.Unmarshal error: %w", err)
 	}
-
-	if err := c.validate(); err != nil {
-		return nil, fmt.Errorf("validate error: %w", err)
+	// the warnings are only reported by validate and logged here
+	if errs := problems.Errors(); len(errs) > 0 {
+		return nil, fmt.Errorf("validate error: %w", errs)
+	}
+	for _, p := range problems {
+		logrus.WithField("component", "config").Warn(p.String())
 	}
 
 	return c, nil
 }
+
+func sortedKeys(m map[string]AdapterConfig) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DriverConfig is the config of an adapter driver, it embeds GeneralConfig
+// with `yaml:",inline"` to override the general config.
+type DriverConfig interface {
+	General() GeneralConfig
+}
+
+// ServerConfig is implemented by the driver configs running an http server,
+// the enabled adapters can't listen on the same address. An empty address
+// means no server is run.
+type ServerConfig interface {
+	ListenAddress() string
+}
+
+// Driver decodes and checks the config of an adapter driver, the section
+// named after the driver in the adapter config.
+type Driver struct {
+	// NewConfig returns a pointer to the config with the defaults, the
+	// section is decoded into it.
+	NewConfig func() DriverConfig
+	// Validate returns the problems of the decoded config, the paths are
+	// relative to the section, e.g. token or whitelist[0]. optional.
+	Validate func(cfg DriverConfig) []Problem
+}
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]Driver)
+)
+
+// RegisterDriver makes the config of a driver available by the name, it
+// panics if called twice for the same name.
+func RegisterDriver(name string, d Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	if d.NewConfig == nil {
+		panic("config: RegisterDriver config is nil")
+	}
+	if _, dup := drivers[name]; dup {
+		panic("config: RegisterDriver called twice for driver " + name)
+	}
+	drivers[name] = d
+}
+
+// LookupDriver returns the registered driver of the name.
+func LookupDriver(name string) (Driver, bool) {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	d, ok := drivers[name]
+	return d, ok
+}
+
+// Drivers returns the sorted names of the registered drivers.
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// driverFields returns the config types of the registered drivers by their
+// section keys.
+func driverFields() map[string]reflect.Type {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	fields := make(map[string]reflect.Type, len(drivers))
+	for name, d := range drivers {
+		fields[name] = reflect.TypeOf(d.NewConfig())
+	}
+	return fields
+}
+
+// UnmarshalYAML keeps the raw section of the driver and decodes it by the
+// registered driver, the config is left nil if the driver is unknown or the
+// section is missing.
+func (a *AdapterConfig) UnmarshalYAML(node *yaml.Node) error {
+	var v struct {
+		Driver string `yaml:"driver"`
+	}
+	if err := node.Decode(&v); err != nil {
+		return err
+	}
+
+	a.Driver = v.Driver
+	a.Raw = mappingValue(node, v.Driver)
+	a.Config = nil
+	d, ok := LookupDriver(a.Driver)
+	if !ok || a.Raw == nil {
+		return nil
+	}
+
+	cfg := d.NewConfig()
+	if err := a.Raw.Decode(cfg); err != nil {
+		return err
+	}
+	a.Config = cfg
+	return nil
+}
+
+func (a AdapterConfig) MarshalYAML() (interface{}, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	setMappingValue(node, "driver", &yaml.Node{Kind: yaml.ScalarNode, Value: a.Driver})
+	switch {
+	case a.Config != nil:
+		var section yaml.Node
+		if err := section.Encode(a.Config); err != nil {
+			return nil, err
+		}
+		setMappingValue(node, a.Driver, &section)
+	case a.Raw != nil:
+		setMappingValue(node, a.Driver, a.Raw)
+	}
+	return node, nil
+}
+
+// General returns the general config set in the driver config.
+func (a AdapterConfig) General() GeneralConfig {
+	if a.Config == nil {
+		return GeneralConfig{}
+	}
+	return a.Config.General()
+}
+
+// Equal reports whether the decoded configs are the same, the raw sections
+// may differ in the line numbers only.
+func (a AdapterConfig) Equal(b AdapterConfig) bool {
+	return a.Driver == b.Driver && reflect.DeepEqual(a.Config, b.Config)
+}
+
+// Required returns the problems of the fields not set, by their keys in the
+// section of the driver. It's for the validators of the drivers.
+func Required(fields map[string]string) []Problem {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var problems []Problem
+	for _, k := range keys {
+		if fields[k] == "" {
+			problems = append(problems, Problem{Path: k, Message: k + " is required"})
+		}
+	}
+	return problems
+}
+
+// relativePath splits the path returned by a driver validator.
+func relativePath(path string) []string {
+	return strings.FieldsFunc(path, func(r rune) bool {
+		return r == '.' || r == '[' || r == ']'
+	})
+}
+
+func (c GeneralConfig) General() GeneralConfig {
+	return c
+}
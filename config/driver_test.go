@@ -0,0 +1,73 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+type testDriverConfig struct {
+	GeneralConfig `yaml:",inline"`
+
+	Token     string   `yaml:"token"`
+	Users     []string `yaml:"users"`
+	Whitelist []string `yaml:"whitelist"`
+}
+
+func init() {
+	RegisterDriver("test_driver", Driver{
+		NewConfig: func() DriverConfig { return &testDriverConfig{Token: "default"} },
+		Validate: func(cfg DriverConfig) []Problem {
+			c := cfg.(*testDriverConfig)
+			problems := Required(map[string]string{"token": c.Token})
+			if len(c.Users) > 1 {
+				problems = append(problems, Problem{Path: "users[1]", Message: "only one user is allowed"})
+			}
+			return problems
+		},
+	})
+}
+
+func TestLintDriver(t *testing.T) {
+	t.Setenv("PAL9000_ADAPTERS_ITEMS_T_TOKEN", "env-token")
+
+	data := []byte(`general:
+  bot:
+    bot_id: 1
+  botastic:
+    app_id: app
+    host: https://botastic-api.pando.im
+adapters:
+  items:
+    t:
+      driver: test_driver
+      test_driver:
+        bot:
+          bot_id: 2
+        users:
+          - a
+          - b
+`)
+
+	c, problems, err := Lint(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].String() != "line 16: adapters.items.t.test_driver.users[1]: only one user is allowed" {
+		t.Errorf("Lint() = %q", problems)
+	}
+
+	a := c.Adapters.Items["t"]
+	cfg, ok := a.Config.(*testDriverConfig)
+	if !ok {
+		t.Fatalf("config = %T", a.Config)
+	}
+	if cfg.Token != "env-token" || !reflect.DeepEqual(cfg.Users, []string{"a", "b"}) {
+		t.Errorf("config = %+v", cfg)
+	}
+	if a.General().Bot.BotID != 2 {
+		t.Errorf("general = %+v", a.General())
+	}
+	if a.Raw == nil || a.Raw.Line != 12 {
+		t.Errorf("raw = %+v", a.Raw)
+	}
+}
@@ -0,0 +1,285 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The secrets don't have to be written in the config file:
+//
+//   - ${ENV_VAR} and ${ENV_VAR:-default} in the values are expanded.
+//   - a key with the "_file" suffix, e.g. token_file, reads the value of the
+//     key from the file, as the docker and kubernetes secrets are mounted.
+//   - the env vars named after the path of a key override it, e.g.
+//     PAL9000_GENERAL_BOTASTIC_APP_ID or PAL9000_ADAPTERS_ITEMS_<NAME>_TOKEN,
+//     where the keys of the driver config come right after the adapter name.
+//     The "_FILE" suffix reads the value from the file, and lists are comma
+//     separated. Only the adapters in the file can be overridden.
+
+const envPrefix = "PAL9000"
+
+var (
+	envVarRegex       = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+	adapterConfigType = reflect.TypeOf(AdapterConfig{})
+)
+
+// preprocess applies the env vars and secret files to the yaml document
+// before decoding.
+func (l *linter) preprocess(doc *yaml.Node, t reflect.Type) {
+	l.expandEnv(doc)
+	l.secretFiles(doc, t)
+	l.envOverride(doc, t, envPrefix)
+}
+
+func (l *linter) expandEnv(node *yaml.Node) {
+	if node.Kind == yaml.ScalarNode {
+		if !strings.Contains(node.Value, "${") {
+			return
+		}
+
+		node.Value = envVarRegex.ReplaceAllStringFunc(node.Value, func(s string) string {
+			m := envVarRegex.FindStringSubmatch(s)
+			v, ok := os.LookupEnv(m[1])
+			if m[2] == "" && !ok {
+				l.problems = append(l.problems, Problem{
+					Line:    node.Line,
+					Message: fmt.Sprintf("env var %s is not set", m[1]),
+				})
+			}
+			// the default is used if the var is unset or empty
+			if v == "" {
+				return m[3]
+			}
+			return v
+		})
+		// resolve the plain value again, e.g. bot_id: ${BOT_ID} is an int
+		if node.Style == 0 {
+			node.Tag = ""
+		}
+		return
+	}
+
+	for i, n := range node.Content {
+		// skip the keys of the mappings
+		if node.Kind == yaml.MappingNode && i%2 == 0 {
+			continue
+		}
+		l.expandEnv(n)
+	}
+}
+
+// secretFiles replaces the "<key>_file" keys of the struct t with the key
+// and the content of the file.
+func (l *linter) secretFiles(node *yaml.Node, t reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyNode, value := node.Content[i], node.Content[i+1]
+			if ft, ok := fields[keyNode.Value]; ok {
+				l.secretFiles(value, ft)
+				continue
+			}
+
+			key := strings.TrimSuffix(keyNode.Value, "_file")
+			ft, ok := fields[key]
+			if key == keyNode.Value || !ok || !isScalar(ft) {
+				continue
+			}
+			if mappingValue(node, key) != nil {
+				l.problems = append(l.problems, Problem{
+					Line:    keyNode.Line,
+					Message: fmt.Sprintf("both %s and %s are set", key, keyNode.Value),
+				})
+				continue
+			}
+
+			secret, err := readSecret(value.Value)
+			if err != nil {
+				l.problems = append(l.problems, Problem{Line: value.Line, Message: err.Error()})
+				continue
+			}
+			keyNode.Value = key
+			node.Content[i+1] = scalarNode(secret, ft, value.Line)
+		}
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Map:
+		for i := 1; i < len(node.Content); i += 2 {
+			l.secretFiles(node.Content[i], t.Elem())
+		}
+	case node.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for _, item := range node.Content {
+			l.secretFiles(item, t.Elem())
+		}
+	}
+}
+
+// envOverride returns the node of type t overridden by the env vars named
+// after name, node is nil if it's not set in the file, and so is the result
+// if no env var is set.
+func (l *linter) envOverride(node *yaml.Node, t reflect.Type, name string) (result *yaml.Node) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if !hasEnvPrefix(name + "_") {
+			return node
+		}
+		created := node == nil
+		if created {
+			node = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		if node.Kind != yaml.MappingNode {
+			return node
+		}
+		// don't add an empty section which would override the defaults
+		defer func() {
+			if created && len(node.Content) == 0 {
+				result = nil
+			}
+		}()
+
+		fields := yamlFields(t)
+		if t == adapterConfigType {
+			// the keys of the driver config come right after the adapter name
+			driver := l.envOverride(mappingValue(node, "driver"), fields["driver"], name+"_DRIVER")
+			if driver == nil {
+				return node
+			}
+			setMappingValue(node, "driver", driver)
+			if ft, ok := fields[driver.Value]; ok {
+				if v := l.envOverride(mappingValue(node, driver.Value), ft, name); v != nil {
+					setMappingValue(node, driver.Value, v)
+				}
+			}
+			return node
+		}
+
+		keys := make([]string, 0, len(fields))
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if v := l.envOverride(mappingValue(node, key), fields[key], name+"_"+envName(key)); v != nil {
+				setMappingValue(node, key, v)
+			}
+		}
+		return node
+	case reflect.Map:
+		if node == nil || node.Kind != yaml.MappingNode {
+			return node
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			node.Content[i+1] = l.envOverride(node.Content[i+1], t.Elem(), name+"_"+envName(node.Content[i].Value))
+		}
+		return node
+	case reflect.Slice:
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return node
+		}
+		seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				seq.Content = append(seq.Content, scalarNode(item, t.Elem(), 0))
+			}
+		}
+		return seq
+	}
+
+	if v, ok := os.LookupEnv(name); ok {
+		return scalarNode(v, t, 0)
+	}
+	if fp, ok := os.LookupEnv(name + "_FILE"); ok {
+		secret, err := readSecret(fp)
+		if err != nil {
+			l.problems = append(l.problems, Problem{Message: fmt.Sprintf("%s_FILE: %v", name, err)})
+			return node
+		}
+		return scalarNode(secret, t, 0)
+	}
+	return node
+}
+
+func hasEnvPrefix(prefix string) bool {
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// envName converts a yaml key to its env var form, e.g. bot-id to BOT_ID.
+func envName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+func readSecret(fp string) (string, error) {
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return "", fmt.Errorf("read secret file error: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func isScalar(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Ptr, reflect.Interface:
+		return false
+	}
+	return true
+}
+
+// scalarNode returns the node of the value for a field of type t, strings
+// are always tagged as strings so a token like 123456 still decodes.
+func scalarNode(value string, t reflect.Type, line int) *yaml.Node {
+	node := &yaml.Node{Kind: yaml.ScalarNode, Value: value, Line: line}
+	if t.Kind() == reflect.String {
+		node.Tag = "!!str"
+	}
+	return node
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func setMappingValue(node *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content[i+1] = value
+			return
+		}
+	}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
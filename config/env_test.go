@@ -0,0 +1,77 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLintEnv(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("BOT_ID", "7")
+	t.Setenv("PAL9000_GENERAL_BOTASTIC_APP_ID", "env-app")
+	t.Setenv("PAL9000_ADAPTERS_ITEMS_TEST_A_TOKEN", "123456")
+	t.Setenv("PAL9000_ADAPTERS_ITEMS_TEST_A_WHITELIST", "1, 2")
+	t.Setenv("PAL9000_ADAPTERS_ITEMS_TEST_B_TOKEN_FILE", tokenFile)
+
+	data := []byte(`general:
+  bot:
+    bot_id: ${BOT_ID}
+    lang: ${BOT_LANG:-zh}
+  botastic:
+    host: https://botastic-api.pando.im
+adapters:
+  items:
+    test_a:
+      driver: test_driver
+    test_b:
+      driver: test_driver
+      test_driver: {}
+`)
+
+	c, problems, err := Lint(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) > 0 {
+		t.Fatalf("unexpected problems: %q", problems)
+	}
+
+	if c.General.Bot.BotID != 7 || c.General.Bot.Lang != "zh" {
+		t.Errorf("bot = %+v", c.General.Bot)
+	}
+	if c.General.Botastic.AppId != "env-app" {
+		t.Errorf("app_id = %q", c.General.Botastic.AppId)
+	}
+	a := c.Adapters.Items["test_a"].Config.(*testDriverConfig)
+	if a.Token != "123456" || !reflect.DeepEqual(a.Whitelist, []string{"1", "2"}) {
+		t.Errorf("test_a = %+v", a)
+	}
+	if token := c.Adapters.Items["test_b"].Config.(*testDriverConfig).Token; token != "file-token" {
+		t.Errorf("test_b token = %q", token)
+	}
+}
+
+func TestLintEnvNotSet(t *testing.T) {
+	data := []byte(`general:
+  botastic:
+    app_id: ${PAL9000_TEST_UNSET_VAR}
+`)
+
+	_, problems, err := Lint(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		if p.String() == "line 3: env var PAL9000_TEST_UNSET_VAR is not set" {
+			return
+		}
+	}
+	t.Errorf("Lint() = %q", problems)
+}
@@ -0,0 +1,403 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is a problem found in the config.
+type Problem struct {
+	Line    int    // line in the yaml file, zero if unknown
+	Path    string // e.g. adapters.items.test_telegram.telegram.token
+	Message string
+	// Warning doesn't stop the bots from running, e.g. an unknown field or a
+	// problem of the adapters not enabled
+	Warning bool
+}
+
+func (p Problem) String() string {
+	s := p.Message
+	if p.Path != "" {
+		s = p.Path + ": " + s
+	}
+	if p.Line > 0 {
+		s = fmt.Sprintf("line %d: %s", p.Line, s)
+	}
+	return s
+}
+
+// Problems is returned as the error of Init if the config has any problem
+// which is not a warning.
+type Problems []Problem
+
+// Errors returns the problems which are not warnings.
+func (ps Problems) Errors() Problems {
+	var errs Problems
+	for _, p := range ps {
+		if !p.Warning {
+			errs = append(errs, p)
+		}
+	}
+	return errs
+}
+
+func (ps Problems) Error() string {
+	msgs := make([]string, len(ps))
+	for i, p := range ps {
+		msgs[i] = p.String()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Lint parses the config and checks it deeply, it reports all the problems
+// found instead of stopping at the first one. The error is only returned if
+// the data is not valid yaml.
+func Lint(data []byte) (*Config, Problems, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, nil, err
+	}
+
+	// an empty file can still be configured by the env vars
+	if len(root.Content) == 0 {
+		root.Kind = yaml.DocumentNode
+		root.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+
+	l := &linter{root: &root}
+	c := DefaultConfig()
+	doc, t := root.Content[0], reflect.TypeOf(c).Elem()
+	l.preprocess(doc, t)
+	l.unknownFields(doc, t, nil)
+	if err := doc.Decode(c); err != nil {
+		l.typeErrors(err)
+	}
+
+	l.config(c)
+	sort.SliceStable(l.problems, func(i, j int) bool {
+		return l.problems[i].Line < l.problems[j].Line
+	})
+	return c, l.problems, nil
+}
+
+// MergeGeneralConfig returns the default general config overridden by the
+// sections set in the adapter.
+func MergeGeneralConfig(defaultCfg, overrideCfg GeneralConfig) GeneralConfig {
+	cfg := defaultCfg
+	if overrideCfg.Bot != nil {
+		cfg.Bot = overrideCfg.Bot
+	}
+	if overrideCfg.Botastic != nil {
+		cfg.Botastic = overrideCfg.Botastic
+	}
+	if overrideCfg.Options != nil {
+		cfg.Options = overrideCfg.Options
+	}
+	if overrideCfg.Backend != nil {
+		cfg.Backend = overrideCfg.Backend
+	}
+
+	return cfg
+}
+
+type linter struct {
+	root     *yaml.Node
+	problems Problems
+	// the indexes of the problems reported
+	seen map[string]int
+
+	enabled map[string]bool
+	// the adapter being checked, empty for the sections of all adapters
+	adapter string
+}
+
+// add reports a problem at path, the line is the one of the deepest node
+// found along the path. It's a warning if only found in the adapters not
+// enabled.
+func (l *linter) add(path []string, format string, args ...interface{}) {
+	p := Problem{
+		Line:    l.line(path),
+		Path:    formatPath(path),
+		Message: fmt.Sprintf(format, args...),
+		Warning: l.adapter != "" && !l.enabled[l.adapter],
+	}
+
+	// the general config is checked once for every adapter using it
+	if l.seen == nil {
+		l.seen = make(map[string]int)
+	}
+	key := p.String()
+	if i, ok := l.seen[key]; ok {
+		l.problems[i].Warning = l.problems[i].Warning && p.Warning
+		return
+	}
+	l.seen[key] = len(l.problems)
+	l.problems = append(l.problems, p)
+}
+
+func (l *linter) line(path []string) int {
+	node := l.root.Content[0]
+	line := node.Line
+	for _, seg := range path {
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == seg {
+					line = node.Content[i].Line
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if i, err := strconv.Atoi(seg); err == nil && i < len(node.Content) {
+				next = node.Content[i]
+			}
+		}
+		if next == nil {
+			break
+		}
+		// the nodes set by the env vars have no line
+		if (next.Kind == yaml.ScalarNode || next.Kind == yaml.SequenceNode) && next.Line > 0 {
+			line = next.Line
+		}
+		node = next
+	}
+	return line
+}
+
+func formatPath(path []string) string {
+	var b strings.Builder
+	for _, seg := range path {
+		if _, err := strconv.Atoi(seg); err == nil {
+			b.WriteString("[" + seg + "]")
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString(".")
+		}
+		b.WriteString(seg)
+	}
+	return b.String()
+}
+
+// unknownFields reports the keys not matching any field, mostly typos which
+// yaml silently ignores.
+func (l *linter) unknownFields(node *yaml.Node, t reflect.Type, path []string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i].Value, node.Content[i+1]
+			ft, ok := fields[key]
+			// the section of an invalid driver is reported by the driver
+			if !ok && t == adapterConfigType && isDriverKey(node, key) {
+				continue
+			}
+			if !ok {
+				l.problems = append(l.problems, Problem{
+					Line:    node.Content[i].Line,
+					Path:    formatPath(appendPath(path, key)),
+					Message: "unknown field",
+					Warning: true,
+				})
+				continue
+			}
+			l.unknownFields(value, ft, appendPath(path, key))
+		}
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Map:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			l.unknownFields(node.Content[i+1], t.Elem(), appendPath(path, node.Content[i].Value))
+		}
+	case node.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for i, item := range node.Content {
+			l.unknownFields(item, t.Elem(), appendPath(path, strconv.Itoa(i)))
+		}
+	}
+}
+
+// yamlFields returns the types of the fields of the struct by their yaml
+// keys, including the ones of the inline structs. The adapter config has the
+// sections of the registered drivers.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	if t == adapterConfigType {
+		fields = driverFields()
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		tag := f.Tag.Get("yaml")
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(opts, "inline") {
+			for k, v := range yamlFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+func isDriverKey(node *yaml.Node, key string) bool {
+	driver := mappingValue(node, "driver")
+	return driver != nil && driver.Value == key
+}
+
+func appendPath(path []string, seg ...string) []string {
+	return append(append([]string{}, path...), seg...)
+}
+
+var typeErrorRegex = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+func (l *linter) typeErrors(err error) {
+	te, ok := err.(*yaml.TypeError)
+	if !ok {
+		l.problems = append(l.problems, Problem{Message: err.Error()})
+		return
+	}
+
+	for _, msg := range te.Errors {
+		p := Problem{Message: msg}
+		if m := typeErrorRegex.FindStringSubmatch(msg); m != nil {
+			p.Line, _ = strconv.Atoi(m[1])
+			p.Message = m[2]
+		}
+		l.problems = append(l.problems, p)
+	}
+}
+
+func (l *linter) config(c *Config) {
+	switch c.Store.Driver {
+	case "", "memory":
+	case "bolt":
+		if c.Store.Path == "" {
+			l.add([]string{"store", "path"}, "path is required by the bolt store")
+		}
+	default:
+		l.add([]string{"store", "driver"}, "invalid store driver: %s", c.Store.Driver)
+	}
+
+	enabled := make(map[string]bool)
+	l.enabled = enabled
+	for i, name := range c.Adapters.Enabled {
+		path := []string{"adapters", "enabled", strconv.Itoa(i)}
+		if _, ok := c.Adapters.Items[name]; !ok {
+			l.add(path, "adapter not found: %s", name)
+		}
+		if enabled[name] {
+			l.add(path, "adapter enabled twice: %s", name)
+		}
+		enabled[name] = true
+	}
+
+	if len(c.Adapters.Items) == 0 {
+		l.general(c.General, GeneralConfig{}, nil)
+	}
+
+	addresses := make(map[string]string)
+	for _, name := range sortedKeys(c.Adapters.Items) {
+		a := c.Adapters.Items[name]
+		l.adapter = name
+		path := []string{"adapters", "items", name}
+		driverPath := appendPath(path, a.Driver)
+
+		d, ok := LookupDriver(a.Driver)
+		if !ok {
+			l.add(appendPath(path, "driver"), "invalid driver: %s", a.Driver)
+			continue
+		}
+		if a.Config == nil {
+			l.add(path, "%s config not found", a.Driver)
+			continue
+		}
+		if d.Validate != nil {
+			for _, p := range d.Validate(a.Config) {
+				l.add(appendPath(driverPath, relativePath(p.Path)...), "%s", p.Message)
+			}
+		}
+		if s, ok := a.Config.(ServerConfig); ok && enabled[name] && s.ListenAddress() != "" {
+			if other, ok := addresses[s.ListenAddress()]; ok {
+				l.add(driverPath, "address is already used by %s", other)
+			}
+			addresses[s.ListenAddress()] = name
+		}
+
+		l.general(c.General, a.Config.General(), driverPath)
+	}
+	l.adapter = ""
+}
+
+// general checks the general config merged with the override of the adapter
+// at path, the problems are reported where the sections are set.
+func (l *linter) general(defaultCfg, overrideCfg GeneralConfig, path []string) {
+	cfg := MergeGeneralConfig(defaultCfg, overrideCfg)
+	sectionPath := func(overridden bool, section string) []string {
+		if overridden {
+			return appendPath(path, section)
+		}
+		return []string{"general", section}
+	}
+
+	backendPath := sectionPath(overrideCfg.Backend != nil, "backend")
+	driver := ""
+	if cfg.Backend != nil {
+		driver = cfg.Backend.Driver
+	}
+
+	switch driver {
+	case "", "botastic":
+		botasticPath := sectionPath(overrideCfg.Botastic != nil, "botastic")
+		switch {
+		case cfg.Botastic == nil:
+			l.add(botasticPath, "botastic config is required")
+		default:
+			if cfg.Botastic.AppId == "" {
+				l.add(appendPath(botasticPath, "app_id"), "app_id is required")
+			}
+			if cfg.Botastic.Host == "" {
+				l.add(appendPath(botasticPath, "host"), "host is required")
+			}
+		}
+
+		botPath := sectionPath(overrideCfg.Bot != nil, "bot")
+		if cfg.Bot == nil || cfg.Bot.BotID == 0 {
+			l.add(appendPath(botPath, "bot_id"), "bot_id is required")
+		}
+	case "openai":
+		openaiPath := appendPath(backendPath, "openai")
+		switch {
+		case cfg.Backend.OpenAI == nil:
+			l.add(openaiPath, "openai backend config not found")
+		default:
+			if cfg.Backend.OpenAI.BaseURL == "" {
+				l.add(appendPath(openaiPath, "base_url"), "base_url is required")
+			}
+			if cfg.Backend.OpenAI.Model == "" {
+				l.add(appendPath(openaiPath, "model"), "model is required")
+			}
+		}
+	default:
+		l.add(appendPath(backendPath, "driver"), "invalid backend driver: %s", driver)
+	}
+}
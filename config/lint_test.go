@@ -0,0 +1,85 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	data := []byte(`general:
+  bot:
+    lang: en
+  botastic:
+    host: https://botastic-api.pando.im
+adapters:
+  enabled: [t1, missing]
+  items:
+    t1:
+      driver: test_driver
+      test_driver:
+        token: ""
+        bot:
+          bot_id: 2
+    t2:
+      driver: test_driver
+      test_driver:
+        users: [c, d]
+`)
+
+	_, problems, err := Lint(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.String())
+	}
+	want := []string{
+		"line 2: general.bot.bot_id: bot_id is required",
+		"line 4: general.botastic.app_id: app_id is required",
+		"line 7: adapters.enabled[1]: adapter not found: missing",
+		"line 12: adapters.items.t1.test_driver.token: token is required",
+		"line 18: adapters.items.t2.test_driver.users[1]: only one user is allowed",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Lint() =\n%q\nwant\n%q", got, want)
+	}
+
+	// the problems only found in t2 don't stop run as it's not enabled
+	got = nil
+	for _, p := range problems.Errors() {
+		got = append(got, p.String())
+	}
+	want = []string{
+		"line 4: general.botastic.app_id: app_id is required",
+		"line 7: adapters.enabled[1]: adapter not found: missing",
+		"line 12: adapters.items.t1.test_driver.token: token is required",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Errors() =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestLintUnknownFields(t *testing.T) {
+	data := []byte(`general:
+  bot:
+    bot_id: 1
+  botastic:
+    app_id: app
+    host: https://botastic-api.pando.im
+  options:
+    strem: true
+`)
+
+	_, problems, err := Lint(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].String() != "line 8: general.options.strem: unknown field" {
+		t.Errorf("Lint() = %q", problems)
+	}
+	if errs := problems.Errors(); len(errs) > 0 {
+		t.Errorf("unknown field is not a warning: %q", errs)
+	}
+}
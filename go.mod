@@ -10,8 +10,9 @@ require (
 	github.com/pandodao/botastic-go v0.0.2
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/sirupsen/logrus v1.9.0
+	github.com/slack-go/slack v0.14.0
 	github.com/spf13/cobra v1.6.1
-	golang.org/x/sync v0.2.0
+	go.etcd.io/bbolt v1.3.7
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -33,6 +34,7 @@ require (
 	github.com/zeebo/blake3 v0.2.3 // indirect
 	golang.org/x/crypto v0.9.0 // indirect
 	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/sync v0.2.0 // indirect
 	golang.org/x/sys v0.8.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.30.0 // indirect
@@ -0,0 +1,156 @@
+package dingtalk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pandodao/PAL9000/internal/token"
+)
+
+// client calls the robot apis with the access token of the app and posts to
+// the session webhooks.
+type client struct {
+	apiURL    string
+	appKey    string
+	appSecret string
+	http      *http.Client
+	tokens    *token.Cache
+}
+
+func newClient(apiURL, appKey, appSecret string) *client {
+	c := &client{
+		apiURL:    apiURL,
+		appKey:    appKey,
+		appSecret: appSecret,
+		http:      &http.Client{Timeout: 30 * time.Second},
+	}
+	c.tokens = token.NewCache(c.accessToken)
+	return c
+}
+
+// Error is the error response of the apis, the session webhook responds the
+// errcode and errmsg.
+type Error struct {
+	StatusCode int
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	ErrCode    int    `json:"errcode"`
+	ErrMsg     string `json:"errmsg"`
+}
+
+func (e *Error) Error() string {
+	if e.ErrCode != 0 {
+		return fmt.Sprintf("dingtalk error %d: %s", e.ErrCode, e.ErrMsg)
+	}
+	return fmt.Sprintf("dingtalk %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func (c *client) accessToken(ctx context.Context) (string, time.Duration, error) {
+	var resp struct {
+		AccessToken string `json:"accessToken"`
+		ExpireIn    int64  `json:"expireIn"` // seconds
+	}
+	body := map[string]string{"appKey": c.appKey, "appSecret": c.appSecret}
+	if err := c.do(ctx, c.url("/v1.0/oauth2/accessToken"), "", body, &resp); err != nil {
+		return "", 0, err
+	}
+	return resp.AccessToken, time.Duration(resp.ExpireIn) * time.Second, nil
+}
+
+func (c *client) url(path string) string {
+	return strings.TrimRight(c.apiURL, "/") + path
+}
+
+// call posts to the api with the access token.
+func (c *client) call(ctx context.Context, path string, body interface{}) error {
+	return c.tokens.Do(ctx, func(token string) (bool, error) {
+		err := c.do(ctx, c.url(path), token, body, nil)
+		e, ok := err.(*Error)
+		return ok && e.StatusCode == http.StatusUnauthorized, err
+	})
+}
+
+func (c *client) do(ctx context.Context, u, token string, body, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("x-acs-dingtalk-access-token", token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		e := &Error{StatusCode: resp.StatusCode}
+		json.Unmarshal(data, e)
+		return e
+	}
+	// the session webhook responds 200 with the errcode
+	var e Error
+	if json.Unmarshal(data, &e) == nil && e.ErrCode != 0 {
+		e.StatusCode = resp.StatusCode
+		return &e
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+// sendWebhook replies by the session webhook of the callback, the sender is
+// mentioned in the group.
+func (c *client) sendWebhook(ctx context.Context, webhookURL, text string, atUserIDs []string) error {
+	body := map[string]interface{}{
+		"msgtype": "text",
+		"text":    map[string]string{"content": text},
+		"at":      map[string]interface{}{"atUserIds": atUserIDs},
+	}
+	return c.do(ctx, webhookURL, "", body, nil)
+}
+
+// sendGroup sends a text message of the robot to the group.
+func (c *client) sendGroup(ctx context.Context, robotCode, conversationID, text string) error {
+	body := map[string]string{
+		"robotCode":          robotCode,
+		"openConversationId": conversationID,
+		"msgKey":             "sampleText",
+		"msgParam":           textParam(text),
+	}
+	return c.call(ctx, "/v1.0/robot/groupMessages/send", body)
+}
+
+// sendUser sends a text message of the robot to the user in the single chat.
+func (c *client) sendUser(ctx context.Context, robotCode, userID, text string) error {
+	body := map[string]interface{}{
+		"robotCode": robotCode,
+		"userIds":   []string{userID},
+		"msgKey":    "sampleText",
+		"msgParam":  textParam(text),
+	}
+	return c.call(ctx, "/v1.0/robot/oToMessages/batchSend", body)
+}
+
+func textParam(text string) string {
+	data, _ := json.Marshal(map[string]string{"content": text})
+	return string(data)
+}
@@ -0,0 +1,363 @@
+// Package dingtalk is the adapter of the dingtalk driver, it receives the
+// messages of an enterprise robot by the outgoing callbacks and replies by
+// the session webhook, or by the robot api once the webhook expired.
+package dingtalk
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pandodao/PAL9000/config"
+	"github.com/pandodao/PAL9000/internal/webhook"
+	"github.com/pandodao/PAL9000/service"
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	_ service.Adapter           = (*Bot)(nil)
+	_ service.ReloadableAdapter = (*Bot)(nil)
+	_ config.ServerConfig       = (*Config)(nil)
+)
+
+const (
+	defaultAPIURL = "https://api.dingtalk.com"
+	defaultPath   = "/dingtalk/callback"
+	// max bytes of the content of a text message
+	messageLimit = 4000
+	// the callbacks older than it are rejected
+	timestampTolerance = time.Hour
+	// the session webhook is not used when it's about to expire
+	webhookExpiryMargin = time.Minute
+	msgDedupExpiration  = time.Hour
+
+	// the conversation type of the group chats, it's 1 for the single chats
+	conversationGroup = "2"
+)
+
+// Config is of the robot of an internal app, its message receiving url is the
+// address and path.
+type Config struct {
+	config.GeneralConfig `yaml:",inline"`
+
+	// the client id and secret of the app, the callbacks are signed by the
+	// secret
+	AppKey    string `yaml:"app_key"`
+	AppSecret string `yaml:"app_secret"`
+	RobotCode string `yaml:"robot_code"` // defaults to app_key
+	Address   string `yaml:"address"`    // e.g. :8080
+	Path      string `yaml:"path"`       // defaults to /dingtalk/callback
+	// staff ids or conversation ids allowed to talk to the bot
+	Whitelist []string `yaml:"whitelist"`
+	// defaults to https://api.dingtalk.com
+	APIURL string `yaml:"api_url"`
+}
+
+func (c *Config) ListenAddress() string {
+	return c.Address
+}
+
+func (c Config) robotCode() string {
+	if c.RobotCode == "" {
+		return c.AppKey
+	}
+	return c.RobotCode
+}
+
+func init() {
+	service.RegisterDriver("dingtalk", service.Driver{
+		Config: config.Driver{
+			NewConfig: func() config.DriverConfig {
+				return &Config{Path: defaultPath, APIURL: defaultAPIURL}
+			},
+			Validate: validate,
+		},
+		New: func(ctx context.Context, name string, cfg config.DriverConfig) (service.Adapter, error) {
+			return New(ctx, name, *cfg.(*Config))
+		},
+	})
+}
+
+func validate(cfg config.DriverConfig) []config.Problem {
+	c := cfg.(*Config)
+	problems := config.Required(map[string]string{
+		"app_key":    c.AppKey,
+		"app_secret": c.AppSecret,
+		"address":    c.Address,
+	})
+	if !strings.HasPrefix(c.Path, "/") {
+		problems = append(problems, config.Problem{Path: "path", Message: "path must start with /"})
+	}
+	return problems
+}
+
+type replyKey struct{}
+
+// reply is where the reply goes
+type reply struct {
+	conversationID   string
+	conversationType string
+	staffID          string
+	webhookURL       string
+	webhookExpiry    time.Time
+}
+
+type callback struct {
+	MsgID            string `json:"msgId"`
+	MsgType          string `json:"msgtype"`
+	ConversationID   string `json:"conversationId"`
+	ConversationType string `json:"conversationType"`
+	SenderID         string `json:"senderId"`
+	// empty if the sender is not of the corp
+	SenderStaffID             string `json:"senderStaffId"`
+	ChatbotUserID             string `json:"chatbotUserId"`
+	IsInAtList                bool   `json:"isInAtList"`
+	SessionWebhook            string `json:"sessionWebhook"`
+	SessionWebhookExpiredTime int64  `json:"sessionWebhookExpiredTime"` // ms
+	Text                      struct {
+		Content string `json:"content"`
+	} `json:"text"`
+	AtUsers []struct {
+		DingtalkID string `json:"dingtalkId"`
+		StaffID    string `json:"staffId"`
+	} `json:"atUsers"`
+}
+
+// mentioned reports whether the robot is mentioned, the group robot only
+// receives the messages mentioning it, but it's checked anyway.
+func (c *callback) mentioned() bool {
+	if c.IsInAtList {
+		return true
+	}
+	for _, u := range c.AtUsers {
+		if u.DingtalkID == c.ChatbotUserID {
+			return true
+		}
+	}
+	return false
+}
+
+type Bot struct {
+	name   string
+	server *webhook.Server
+	client *client
+	msgs   *cache.Cache
+	logger logrus.FieldLogger
+
+	mu  sync.RWMutex
+	cfg Config
+}
+
+func New(ctx context.Context, name string, cfg Config) (*Bot, error) {
+	c := newClient(cfg.APIURL, cfg.AppKey, cfg.AppSecret)
+	if _, err := c.tokens.Get(ctx); err != nil {
+		return nil, fmt.Errorf("get access token error: %w", err)
+	}
+
+	logger := logrus.WithField("adapter", "dingtalk").WithField("name", name)
+	server, err := webhook.Listen(cfg.Address, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Bot{
+		name:   name,
+		server: server,
+		client: c,
+		msgs:   cache.New(msgDedupExpiration, 10*time.Minute),
+		logger: logger,
+		cfg:    cfg,
+	}, nil
+}
+
+func (b *Bot) GetName() string {
+	return b.name
+}
+
+func (b *Bot) getConfig() Config {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.cfg
+}
+
+// Reload applies the path, robot code and whitelist, a new app or address
+// needs a restart.
+func (b *Bot) Reload(cfg config.AdapterConfig) bool {
+	c, ok := cfg.Config.(*Config)
+	if !ok {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.AppKey != b.cfg.AppKey || c.AppSecret != b.cfg.AppSecret || c.Address != b.cfg.Address || c.APIURL != b.cfg.APIURL {
+		return false
+	}
+	b.cfg = *c
+	return true
+}
+
+func (b *Bot) GetMessageChan(ctx context.Context) <-chan *service.Message {
+	msgChan := make(chan *service.Message)
+	b.server.Serve(b.callbackHandler(ctx, msgChan))
+	return msgChan
+}
+
+// Close shuts the server down after the pending callbacks are answered.
+func (b *Bot) Close() error {
+	return b.server.Close()
+}
+
+// sign is the sign header of the callback.
+func sign(timestamp, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + secret))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifySign(timestamp, signature, secret string, now time.Time) bool {
+	ms, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if d := now.Sub(time.UnixMilli(ms)); d > timestampTolerance || d < -timestampTolerance {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(sign(timestamp, secret)))
+}
+
+func (b *Bot) callbackHandler(ctx context.Context, msgChan chan<- *service.Message) http.HandlerFunc {
+	// the callbacks are answered right away, the messages are handed off
+	// after them in order
+	queue := webhook.NewQueue(ctx)
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := b.getConfig()
+		if r.URL.Path != cfg.Path {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if ctx.Err() != nil {
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if !verifySign(r.Header.Get("timestamp"), r.Header.Get("sign"), cfg.AppSecret, time.Now()) {
+			http.Error(w, "Invalid sign", http.StatusUnauthorized)
+			return
+		}
+
+		body, err := webhook.ReadBody(w, r)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		var cb callback
+		if err := json.Unmarshal(body, &cb); err != nil {
+			http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+			return
+		}
+
+		// the reply is sent by the session webhook, the callback is
+		// answered empty
+		if msg := b.message(&cb); msg != nil {
+			queue.Send(msgChan, msg)
+		}
+	}
+}
+
+func (b *Bot) message(cb *callback) *service.Message {
+	if cb.MsgType != "text" || (cb.ConversationType == conversationGroup && !cb.mentioned()) {
+		return nil
+	}
+	// the users not of the corp have no staff id
+	userID := cb.SenderStaffID
+	if userID == "" {
+		userID = cb.SenderID
+	}
+	if !b.allowed(userID, cb.ConversationID) || b.duplicate(cb.MsgID) {
+		return nil
+	}
+
+	r := reply{
+		conversationID:   cb.ConversationID,
+		conversationType: cb.ConversationType,
+		staffID:          cb.SenderStaffID,
+		webhookURL:       cb.SessionWebhook,
+		webhookExpiry:    time.UnixMilli(cb.SessionWebhookExpiredTime),
+	}
+	return &service.Message{
+		Context:      context.WithValue(context.Background(), replyKey{}, r),
+		UserIdentity: userID,
+		ConvKey:      cb.ConversationID,
+		Content:      strings.TrimSpace(cb.Text.Content),
+	}
+}
+
+// duplicate reports whether the message is a retry of a received one, the
+// messages without an id are never deduped.
+func (b *Bot) duplicate(msgID string) bool {
+	return msgID != "" && b.msgs.Add(msgID, true, cache.DefaultExpiration) != nil
+}
+
+func (b *Bot) allowed(userID, conversationID string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if len(b.cfg.Whitelist) == 0 {
+		return true
+	}
+	for _, id := range b.cfg.Whitelist {
+		if id == userID || id == conversationID {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bot) HandleResult(req *service.Message, r *service.Result) {
+	if r.Err != nil && r.IgnoreIfError {
+		return
+	}
+
+	to := req.Context.Value(replyKey{}).(reply)
+	robotCode := b.getConfig().robotCode()
+	for i, text := range r.Parts(service.FormatPlain, messageLimit, service.ByteLength) {
+		if err := b.send(to, robotCode, text, i == 0); err != nil {
+			b.logger.WithError(err).Error("send message error")
+			return
+		}
+	}
+}
+
+// send replies by the session webhook, or by the robot api if it expired.
+func (b *Bot) send(to reply, robotCode, text string, first bool) error {
+	ctx := context.Background()
+	if to.webhookURL != "" && time.Now().Add(webhookExpiryMargin).Before(to.webhookExpiry) {
+		// mention the sender once in the group
+		var at []string
+		if first && to.conversationType == conversationGroup && to.staffID != "" {
+			at = []string{to.staffID}
+		}
+		return b.client.sendWebhook(ctx, to.webhookURL, text, at)
+	}
+
+	if to.conversationType == conversationGroup {
+		return b.client.sendGroup(ctx, robotCode, to.conversationID, text)
+	}
+	if to.staffID == "" {
+		return fmt.Errorf("session webhook expired, the sender is not of the corp")
+	}
+	return b.client.sendUser(ctx, robotCode, to.staffID, text)
+}
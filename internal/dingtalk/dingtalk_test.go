@@ -0,0 +1,259 @@
+package dingtalk
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pandodao/PAL9000/internal/webhook/webhooktest"
+	"github.com/pandodao/PAL9000/service"
+)
+
+// newStub serves the robot apis and the session webhook.
+func newStub(t *testing.T, ts *webhooktest.Tokens) *webhooktest.Stub {
+	authorized := func(w http.ResponseWriter, r *http.Request) {
+		if !ts.Valid(r.Header.Get("x-acs-dingtalk-access-token")) {
+			w.WriteHeader(http.StatusUnauthorized)
+			webhooktest.WriteJSON(w, `{"code":"InvalidAuthentication","message":"invalid token"}`)
+			return
+		}
+		webhooktest.WriteJSON(w, `{}`)
+	}
+	return webhooktest.NewStub(t, map[string]http.HandlerFunc{
+		"/v1.0/oauth2/accessToken": func(w http.ResponseWriter, r *http.Request) {
+			webhooktest.WriteJSON(w, `{"accessToken":"`+ts.Issue()+`","expireIn":7200}`)
+		},
+		"/v1.0/robot/groupMessages/send":    authorized,
+		"/v1.0/robot/oToMessages/batchSend": authorized,
+		"/robot/sendBySession": func(w http.ResponseWriter, r *http.Request) {
+			webhooktest.WriteJSON(w, `{"errcode":0,"errmsg":"ok"}`)
+		},
+	})
+}
+
+// newBot runs the robot against the stub.
+func newBot(t *testing.T, stub *webhooktest.Stub) (*Bot, http.Handler, chan *service.Message) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	b, err := New(ctx, "test", Config{
+		AppKey:    "ding1",
+		AppSecret: "secret",
+		Address:   "127.0.0.1:0",
+		Path:      defaultPath,
+		APIURL:    stub.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	msgChan := make(chan *service.Message)
+	return b, b.callbackHandler(ctx, msgChan), msgChan
+}
+
+func signedRequest(secret, body string) *http.Request {
+	ts := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	req := httptest.NewRequest(http.MethodPost, defaultPath, strings.NewReader(body))
+	req.Header.Set("timestamp", ts)
+	req.Header.Set("sign", sign(ts, secret))
+	return req
+}
+
+type message struct {
+	id, convType, staffID, webhookURL string
+	atList                            bool
+	// the session webhook expires after it, it's expired if zero
+	webhookTTL time.Duration
+}
+
+func (m message) String() string {
+	return `{"msgId":"` + m.id + `","msgtype":"text","conversationId":"cid1","conversationType":"` + m.convType + `",` +
+		`"senderId":"$:LWCP_v1:$x","senderStaffId":"` + m.staffID + `","chatbotUserId":"$:LWCP_v1:$bot",` +
+		`"isInAtList":` + strconv.FormatBool(m.atList) + `,"sessionWebhook":"` + m.webhookURL + `",` +
+		`"sessionWebhookExpiredTime":` + strconv.FormatInt(time.Now().Add(m.webhookTTL).UnixMilli(), 10) +
+		`,"text":{"content":" hello "}}`
+}
+
+// text is the content of the message sent by the webhook or the robot api.
+func text(t *testing.T, call webhooktest.Call) string {
+	t.Helper()
+	body := call.JSON(t)
+	if param, ok := body["msgParam"].(string); ok {
+		var v struct {
+			Content string `json:"content"`
+		}
+		json.Unmarshal([]byte(param), &v)
+		return v.Content
+	}
+	return body["text"].(map[string]interface{})["content"].(string)
+}
+
+func TestSign(t *testing.T) {
+	now := time.Now()
+	ts := strconv.FormatInt(now.UnixMilli(), 10)
+	cases := []struct {
+		name      string
+		timestamp string
+		sign      string
+		now       time.Time
+		want      bool
+	}{
+		{name: "valid", timestamp: ts, sign: sign(ts, "secret"), now: now, want: true},
+		{name: "wrong secret", timestamp: ts, sign: sign(ts, "wrong"), now: now},
+		{name: "expired", timestamp: ts, sign: sign(ts, "secret"), now: now.Add(2 * time.Hour)},
+		{name: "invalid timestamp", timestamp: "abc", sign: sign("abc", "secret"), now: now},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := verifySign(c.timestamp, c.sign, "secret", c.now); got != c.want {
+				t.Errorf("verifySign() = %v, want %v", got, c.want)
+			}
+		})
+	}
+
+	_, h, _ := newBot(t, newStub(t, &webhooktest.Tokens{}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, signedRequest("wrong", message{id: "1", convType: "1"}.String()))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong sign: status = %d", w.Code)
+	}
+}
+
+func TestMessage(t *testing.T) {
+	cases := []struct {
+		name string
+		msg  message
+		// nil if the message is ignored
+		want *service.Message
+	}{
+		{
+			name: "not mentioned in the group",
+			msg:  message{convType: conversationGroup, staffID: "staff1"},
+		},
+		{
+			name: "mentioned in the group",
+			msg:  message{convType: conversationGroup, staffID: "staff1", atList: true},
+			want: &service.Message{Content: "hello", ConvKey: "cid1", UserIdentity: "staff1"},
+		},
+		{
+			name: "sender not of the corp",
+			msg:  message{convType: "1"},
+			want: &service.Message{Content: "hello", ConvKey: "cid1", UserIdentity: "$:LWCP_v1:$x"},
+		},
+	}
+
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, h, msgChan := newBot(t, newStub(t, &webhooktest.Tokens{}))
+			c.msg.id = strconv.Itoa(i)
+			webhooktest.CheckMessage(t, webhooktest.Receive(t, h, signedRequest("secret", c.msg.String()), msgChan), c.want)
+		})
+	}
+}
+
+func TestDedup(t *testing.T) {
+	_, h, msgChan := newBot(t, newStub(t, &webhooktest.Tokens{}))
+
+	body := message{id: "1", convType: "1"}.String()
+	webhooktest.MustReceive(t, h, signedRequest("secret", body), msgChan)
+	if msg := webhooktest.Receive(t, h, signedRequest("secret", body), msgChan); msg != nil {
+		t.Errorf("retried message received: %+v", msg)
+	}
+
+	// the messages without an id are not taken for retries
+	body = message{convType: "1"}.String()
+	for i := 0; i < 2; i++ {
+		if webhooktest.Receive(t, h, signedRequest("secret", body), msgChan) == nil {
+			t.Errorf("message %d without an id not received", i)
+		}
+	}
+}
+
+func TestHandleResult(t *testing.T) {
+	ts := &webhooktest.Tokens{}
+	stub := newStub(t, ts)
+	b, h, msgChan := newBot(t, stub)
+	webhookURL := stub.URL + "/robot/sendBySession?session=s"
+
+	receive := func(m message) *service.Message {
+		t.Helper()
+		return webhooktest.MustReceive(t, h, signedRequest("secret", m.String()), msgChan)
+	}
+
+	// the sender is mentioned by the session webhook
+	msg := receive(message{id: "1", convType: conversationGroup, staffID: "staff1", atList: true, webhookURL: webhookURL, webhookTTL: time.Hour})
+	b.HandleResult(msg, webhooktest.Reply("**yes**"))
+	call := stub.Next(t, "/robot/sendBySession")
+	at := call.JSON(t)["at"].(map[string]interface{})["atUserIds"].([]interface{})
+	if text(t, call) != "yes" || len(at) != 1 || at[0] != "staff1" {
+		t.Errorf("sent = %s", call.Body)
+	}
+
+	// the expired session webhook falls back to the robot api
+	msg = receive(message{id: "2", convType: conversationGroup, staffID: "staff1", atList: true, webhookURL: webhookURL})
+	b.HandleResult(msg, webhooktest.Reply("group"))
+	call = stub.Next(t, "/v1.0/robot/groupMessages/send")
+	if body := call.JSON(t); body["openConversationId"] != "cid1" || body["robotCode"] != "ding1" || text(t, call) != "group" {
+		t.Errorf("sent = %s", call.Body)
+	}
+
+	msg = receive(message{id: "3", convType: "1", staffID: "staff1", webhookURL: webhookURL})
+	for i := 0; i < 2; i++ {
+		b.HandleResult(msg, webhooktest.Reply("single"))
+		call = stub.Next(t, "/v1.0/robot/oToMessages/batchSend")
+		if token := call.Header.Get("x-acs-dingtalk-access-token"); token != "token-1" || text(t, call) != "single" {
+			t.Errorf("sent = %s %s", token, call.Body)
+		}
+	}
+
+	// the token is fetched again once rejected
+	ts.Issue()
+	b.HandleResult(msg, webhooktest.Reply("again"))
+	for _, want := range []string{"token-1", "token-3"} {
+		call = stub.Next(t, "/v1.0/robot/oToMessages/batchSend")
+		if token := call.Header.Get("x-acs-dingtalk-access-token"); token != want || text(t, call) != "again" {
+			t.Errorf("sent = %s %s, want %s", token, call.Body, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  *Config
+		want []string
+	}{
+		{
+			name: "valid",
+			cfg:  &Config{AppKey: "ding1", AppSecret: "secret", Address: ":8080", Path: defaultPath},
+		},
+		{
+			name: "missing",
+			cfg:  &Config{Path: "dingtalk"},
+			want: []string{
+				"address: address is required",
+				"app_key: app_key is required",
+				"app_secret: app_secret is required",
+				"path: path must start with /",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var got []string
+			for _, p := range validate(c.cfg) {
+				got = append(got, p.String())
+			}
+			if strings.Join(got, "\n") != strings.Join(c.want, "\n") {
+				t.Errorf("validate() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
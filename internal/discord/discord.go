@@ -5,23 +5,57 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/pandodao/PAL9000/config"
 	"github.com/pandodao/PAL9000/service"
 )
 
-var _ service.Adapter = (*Bot)(nil)
+var (
+	_ service.Adapter           = (*Bot)(nil)
+	_ service.StreamingAdapter  = (*Bot)(nil)
+	_ service.TypingAdapter     = (*Bot)(nil)
+	_ service.ReloadableAdapter = (*Bot)(nil)
+)
 
 type messageKey struct{}
 type sessionKey struct{}
 
+// max length of a message in characters
+const messageLimit = 2000
+
+type Config struct {
+	config.GeneralConfig `yaml:",inline"`
+
+	Token     string   `yaml:"token"`
+	Whitelist []string `yaml:"whitelist"`
+}
+
 type Bot struct {
-	name string
-	cfg  config.DiscordConfig
+	name    string
+	session *discordgo.Session
+
+	mu  sync.RWMutex
+	cfg Config
+}
+
+func init() {
+	service.RegisterDriver("discord", service.Driver{
+		Config: config.Driver{
+			NewConfig: func() config.DriverConfig { return &Config{} },
+			Validate: func(cfg config.DriverConfig) []config.Problem {
+				return config.Required(map[string]string{"token": cfg.(*Config).Token})
+			},
+		},
+		New: func(ctx context.Context, name string, cfg config.DriverConfig) (service.Adapter, error) {
+			return New(name, *cfg.(*Config)), nil
+		},
+	})
 }
 
-func New(name string, cfg config.DiscordConfig) *Bot {
+func New(name string, cfg Config) *Bot {
 	return &Bot{
 		name: name,
 		cfg:  cfg,
@@ -35,9 +69,17 @@ func (b *Bot) GetName() string {
 func (b *Bot) GetMessageChan(ctx context.Context) <-chan *service.Message {
 	msgChan := make(chan *service.Message)
 
-	dg, _ := discordgo.New("Bot " + b.cfg.Token)
+	dg, _ := discordgo.New("Bot " + b.getConfig().Token)
+	b.session = dg
 	dg.Identify.Intents = discordgo.IntentGuildMessages | discordgo.IntentDirectMessages | discordgo.IntentMessageContent
+	// the handlers run in their own goroutines by default, the messages of
+	// a channel must be received in order
+	dg.SyncEvents = true
 	dg.AddHandler(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+		// stop receiving, the session is kept open to deliver the results
+		if ctx.Err() != nil {
+			return
+		}
 		if m.Author.ID == s.State.User.ID {
 			return
 		}
@@ -47,15 +89,7 @@ func (b *Bot) GetMessageChan(ctx context.Context) <-chan *service.Message {
 			return
 		}
 
-		allowed := len(b.cfg.Whitelist) == 0
-		for _, id := range b.cfg.Whitelist {
-			if id == m.Author.ID || (m.GuildID != "" && id == m.GuildID) {
-				allowed = true
-				break
-			}
-		}
-
-		if !allowed {
+		if !b.allowed(m.Author.ID, m.GuildID) {
 			return
 		}
 
@@ -74,47 +108,136 @@ func (b *Bot) GetMessageChan(ctx context.Context) <-chan *service.Message {
 		}
 
 		content := strings.TrimSpace(strings.TrimPrefix(m.Content, prefix))
-		ctx = context.WithValue(ctx, messageKey{}, m)
-		ctx = context.WithValue(ctx, sessionKey{}, s)
+		msgCtx := context.WithValue(ctx, messageKey{}, m)
+		msgCtx = context.WithValue(msgCtx, sessionKey{}, s)
 
-		msgChan <- &service.Message{
-			Context:      ctx,
+		msg := &service.Message{
+			Context:      msgCtx,
 			ReplyContent: replyContent,
 			UserIdentity: m.Author.ID,
 			Content:      content,
 			ConvKey:      m.ChannelID,
 		}
+		// the channel is never closed, handlers may still be running after
+		// ctx is done
+		select {
+		case msgChan <- msg:
+		case <-ctx.Done():
+		}
 	})
 
 	go func() {
 		if err := dg.Open(); err != nil {
 			log.Printf("error opening connection to Discord, %v\n", err)
 		}
-
-		select {
-		case <-ctx.Done():
-			dg.Close()
-			close(msgChan)
-			return
-		}
 	}()
 
 	return msgChan
 }
 
+// Close closes the session opened by GetMessageChan.
+func (b *Bot) Close() error {
+	if b.session == nil {
+		return nil
+	}
+	return b.session.Close()
+}
+
+func (b *Bot) getConfig() Config {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.cfg
+}
+
+func (b *Bot) allowed(userID, guildID string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if len(b.cfg.Whitelist) == 0 {
+		return true
+	}
+	for _, id := range b.cfg.Whitelist {
+		if id == userID || (guildID != "" && id == guildID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload applies the whitelist, a new token needs a restart.
+func (b *Bot) Reload(cfg config.AdapterConfig) bool {
+	c, ok := cfg.Config.(*Config)
+	if !ok {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.Token != b.cfg.Token {
+		return false
+	}
+	b.cfg = *c
+	return true
+}
+
 func (b *Bot) HandleResult(req *service.Message, r *service.Result) {
+	msg := req.Context.Value(messageKey{}).(*discordgo.MessageCreate)
+	s := req.Context.Value(sessionKey{}).(*discordgo.Session)
 	if r.Err != nil && r.IgnoreIfError {
+		// the placeholder must not be left with the half streamed reply
+		if r.StreamMessageID != "" {
+			if err := s.ChannelMessageDelete(msg.ChannelID, r.StreamMessageID); err != nil {
+				log.Printf("error deleting message on Discord, %v\n", err)
+			}
+		}
 		return
 	}
-	text := ""
-	if r.Err != nil {
-		text = r.Err.Error()
-	} else {
-		text = r.ConvTurn.Response
+	parts := r.Parts(service.FormatDiscord, messageLimit, service.RuneLength)
+	if r.StreamMessageID != "" {
+		if _, err := s.ChannelMessageEdit(msg.ChannelID, r.StreamMessageID, parts[0]); err != nil {
+			log.Printf("error editing message on Discord, %v\n", err)
+		}
+		parts = parts[1:]
+	}
+
+	for _, text := range parts {
+		if _, err := s.ChannelMessageSend(msg.ChannelID, text); err != nil {
+			log.Printf("error sending message to Discord, %v\n", err)
+			return
+		}
 	}
+}
+
+func (b *Bot) SendPlaceholder(req *service.Message, text string) (string, error) {
 	msg := req.Context.Value(messageKey{}).(*discordgo.MessageCreate)
 	s := req.Context.Value(sessionKey{}).(*discordgo.Session)
-	if _, err := s.ChannelMessageSend(msg.ChannelID, text); err != nil {
-		log.Printf("error sending message to Discord, %v\n", err)
+	sent, err := s.ChannelMessageSend(msg.ChannelID, renderPartial(text))
+	if err != nil {
+		return "", err
 	}
+	return sent.ID, nil
+}
+
+func (b *Bot) EditMessage(req *service.Message, id string, text string) error {
+	msg := req.Context.Value(messageKey{}).(*discordgo.MessageCreate)
+	s := req.Context.Value(sessionKey{}).(*discordgo.Session)
+	_, err := s.ChannelMessageEdit(msg.ChannelID, id, renderPartial(text))
+	return err
+}
+
+// renderPartial renders the text streamed so far, only the first part fits
+// into the placeholder.
+func renderPartial(text string) string {
+	return service.FormatText(text, service.FormatDiscord, service.RenderOptions{}, messageLimit, service.RuneLength, false)[0]
+}
+
+func (b *Bot) SendTyping(req *service.Message) error {
+	msg := req.Context.Value(messageKey{}).(*discordgo.MessageCreate)
+	s := req.Context.Value(sessionKey{}).(*discordgo.Session)
+	return s.ChannelTyping(msg.ChannelID)
+}
+
+// TypingInterval refreshes the typing indicator before it expires after 10 seconds.
+func (b *Bot) TypingInterval() time.Duration {
+	return 8 * time.Second
 }
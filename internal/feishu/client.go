@@ -0,0 +1,188 @@
+package feishu
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pandodao/PAL9000/internal/token"
+)
+
+// the codes of an invalid or expired tenant access token
+var tokenErrorCodes = map[int]bool{99991661: true, 99991663: true, 99991668: true}
+
+// client calls the open apis with the tenant access token.
+type client struct {
+	baseURL   string
+	appID     string
+	appSecret string
+	http      *http.Client
+	tokens    *token.Cache
+}
+
+func newClient(baseURL, appID, appSecret string) *client {
+	c := &client{
+		baseURL:   baseURL,
+		appID:     appID,
+		appSecret: appSecret,
+		http:      &http.Client{Timeout: 30 * time.Second},
+	}
+	c.tokens = token.NewCache(c.tenantAccessToken)
+	return c
+}
+
+// Error is the error response of the open apis.
+type Error struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("feishu error %d: %s", e.Code, e.Msg)
+}
+
+func (c *client) tenantAccessToken(ctx context.Context) (string, time.Duration, error) {
+	var resp struct {
+		Error
+		TenantAccessToken string `json:"tenant_access_token"`
+		Expire            int64  `json:"expire"` // seconds
+	}
+	body := map[string]string{"app_id": c.appID, "app_secret": c.appSecret}
+	if err := c.post(ctx, "/open-apis/auth/v3/tenant_access_token/internal", "", body, &resp); err != nil {
+		return "", 0, err
+	}
+	if resp.Code != 0 {
+		return "", 0, &resp.Error
+	}
+	return resp.TenantAccessToken, time.Duration(resp.Expire) * time.Second, nil
+}
+
+// call calls the api with the tenant access token.
+func (c *client) call(ctx context.Context, method, path string, body interface{}, result interface{}) error {
+	return c.tokens.Do(ctx, func(token string) (bool, error) {
+		var resp struct {
+			Error
+			Data json.RawMessage `json:"data"`
+		}
+		var err error
+		if method == http.MethodGet {
+			err = c.get(ctx, path, token, &resp)
+		} else {
+			err = c.post(ctx, path, token, body, &resp)
+		}
+		if err != nil {
+			return false, err
+		}
+		if resp.Code != 0 {
+			return tokenErrorCodes[resp.Code], &resp.Error
+		}
+		if result == nil || len(resp.Data) == 0 {
+			return false, nil
+		}
+		return false, json.Unmarshal(resp.Data, result)
+	})
+}
+
+func (c *client) get(ctx context.Context, path, token string, result interface{}) error {
+	return c.do(ctx, http.MethodGet, path, token, nil, result)
+}
+
+func (c *client) post(ctx context.Context, path, token string, body, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPost, path, token, bytes.NewReader(data), result)
+}
+
+func (c *client) do(ctx context.Context, method, path, token string, body io.Reader, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(c.baseURL, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	// the errors are in the body with the http status 400 or so
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("feishu %s %s: %s", method, path, resp.Status)
+	}
+	return nil
+}
+
+// botOpenID returns the open_id of the bot, to find it in the mentions.
+func (c *client) botOpenID(ctx context.Context) (string, error) {
+	token, err := c.tokens.Get(ctx)
+	if err != nil {
+		return "", fmt.Errorf("get tenant access token error: %w", err)
+	}
+
+	// the bot info is not in the data field
+	var resp struct {
+		Error
+		Bot struct {
+			OpenID string `json:"open_id"`
+		} `json:"bot"`
+	}
+	if err := c.get(ctx, "/open-apis/bot/v3/info", token, &resp); err != nil {
+		return "", err
+	}
+	if resp.Code != 0 {
+		return "", &resp.Error
+	}
+	return resp.Bot.OpenID, nil
+}
+
+// reply replies to the message with a text message.
+func (c *client) reply(ctx context.Context, messageID, text string) error {
+	content, _ := json.Marshal(map[string]string{"text": text})
+	body := map[string]string{"msg_type": "text", "content": string(content)}
+	return c.call(ctx, http.MethodPost, "/open-apis/im/v1/messages/"+url.PathEscape(messageID)+"/reply", body, nil)
+}
+
+// messageText returns the text of a text message, it's empty for the other
+// types.
+func (c *client) messageText(ctx context.Context, messageID string) (string, error) {
+	var data struct {
+		Items []struct {
+			MsgType string `json:"msg_type"`
+			Body    struct {
+				Content string `json:"content"`
+			} `json:"body"`
+		} `json:"items"`
+	}
+	if err := c.call(ctx, http.MethodGet, "/open-apis/im/v1/messages/"+url.PathEscape(messageID), nil, &data); err != nil {
+		return "", err
+	}
+	if len(data.Items) == 0 || data.Items[0].MsgType != "text" {
+		return "", nil
+	}
+	return textContent(data.Items[0].Body.Content), nil
+}
+
+func textContent(content string) string {
+	var v struct {
+		Text string `json:"text"`
+	}
+	json.Unmarshal([]byte(content), &v)
+	return v.Text
+}
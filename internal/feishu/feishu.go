@@ -0,0 +1,420 @@
+// Package feishu is the adapter of the feishu driver, it receives the
+// im.message.receive_v1 events by the event subscription callbacks and
+// replies by the message reply api. It works with lark by the base url.
+package feishu
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pandodao/PAL9000/config"
+	"github.com/pandodao/PAL9000/internal/webhook"
+	"github.com/pandodao/PAL9000/service"
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	_ service.Adapter           = (*Bot)(nil)
+	_ service.ReloadableAdapter = (*Bot)(nil)
+	_ config.ServerConfig       = (*Config)(nil)
+)
+
+const (
+	defaultBaseURL = "https://open.feishu.cn"
+	defaultPath    = "/feishu/events"
+	// max bytes of a text message, the request body is limited to 150KB
+	messageLimit = 30 * 1024
+	// feishu retries the events not answered in time
+	eventDedupExpiration = time.Hour
+)
+
+// Config is of a custom app with the bot ability, it subscribes to the
+// im.message.receive_v1 event with the request url of the address and path.
+type Config struct {
+	config.GeneralConfig `yaml:",inline"`
+
+	AppID     string `yaml:"app_id"`
+	AppSecret string `yaml:"app_secret"`
+	// the verification token and encrypt key of the event subscription, the
+	// events must be encrypted if the key is set
+	VerificationToken string `yaml:"verification_token"`
+	EncryptKey        string `yaml:"encrypt_key"`
+	Address           string `yaml:"address"` // e.g. :8080
+	Path              string `yaml:"path"`    // defaults to /feishu/events
+	// defaults to https://open.feishu.cn, https://open.larksuite.com for lark
+	BaseURL string `yaml:"base_url"`
+	// chat_id or open_id allowed to talk to the bot
+	Whitelist []string `yaml:"whitelist"`
+}
+
+func (c *Config) ListenAddress() string {
+	return c.Address
+}
+
+func init() {
+	service.RegisterDriver("feishu", service.Driver{
+		Config: config.Driver{
+			NewConfig: func() config.DriverConfig {
+				return &Config{Path: defaultPath, BaseURL: defaultBaseURL}
+			},
+			Validate: validate,
+		},
+		New: func(ctx context.Context, name string, cfg config.DriverConfig) (service.Adapter, error) {
+			return New(ctx, name, *cfg.(*Config))
+		},
+	})
+}
+
+func validate(cfg config.DriverConfig) []config.Problem {
+	c := cfg.(*Config)
+	problems := config.Required(map[string]string{
+		"app_id":     c.AppID,
+		"app_secret": c.AppSecret,
+		"address":    c.Address,
+	})
+	// the callbacks are verified by either of them
+	if c.VerificationToken == "" && c.EncryptKey == "" {
+		problems = append(problems, config.Problem{Path: "verification_token", Message: "verification_token or encrypt_key is required"})
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		problems = append(problems, config.Problem{Path: "path", Message: "path must start with /"})
+	}
+	if !strings.HasPrefix(c.BaseURL, "https://") && !strings.HasPrefix(c.BaseURL, "http://") {
+		problems = append(problems, config.Problem{Path: "base_url", Message: "base_url must be an http(s) url"})
+	}
+	return problems
+}
+
+type messageKey struct{}
+
+// the body of the callbacks, the fields of the schema 2.0 and the url
+// verification
+type callback struct {
+	Encrypt   string `json:"encrypt"`
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Token     string `json:"token"`
+	Schema    string `json:"schema"`
+	Header    struct {
+		EventID   string `json:"event_id"`
+		EventType string `json:"event_type"`
+		Token     string `json:"token"`
+	} `json:"header"`
+	Event json.RawMessage `json:"event"`
+}
+
+type messageEvent struct {
+	Sender struct {
+		SenderID struct {
+			OpenID string `json:"open_id"`
+		} `json:"sender_id"`
+		SenderType string `json:"sender_type"`
+	} `json:"sender"`
+	Message struct {
+		MessageID   string `json:"message_id"`
+		ParentID    string `json:"parent_id"`
+		ChatID      string `json:"chat_id"`
+		ChatType    string `json:"chat_type"` // p2p or group
+		MessageType string `json:"message_type"`
+		Content     string `json:"content"`
+		Mentions    []struct {
+			Key string `json:"key"` // e.g. @_user_1 in the text
+			ID  struct {
+				OpenID string `json:"open_id"`
+			} `json:"id"`
+			Name string `json:"name"`
+		} `json:"mentions"`
+	} `json:"message"`
+}
+
+type Bot struct {
+	name      string
+	server    *webhook.Server
+	client    *client
+	botOpenID string
+	events    *cache.Cache
+	logger    logrus.FieldLogger
+
+	mu  sync.RWMutex
+	cfg Config
+}
+
+func New(ctx context.Context, name string, cfg Config) (*Bot, error) {
+	c := newClient(cfg.BaseURL, cfg.AppID, cfg.AppSecret)
+	openID, err := c.botOpenID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get bot info error: %w", err)
+	}
+
+	logger := logrus.WithField("adapter", "feishu").WithField("name", name)
+	server, err := webhook.Listen(cfg.Address, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Bot{
+		name:      name,
+		server:    server,
+		client:    c,
+		botOpenID: openID,
+		events:    cache.New(eventDedupExpiration, 10*time.Minute),
+		logger:    logger,
+		cfg:       cfg,
+	}, nil
+}
+
+func (b *Bot) GetName() string {
+	return b.name
+}
+
+func (b *Bot) getConfig() Config {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.cfg
+}
+
+// Reload applies the whitelist, path and the event subscription secrets, a
+// new app or address needs a restart.
+func (b *Bot) Reload(cfg config.AdapterConfig) bool {
+	c, ok := cfg.Config.(*Config)
+	if !ok {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.AppID != b.cfg.AppID || c.AppSecret != b.cfg.AppSecret || c.Address != b.cfg.Address || c.BaseURL != b.cfg.BaseURL {
+		return false
+	}
+	b.cfg = *c
+	return true
+}
+
+func (b *Bot) GetMessageChan(ctx context.Context) <-chan *service.Message {
+	msgChan := make(chan *service.Message)
+	b.server.Serve(b.eventsHandler(ctx, msgChan))
+	return msgChan
+}
+
+// Close shuts the server down after the pending events are answered.
+func (b *Bot) Close() error {
+	return b.server.Close()
+}
+
+func (b *Bot) eventsHandler(ctx context.Context, msgChan chan<- *service.Message) http.HandlerFunc {
+	// feishu expects the response within 3 seconds, the events are handled
+	// after it in order
+	queue := webhook.NewQueue(ctx)
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := b.getConfig()
+		if r.URL.Path != cfg.Path {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := webhook.ReadBody(w, r)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		cb, err := parseCallback(body, cfg.EncryptKey)
+		if err != nil {
+			b.logger.WithError(err).Warn("invalid callback")
+			http.Error(w, "Invalid callback", http.StatusBadRequest)
+			return
+		}
+		token := cb.Token
+		if cb.Schema == "2.0" {
+			token = cb.Header.Token
+		}
+		if cfg.VerificationToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.VerificationToken)) != 1 {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		// the url verification is not signed
+		if cb.Type == "url_verification" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"challenge": cb.Challenge})
+			return
+		}
+		// the events are signed if the encrypt key is set
+		if cfg.EncryptKey != "" {
+			want := signature(r.Header.Get("X-Lark-Request-Timestamp"), r.Header.Get("X-Lark-Request-Nonce"), cfg.EncryptKey, body)
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Lark-Signature")), []byte(want)) != 1 {
+				http.Error(w, "Invalid signature", http.StatusUnauthorized)
+				return
+			}
+		}
+		if cb.Header.EventType != "im.message.receive_v1" {
+			return
+		}
+
+		var e messageEvent
+		if err := json.Unmarshal(cb.Event, &e); err != nil {
+			http.Error(w, "Invalid event", http.StatusBadRequest)
+			return
+		}
+		queue.Push(func() {
+			b.handleMessage(ctx, msgChan, cb.Header.EventID, &e)
+		})
+	}
+}
+
+// signature is the X-Lark-Signature of the request body.
+func signature(timestamp, nonce, encryptKey string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(timestamp + nonce + encryptKey))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func parseCallback(body []byte, encryptKey string) (*callback, error) {
+	var cb callback
+	if err := json.Unmarshal(body, &cb); err != nil {
+		return nil, err
+	}
+	if encryptKey == "" {
+		return &cb, nil
+	}
+	if cb.Encrypt == "" {
+		return nil, errors.New("the callback is not encrypted")
+	}
+
+	plain, err := decrypt(cb.Encrypt, encryptKey)
+	if err != nil {
+		return nil, err
+	}
+	cb = callback{}
+	if err := json.Unmarshal(plain, &cb); err != nil {
+		return nil, err
+	}
+	return &cb, nil
+}
+
+// decrypt decrypts the encrypted callback, it's AES-256-CBC with the sha256
+// of the encrypt key, and the iv is the first block.
+func decrypt(encrypted, encryptKey string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("base64 decode error: %w", err)
+	}
+	if len(data) < 2*aes.BlockSize || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid encrypted data length")
+	}
+
+	key := sha256.Sum256([]byte(encryptKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	iv, data := data[:aes.BlockSize], data[aes.BlockSize:]
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, errors.New("invalid padding")
+	}
+	return data[:len(data)-pad], nil
+}
+
+// handleMessage sends the message of the event, the event id is recorded
+// once it's sent so the retries of the events dropped before are still
+// handled.
+func (b *Bot) handleMessage(ctx context.Context, msgChan chan<- *service.Message, eventID string, e *messageEvent) {
+	// the event was handled when the first attempt timed out, the queue
+	// handles the events one by one so the retry is found here
+	if _, handled := b.events.Get(eventID); eventID != "" && handled {
+		return
+	}
+	m := e.Message
+	// stop receiving, the server is kept running to deliver the results
+	if ctx.Err() != nil || e.Sender.SenderType != "user" || m.MessageType != "text" {
+		return
+	}
+	if !b.allowed(m.ChatID, e.Sender.SenderID.OpenID) {
+		return
+	}
+
+	text := textContent(m.Content)
+	mentioned := false
+	for _, mention := range m.Mentions {
+		if mention.ID.OpenID == b.botOpenID {
+			mentioned = true
+			text = strings.ReplaceAll(text, mention.Key, "")
+			continue
+		}
+		text = strings.ReplaceAll(text, mention.Key, "@"+mention.Name)
+	}
+	if m.ChatType == "group" && !mentioned {
+		return
+	}
+
+	replyContent := ""
+	if m.ParentID != "" {
+		var err error
+		if replyContent, err = b.client.messageText(ctx, m.ParentID); err != nil {
+			b.logger.WithError(err).Error("get parent message error")
+		}
+	}
+
+	msg := &service.Message{
+		Context:      context.WithValue(context.Background(), messageKey{}, m.MessageID),
+		ReplyContent: replyContent,
+		UserIdentity: e.Sender.SenderID.OpenID,
+		ConvKey:      m.ChatID,
+		Content:      strings.TrimSpace(text),
+	}
+	if eventID != "" {
+		b.events.SetDefault(eventID, true)
+	}
+	select {
+	case msgChan <- msg:
+	case <-ctx.Done():
+	}
+}
+
+func (b *Bot) allowed(chatID, openID string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if len(b.cfg.Whitelist) == 0 {
+		return true
+	}
+	for _, id := range b.cfg.Whitelist {
+		if id == chatID || id == openID {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bot) HandleResult(req *service.Message, r *service.Result) {
+	if r.Err != nil && r.IgnoreIfError {
+		return
+	}
+	messageID := req.Context.Value(messageKey{}).(string)
+	for _, text := range r.Parts(service.FormatPlain, messageLimit, service.ByteLength) {
+		if err := b.client.reply(context.Background(), messageID, text); err != nil {
+			b.logger.WithError(err).Error("reply message error")
+			return
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package feishu
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pandodao/PAL9000/internal/webhook/webhooktest"
+	"github.com/pandodao/PAL9000/service"
+)
+
+// newStub serves the open apis used by the bot.
+func newStub(t *testing.T, ts *webhooktest.Tokens) *webhooktest.Stub {
+	authorized := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !ts.Valid(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+				webhooktest.WriteJSON(w, `{"code":99991663,"msg":"invalid token"}`)
+				return
+			}
+			h(w, r)
+		}
+	}
+	return webhooktest.NewStub(t, map[string]http.HandlerFunc{
+		"/open-apis/auth/v3/tenant_access_token/internal": func(w http.ResponseWriter, r *http.Request) {
+			webhooktest.WriteJSON(w, `{"code":0,"tenant_access_token":"`+ts.Issue()+`","expire":7200}`)
+		},
+		"/open-apis/bot/v3/info": authorized(func(w http.ResponseWriter, r *http.Request) {
+			webhooktest.WriteJSON(w, `{"code":0,"bot":{"open_id":"ou_bot"}}`)
+		}),
+		"/open-apis/im/v1/messages/": authorized(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/reply") {
+				webhooktest.WriteJSON(w, `{"code":0,"data":{}}`)
+				return
+			}
+			webhooktest.WriteJSON(w, `{"code":0,"data":{"items":[{"msg_type":"text","body":{"content":"{\"text\":\"the question\"}"}}]}}`)
+		}),
+	})
+}
+
+// newBot runs the bot against the stub, the callbacks are encrypted by the
+// encrypt key if it's set.
+func newBot(t *testing.T, stub *webhooktest.Stub, encryptKey string) (*Bot, http.Handler, chan *service.Message) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	b, err := New(ctx, "test", Config{
+		AppID:             "cli_1",
+		AppSecret:         "secret",
+		VerificationToken: "vtoken",
+		EncryptKey:        encryptKey,
+		Address:           "127.0.0.1:0",
+		Path:              defaultPath,
+		BaseURL:           stub.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	msgChan := make(chan *service.Message)
+	return b, b.eventsHandler(ctx, msgChan), msgChan
+}
+
+func encrypt(t *testing.T, key string, plain []byte) string {
+	pad := aes.BlockSize - len(plain)%aes.BlockSize
+	plain = append(plain, bytes.Repeat([]byte{byte(pad)}, pad)...)
+
+	k := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, aes.BlockSize+len(plain))
+	io.ReadFull(rand.Reader, data[:aes.BlockSize])
+	cipher.NewCBCEncrypter(block, data[:aes.BlockSize]).CryptBlocks(data[aes.BlockSize:], plain)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// request is the callback of the plain body encrypted and signed by the key.
+func request(t *testing.T, key, plain string) *http.Request {
+	body, _ := json.Marshal(map[string]string{"encrypt": encrypt(t, key, []byte(plain))})
+	req := httptest.NewRequest(http.MethodPost, defaultPath, bytes.NewReader(body))
+	req.Header.Set("X-Lark-Request-Timestamp", "1700000000")
+	req.Header.Set("X-Lark-Request-Nonce", "nonce")
+	req.Header.Set("X-Lark-Signature", signature("1700000000", "nonce", key, body))
+	return req
+}
+
+type event struct {
+	id, senderType, chatType, text, mentions string
+}
+
+func (e event) String() string {
+	if e.senderType == "" {
+		e.senderType = "user"
+	}
+	return `{"schema":"2.0","header":{"event_id":"` + e.id + `","event_type":"im.message.receive_v1","token":"vtoken"},` +
+		`"event":{"sender":{"sender_id":{"open_id":"ou_1"},"sender_type":"` + e.senderType + `"},"message":{"message_id":"om_` + e.id +
+		`","parent_id":"om_parent","chat_id":"oc_1","chat_type":"` + e.chatType + `","message_type":"text",` +
+		`"content":"{\"text\":\"` + e.text + `\"}","mentions":[` + e.mentions + `]}}}`
+}
+
+func TestSignature(t *testing.T) {
+	challenge := func(token string) string {
+		return `{"type":"url_verification","challenge":"abc","token":"` + token + `"}`
+	}
+	cases := []struct {
+		name       string
+		encryptKey string
+		req        func(t *testing.T) *http.Request
+		status     int
+	}{
+		{
+			name:       "signed",
+			encryptKey: "ekey",
+			req:        func(t *testing.T) *http.Request { return request(t, "ekey", challenge("vtoken")) },
+			status:     http.StatusOK,
+		},
+		{
+			name:       "event of a wrong signature",
+			encryptKey: "ekey",
+			req: func(t *testing.T) *http.Request {
+				req := request(t, "ekey", event{id: "1", chatType: "p2p", text: "hi"}.String())
+				req.Header.Set("X-Lark-Signature", "wrong")
+				return req
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:       "challenge not signed",
+			encryptKey: "ekey",
+			req: func(t *testing.T) *http.Request {
+				req := request(t, "ekey", challenge("vtoken"))
+				req.Header.Del("X-Lark-Signature")
+				return req
+			},
+			status: http.StatusOK,
+		},
+		{
+			name:       "event not signed",
+			encryptKey: "ekey",
+			req: func(t *testing.T) *http.Request {
+				req := request(t, "ekey", event{id: "1", chatType: "p2p", text: "hi"}.String())
+				req.Header.Del("X-Lark-Signature")
+				return req
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:       "wrong token",
+			encryptKey: "ekey",
+			req:        func(t *testing.T) *http.Request { return request(t, "ekey", challenge("wrong")) },
+			status:     http.StatusUnauthorized,
+		},
+		{
+			name: "token only",
+			req: func(t *testing.T) *http.Request {
+				return httptest.NewRequest(http.MethodPost, defaultPath, strings.NewReader(challenge("vtoken")))
+			},
+			status: http.StatusOK,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, h, _ := newBot(t, newStub(t, &webhooktest.Tokens{}), c.encryptKey)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, c.req(t))
+			if w.Code != c.status {
+				t.Errorf("status = %d, want %d", w.Code, c.status)
+			}
+			// the challenge is echoed
+			if c.status == http.StatusOK && !strings.Contains(w.Body.String(), `"challenge":"abc"`) {
+				t.Errorf("body = %q", w.Body)
+			}
+		})
+	}
+}
+
+func TestMention(t *testing.T) {
+	mentions := `{"key":"@_user_1","id":{"open_id":"ou_bot"},"name":"PAL"},{"key":"@_user_2","id":{"open_id":"ou_2"},"name":"Bob"}`
+	cases := []struct {
+		name  string
+		event event
+		// nil if the message is ignored
+		want *service.Message
+	}{
+		{
+			name:  "not mentioned in the group",
+			event: event{chatType: "group", text: "hello"},
+		},
+		{
+			name:  "mentioned",
+			event: event{chatType: "group", text: "@_user_1 ask @_user_2", mentions: mentions},
+			want:  &service.Message{Content: "ask @Bob", ConvKey: "oc_1", UserIdentity: "ou_1", ReplyContent: "the question"},
+		},
+		{
+			name:  "p2p",
+			event: event{chatType: "p2p", text: "hi"},
+			want:  &service.Message{Content: "hi", ConvKey: "oc_1", UserIdentity: "ou_1", ReplyContent: "the question"},
+		},
+		{
+			name:  "sent by an app",
+			event: event{senderType: "app", chatType: "p2p", text: "hi"},
+		},
+	}
+
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, h, msgChan := newBot(t, newStub(t, &webhooktest.Tokens{}), "ekey")
+			c.event.id = strconv.Itoa(i)
+			webhooktest.CheckMessage(t, webhooktest.Receive(t, h, request(t, "ekey", c.event.String()), msgChan), c.want)
+		})
+	}
+}
+
+func TestDedup(t *testing.T) {
+	_, h, msgChan := newBot(t, newStub(t, &webhooktest.Tokens{}), "ekey")
+	body := event{id: "1", chatType: "p2p", text: "hi"}.String()
+
+	webhooktest.MustReceive(t, h, request(t, "ekey", body), msgChan)
+	if msg := webhooktest.Receive(t, h, request(t, "ekey", body), msgChan); msg != nil {
+		t.Errorf("retried event received: %+v", msg)
+	}
+	if msg := webhooktest.Receive(t, h, request(t, "ekey", event{id: "2", chatType: "p2p", text: "hi"}.String()), msgChan); msg == nil {
+		t.Error("next event not received")
+	}
+
+	// the redelivery of a callback failed to parse is handled
+	broken := `{"schema":"2.0","header":{"event_id":"3","event_type":"im.message.receive_v1","token":"vtoken"},"event":"broken"}`
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, request(t, "ekey", broken))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("broken event: status = %d", w.Code)
+	}
+	if msg := webhooktest.Receive(t, h, request(t, "ekey", event{id: "3", chatType: "p2p", text: "hi"}.String()), msgChan); msg == nil {
+		t.Error("redelivered event not received")
+	}
+}
+
+func TestHandleResult(t *testing.T) {
+	ts := &webhooktest.Tokens{}
+	stub := newStub(t, ts)
+	b, h, msgChan := newBot(t, stub, "ekey")
+	msg := webhooktest.MustReceive(t, h, request(t, "ekey", event{id: "1", chatType: "p2p", text: "hi"}.String()), msgChan)
+	reply := func() (token, text string) {
+		call := stub.Next(t, "/open-apis/im/v1/messages/om_1/reply")
+		var content struct {
+			Text string `json:"text"`
+		}
+		json.Unmarshal([]byte(call.JSON(t)["content"].(string)), &content)
+		return call.Header.Get("Authorization"), content.Text
+	}
+
+	// the token is cached
+	for i := 0; i < 2; i++ {
+		b.HandleResult(msg, webhooktest.Reply("**yes**"))
+		if token, text := reply(); token != "Bearer token-1" || text != "yes" {
+			t.Errorf("reply = %s %q", token, text)
+		}
+	}
+
+	// and fetched again once rejected
+	ts.Issue()
+	b.HandleResult(msg, webhooktest.Reply("again"))
+	for _, want := range []string{"Bearer token-1", "Bearer token-3"} {
+		if token, text := reply(); token != want || text != "again" {
+			t.Errorf("reply = %s %q, want %s", token, text, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := func(token, key string) *Config {
+		return &Config{AppID: "cli_1", AppSecret: "secret", Address: ":8080", Path: defaultPath, BaseURL: defaultBaseURL,
+			VerificationToken: token, EncryptKey: key}
+	}
+	cases := []struct {
+		name string
+		cfg  *Config
+		want []string
+	}{
+		{name: "token", cfg: cfg("vtoken", "")},
+		{name: "encrypt key", cfg: cfg("", "ekey")},
+		{name: "neither", cfg: cfg("", ""), want: []string{"verification_token: verification_token or encrypt_key is required"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var got []string
+			for _, p := range validate(c.cfg) {
+				got = append(got, p.String())
+			}
+			if strings.Join(got, "\n") != strings.Join(c.want, "\n") {
+				t.Errorf("validate() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	plain, err := decrypt(encrypt(t, "key", []byte("hello world")), "key")
+	if err != nil || string(plain) != "hello world" {
+		t.Errorf("decrypt = %q, %v", plain, err)
+	}
+	if _, err := decrypt("aGVsbG8=", "key"); err == nil {
+		t.Error("decrypted the short data")
+	}
+}
@@ -0,0 +1,382 @@
+// Package httpapi is the adapter of the http driver, other services ask the
+// bot by POST /v1/messages and get the reply in the response, or later by a
+// callback.
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fox-one/pkg/uuid"
+	"github.com/pandodao/PAL9000/config"
+	"github.com/pandodao/PAL9000/internal/webhook"
+	"github.com/pandodao/PAL9000/service"
+	"github.com/pandodao/botastic-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	messagesPath = "/v1/messages"
+	// the header of the HMAC-SHA256 signature of the callback body
+	signatureHeader = "X-PAL9000-Signature"
+
+	defaultCallbackTimeout = 10 // seconds
+)
+
+var (
+	_ service.Adapter           = (*Bot)(nil)
+	_ service.ReloadableAdapter = (*Bot)(nil)
+	_ config.ServerConfig       = (*Config)(nil)
+)
+
+type Config struct {
+	config.GeneralConfig `yaml:",inline"`
+
+	Address string `yaml:"address"` // e.g. :8080
+	Token   string `yaml:"token"`   // bearer token of the requests
+	// key of the HMAC-SHA256 signature of the callbacks, optional
+	CallbackSecret  string `yaml:"callback_secret"`
+	CallbackTimeout int64  `yaml:"callback_timeout"` // seconds, defaults to 10
+}
+
+func (c *Config) ListenAddress() string {
+	return c.Address
+}
+
+func init() {
+	service.RegisterDriver("http", service.Driver{
+		Config: config.Driver{
+			NewConfig: func() config.DriverConfig {
+				return &Config{CallbackTimeout: defaultCallbackTimeout}
+			},
+			Validate: func(cfg config.DriverConfig) []config.Problem {
+				c := cfg.(*Config)
+				var problems []config.Problem
+				if c.Address == "" {
+					problems = append(problems, config.Problem{Path: "address", Message: "address is required"})
+				}
+				if c.Token == "" {
+					problems = append(problems, config.Problem{Path: "token", Message: "token is required"})
+				}
+				return problems
+			},
+		},
+		New: func(ctx context.Context, name string, cfg config.DriverConfig) (service.Adapter, error) {
+			return New(name, *cfg.(*Config))
+		},
+	})
+}
+
+// Request is the body of POST /v1/messages.
+type Request struct {
+	UserIdentity string `json:"user_identity"`
+	// ConvKey defaults to the user identity
+	ConvKey      string `json:"conv_key"`
+	Content      string `json:"content"`
+	ReplyContent string `json:"reply_content"`
+	// BotID and Lang default to the ones of the general config
+	BotID uint64 `json:"bot_id"`
+	Lang  string `json:"lang"`
+	// CallbackURL makes the request async, it's answered with 202 and the
+	// response is posted to the url.
+	CallbackURL string `json:"callback_url"`
+}
+
+type Response struct {
+	ID       string             `json:"id,omitempty"`
+	ConvKey  string             `json:"conv_key,omitempty"`
+	Text     string             `json:"text,omitempty"`
+	ConvTurn *botastic.ConvTurn `json:"conv_turn,omitempty"`
+	Error    *Error             `json:"error,omitempty"`
+}
+
+type Error struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// request is the context value of the received messages
+type requestKey struct{}
+
+type request struct {
+	id          string
+	callbackURL string
+	// the sync requests wait for the response
+	respChan chan *Response
+}
+
+type Bot struct {
+	name   string
+	server *webhook.Server
+	client *http.Client
+	logger logrus.FieldLogger
+
+	mu  sync.RWMutex
+	cfg Config
+}
+
+func New(name string, cfg Config) (*Bot, error) {
+	logger := logrus.WithField("adapter", "http").WithField("name", name)
+	server, err := webhook.Listen(cfg.Address, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Bot{
+		name:   name,
+		server: server,
+		client: &http.Client{},
+		logger: logger,
+		cfg:    cfg,
+	}, nil
+}
+
+func (b *Bot) GetName() string {
+	return b.name
+}
+
+func (b *Bot) getConfig() Config {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.cfg
+}
+
+// Reload applies the token and the callback options, a new address needs a
+// restart.
+func (b *Bot) Reload(cfg config.AdapterConfig) bool {
+	c, ok := cfg.Config.(*Config)
+	if !ok {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.Address != b.cfg.Address {
+		return false
+	}
+	b.cfg = *c
+	return true
+}
+
+func (b *Bot) GetMessageChan(ctx context.Context) <-chan *service.Message {
+	msgChan := make(chan *service.Message)
+	mux := http.NewServeMux()
+	mux.Handle(messagesPath, b.messagesHandler(ctx, msgChan))
+	b.server.Serve(mux)
+	return msgChan
+}
+
+// Close shuts the server down after the sync requests are answered.
+func (b *Bot) Close() error {
+	return b.server.Close()
+}
+
+func (b *Bot) messagesHandler(ctx context.Context, msgChan chan<- *service.Message) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, http.StatusMethodNotAllowed, service.ErrorKindInvalidInput, "method not allowed")
+			return
+		}
+		if !b.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, service.ErrorKindNotAllowed, "invalid token")
+			return
+		}
+		if ctx.Err() != nil {
+			writeError(w, http.StatusServiceUnavailable, service.ErrorKindUpstreamUnavailable, "server is shutting down")
+			return
+		}
+
+		body, err := webhook.ReadBody(w, r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, service.ErrorKindInvalidInput, "failed to read request body")
+			return
+		}
+		var req Request
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeError(w, http.StatusBadRequest, service.ErrorKindInvalidInput, "invalid json: "+err.Error())
+			return
+		}
+		if msg := req.validate(); msg != "" {
+			writeError(w, http.StatusBadRequest, service.ErrorKindInvalidInput, msg)
+			return
+		}
+		if req.ConvKey == "" {
+			req.ConvKey = req.UserIdentity
+		}
+
+		pr := &request{
+			id:          uuid.New(),
+			callbackURL: req.CallbackURL,
+		}
+		if pr.callbackURL == "" {
+			pr.respChan = make(chan *Response, 1)
+		}
+		msg := &service.Message{
+			// the async messages outlive the request
+			Context:      context.WithValue(context.Background(), requestKey{}, pr),
+			BotID:        req.BotID,
+			Lang:         req.Lang,
+			UserIdentity: req.UserIdentity,
+			ConvKey:      req.ConvKey,
+			Content:      req.Content,
+			ReplyContent: req.ReplyContent,
+		}
+		select {
+		case msgChan <- msg:
+		case <-ctx.Done():
+			writeError(w, http.StatusServiceUnavailable, service.ErrorKindUpstreamUnavailable, "server is shutting down")
+			return
+		case <-r.Context().Done():
+			return
+		}
+
+		if pr.respChan == nil {
+			writeJSON(w, http.StatusAccepted, &Response{ID: pr.id, ConvKey: req.ConvKey})
+			return
+		}
+
+		select {
+		case resp := <-pr.respChan:
+			writeJSON(w, responseStatus(resp), resp)
+		case <-r.Context().Done():
+			b.logger.WithField("id", pr.id).Info("client gone before the reply")
+		}
+	}
+}
+
+func (req *Request) validate() string {
+	switch {
+	case req.UserIdentity == "":
+		return "user_identity is required"
+	case strings.TrimSpace(req.Content) == "":
+		return "content is required"
+	case req.CallbackURL != "" && !strings.HasPrefix(req.CallbackURL, "http://") && !strings.HasPrefix(req.CallbackURL, "https://"):
+		return "callback_url must be an http or https url"
+	}
+	return ""
+}
+
+func (b *Bot) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(b.getConfig().Token)) == 1
+}
+
+func (b *Bot) HandleResult(req *service.Message, r *service.Result) {
+	pr := req.Context.Value(requestKey{}).(*request)
+	resp := &Response{
+		ID:       pr.id,
+		ConvKey:  req.ConvKey,
+		ConvTurn: r.ConvTurn,
+	}
+	if r.Err == nil {
+		resp.Text = r.Text()
+	} else {
+		var e *service.Error
+		kind := service.ErrorKindUnknown
+		if errors.As(r.Err, &e) {
+			kind = e.Kind
+		}
+		resp.Error = &Error{Kind: string(kind), Message: r.ErrorText}
+	}
+
+	if pr.respChan != nil {
+		pr.respChan <- resp
+		return
+	}
+	if err := b.callback(pr.callbackURL, resp); err != nil {
+		b.logger.WithError(err).WithField("id", pr.id).Error("callback error")
+	}
+}
+
+// callback posts the response of an async request, the body is signed if
+// the callback secret is set.
+func (b *Bot) callback(url string, resp *Response) error {
+	cfg := b.getConfig()
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Duration(cfg.CallbackTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultCallbackTimeout * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.CallbackSecret != "" {
+		req.Header.Set(signatureHeader, "sha256="+Sign(cfg.CallbackSecret, body))
+	}
+
+	res, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("callback status: %s", res.Status)
+	}
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the body, the receivers of the
+// callbacks compare it with the X-PAL9000-Signature header.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// responseStatus returns the status code of a sync response by the kind of
+// the error.
+func responseStatus(resp *Response) int {
+	if resp.Error == nil {
+		return http.StatusOK
+	}
+
+	switch service.ErrorKind(resp.Error.Kind) {
+	case service.ErrorKindUpstreamUnavailable:
+		return http.StatusBadGateway
+	case service.ErrorKindRateLimited:
+		return http.StatusTooManyRequests
+	case service.ErrorKindTimeout:
+		return http.StatusGatewayTimeout
+	case service.ErrorKindNotAllowed:
+		return http.StatusForbidden
+	case service.ErrorKindInvalidInput:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func writeError(w http.ResponseWriter, status int, kind service.ErrorKind, msg string) {
+	writeJSON(w, status, &Response{Error: &Error{Kind: string(kind), Message: msg}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
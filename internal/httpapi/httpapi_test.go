@@ -0,0 +1,118 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pandodao/PAL9000/service"
+	"github.com/pandodao/botastic-go"
+)
+
+func newTestBot(t *testing.T, cfg Config) (*Bot, http.Handler, <-chan *service.Message) {
+	cfg.Address = "127.0.0.1:0"
+	b, err := New("test", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	msgChan := make(chan *service.Message)
+	return b, b.messagesHandler(ctx, msgChan), msgChan
+}
+
+func post(h http.Handler, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, messagesPath, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestMessagesSync(t *testing.T) {
+	b, h, msgChan := newTestBot(t, Config{Token: "secret"})
+
+	if w := post(h, "wrong", `{}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: status = %d", w.Code)
+	}
+	if w := post(h, "secret", `{"user_identity":"u"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("no content: status = %d", w.Code)
+	}
+
+	go func() {
+		msg := <-msgChan
+		if msg.ConvKey != "u" || msg.Content != "hi" || msg.Lang != "zh" {
+			t.Errorf("message = %+v", msg)
+		}
+		b.HandleResult(msg, &service.Result{ConvTurn: &botastic.ConvTurn{ID: 1, Response: "hello"}})
+	}()
+	w := post(h, "secret", `{"user_identity":"u","content":"hi","lang":"zh"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body)
+	}
+	var resp Response
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID == "" || resp.Text != "hello" || resp.ConvTurn.ID != 1 {
+		t.Errorf("response = %+v", resp)
+	}
+
+	go func() {
+		msg := <-msgChan
+		b.HandleResult(msg, &service.Result{Err: service.ErrRateLimited, ErrorText: "slow down"})
+	}()
+	w = post(h, "secret", `{"user_identity":"u","content":"hi"}`)
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), `"kind":"rate_limited"`) {
+		t.Errorf("status = %d, body = %s", w.Code, w.Body)
+	}
+}
+
+func TestMessagesCallback(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer callback.Close()
+
+	b, h, msgChan := newTestBot(t, Config{Token: "secret", CallbackSecret: "key"})
+	go func() {
+		msg := <-msgChan
+		b.HandleResult(msg, &service.Result{Err: errors.New("boom"), ErrorText: "failed"})
+	}()
+
+	w := post(h, "secret", `{"user_identity":"u","conv_key":"c","content":"hi","callback_url":"`+callback.URL+`"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body)
+	}
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		if got := r.Header.Get(signatureHeader); got != "sha256="+Sign("key", body) {
+			t.Errorf("signature = %q", got)
+		}
+		var resp Response
+		if err := json.Unmarshal(body, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.ConvKey != "c" || resp.Error == nil || resp.Error.Kind != "unknown" || resp.Error.Message != "failed" {
+			t.Errorf("callback = %s", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback not received")
+	}
+}
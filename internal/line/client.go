@@ -0,0 +1,104 @@
+package line
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// client is a minimal client of the messaging api with the long-lived
+// channel access token.
+type client struct {
+	apiURL      string
+	accessToken string
+	http        *http.Client
+}
+
+// Error is the error response of the messaging api.
+type Error struct {
+	StatusCode int
+	Message    string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.StatusCode, e.Message)
+}
+
+type textMessage struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+func textMessages(texts []string) []textMessage {
+	messages := make([]textMessage, len(texts))
+	for i, text := range texts {
+		messages[i] = textMessage{Type: "text", Text: text}
+	}
+	return messages
+}
+
+func (c *client) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(c.apiURL, "/")+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		e := &Error{StatusCode: resp.StatusCode}
+		json.Unmarshal(data, e)
+		return e
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+// botUserID returns the user id of the bot, to find it in the mentions.
+func (c *client) botUserID(ctx context.Context) (string, error) {
+	var resp struct {
+		UserID string `json:"userId"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v2/bot/info", nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.UserID, nil
+}
+
+// reply replies by the reply token, it can be used only once.
+func (c *client) reply(ctx context.Context, replyToken string, texts []string) error {
+	body := map[string]interface{}{"replyToken": replyToken, "messages": textMessages(texts)}
+	return c.do(ctx, http.MethodPost, "/v2/bot/message/reply", body, nil)
+}
+
+// push sends the messages to the user, group or room.
+func (c *client) push(ctx context.Context, to string, texts []string) error {
+	body := map[string]interface{}{"to": to, "messages": textMessages(texts)}
+	return c.do(ctx, http.MethodPost, "/v2/bot/message/push", body, nil)
+}
@@ -0,0 +1,375 @@
+// Package line is the adapter of the line driver, it receives the message
+// events by the webhook of the messaging api and replies by the reply token,
+// or pushes the reply once the token expired.
+package line
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/pandodao/PAL9000/config"
+	"github.com/pandodao/PAL9000/internal/webhook"
+	"github.com/pandodao/PAL9000/service"
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	_ service.Adapter           = (*Bot)(nil)
+	_ service.ReloadableAdapter = (*Bot)(nil)
+	_ config.ServerConfig       = (*Config)(nil)
+)
+
+const (
+	defaultAPIURL = "https://api.line.me"
+	defaultPath   = "/line/webhook"
+	// max characters of a text message, counted in UTF-16
+	messageLimit = 5000
+	// max messages of a reply or push request
+	messagesPerRequest = 5
+	// the reply token is valid for about a minute, the reply is pushed
+	// after it
+	replyTokenTTL = 50 * time.Second
+	// line redelivers the events not answered
+	eventDedupExpiration = time.Hour
+)
+
+// Config is of a messaging api channel, its webhook url is the address and
+// path.
+type Config struct {
+	config.GeneralConfig `yaml:",inline"`
+
+	ChannelSecret      string `yaml:"channel_secret"`
+	ChannelAccessToken string `yaml:"channel_access_token"` // long-lived
+	Address            string `yaml:"address"`              // e.g. :8080
+	Path               string `yaml:"path"`                 // defaults to /line/webhook
+	// user, group or room ids allowed to talk to the bot
+	Whitelist []string `yaml:"whitelist"`
+	// defaults to https://api.line.me
+	APIURL string `yaml:"api_url"`
+}
+
+func (c *Config) ListenAddress() string {
+	return c.Address
+}
+
+func init() {
+	service.RegisterDriver("line", service.Driver{
+		Config: config.Driver{
+			NewConfig: func() config.DriverConfig {
+				return &Config{Path: defaultPath, APIURL: defaultAPIURL}
+			},
+			Validate: validate,
+		},
+		New: func(ctx context.Context, name string, cfg config.DriverConfig) (service.Adapter, error) {
+			return New(ctx, name, *cfg.(*Config))
+		},
+	})
+}
+
+func validate(cfg config.DriverConfig) []config.Problem {
+	c := cfg.(*Config)
+	problems := config.Required(map[string]string{
+		"channel_secret":       c.ChannelSecret,
+		"channel_access_token": c.ChannelAccessToken,
+		"address":              c.Address,
+	})
+	if !strings.HasPrefix(c.Path, "/") {
+		problems = append(problems, config.Problem{Path: "path", Message: "path must start with /"})
+	}
+	return problems
+}
+
+type replyKey struct{}
+
+// reply is where the reply goes, the push target is the source
+type reply struct {
+	token      string
+	receivedAt time.Time
+	to         string
+}
+
+type event struct {
+	Type           string `json:"type"`
+	Mode           string `json:"mode"` // active or standby
+	WebhookEventID string `json:"webhookEventId"`
+	ReplyToken     string `json:"replyToken"`
+	Source         struct {
+		Type    string `json:"type"` // user, group or room
+		UserID  string `json:"userId"`
+		GroupID string `json:"groupId"`
+		RoomID  string `json:"roomId"`
+	} `json:"source"`
+	Message struct {
+		Type    string `json:"type"`
+		Text    string `json:"text"`
+		Mention struct {
+			Mentionees []mentionee `json:"mentionees"`
+		} `json:"mention"`
+	} `json:"message"`
+}
+
+type mentionee struct {
+	// the position in UTF-16 code units
+	Index  int    `json:"index"`
+	Length int    `json:"length"`
+	UserID string `json:"userId"`
+	IsSelf bool   `json:"isSelf"`
+}
+
+// sourceID is the id of the user, group or room the event is from.
+func (e *event) sourceID() string {
+	switch e.Source.Type {
+	case "group":
+		return e.Source.GroupID
+	case "room":
+		return e.Source.RoomID
+	default:
+		return e.Source.UserID
+	}
+}
+
+type Bot struct {
+	name      string
+	server    *webhook.Server
+	client    *client
+	botUserID string
+	events    *cache.Cache
+	logger    logrus.FieldLogger
+
+	mu  sync.RWMutex
+	cfg Config
+}
+
+func New(ctx context.Context, name string, cfg Config) (*Bot, error) {
+	c := &client{
+		apiURL:      cfg.APIURL,
+		accessToken: cfg.ChannelAccessToken,
+		http:        &http.Client{Timeout: 30 * time.Second},
+	}
+	userID, err := c.botUserID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get bot info error: %w", err)
+	}
+
+	logger := logrus.WithField("adapter", "line").WithField("name", name)
+	server, err := webhook.Listen(cfg.Address, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Bot{
+		name:      name,
+		server:    server,
+		client:    c,
+		botUserID: userID,
+		events:    cache.New(eventDedupExpiration, 10*time.Minute),
+		logger:    logger,
+		cfg:       cfg,
+	}, nil
+}
+
+func (b *Bot) GetName() string {
+	return b.name
+}
+
+func (b *Bot) getConfig() Config {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.cfg
+}
+
+// Reload applies the channel secret, path and whitelist, a new access token
+// or address needs a restart.
+func (b *Bot) Reload(cfg config.AdapterConfig) bool {
+	c, ok := cfg.Config.(*Config)
+	if !ok {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.ChannelAccessToken != b.cfg.ChannelAccessToken || c.Address != b.cfg.Address || c.APIURL != b.cfg.APIURL {
+		return false
+	}
+	b.cfg = *c
+	return true
+}
+
+func (b *Bot) GetMessageChan(ctx context.Context) <-chan *service.Message {
+	msgChan := make(chan *service.Message)
+	b.server.Serve(b.webhookHandler(ctx, msgChan))
+	return msgChan
+}
+
+// Close shuts the server down after the pending webhooks are answered.
+func (b *Bot) Close() error {
+	return b.server.Close()
+}
+
+// signature is the X-Line-Signature of the request body.
+func signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (b *Bot) webhookHandler(ctx context.Context, msgChan chan<- *service.Message) http.HandlerFunc {
+	// the webhooks are answered right away, the messages are handed off
+	// after them in order
+	queue := webhook.NewQueue(ctx)
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := b.getConfig()
+		if r.URL.Path != cfg.Path {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if ctx.Err() != nil {
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := webhook.ReadBody(w, r)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if !hmac.Equal([]byte(r.Header.Get("X-Line-Signature")), []byte(signature(cfg.ChannelSecret, body))) {
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		var payload struct {
+			Events []event `json:"events"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+			return
+		}
+
+		// the verification of the webhook url has no events
+		receivedAt := time.Now()
+		var msgs []*service.Message
+		for i := range payload.Events {
+			if msg := b.message(&payload.Events[i], receivedAt); msg != nil {
+				msgs = append(msgs, msg)
+			}
+		}
+		if len(msgs) > 0 {
+			queue.Send(msgChan, msgs...)
+		}
+	}
+}
+
+func (b *Bot) message(e *event, receivedAt time.Time) *service.Message {
+	// the standby events are of another channel handling the chat
+	if e.Type != "message" || e.Mode == "standby" || e.Message.Type != "text" || e.ReplyToken == "" {
+		return nil
+	}
+	if !b.allowed(e.Source.UserID, e.sourceID()) {
+		return nil
+	}
+
+	text, mentioned := b.stripMention(e.Message.Text, e.Message.Mention.Mentionees)
+	if e.Source.Type != "user" && !mentioned {
+		return nil
+	}
+	if e.WebhookEventID != "" && b.events.Add(e.WebhookEventID, true, cache.DefaultExpiration) != nil {
+		return nil
+	}
+
+	r := reply{token: e.ReplyToken, receivedAt: receivedAt, to: e.sourceID()}
+	return &service.Message{
+		Context:      context.WithValue(context.Background(), replyKey{}, r),
+		UserIdentity: e.Source.UserID,
+		ConvKey:      e.sourceID(),
+		Content:      strings.TrimSpace(text),
+	}
+}
+
+// stripMention removes the mention of the bot from the text, and reports
+// whether it's mentioned.
+func (b *Bot) stripMention(text string, mentionees []mentionee) (string, bool) {
+	for _, m := range mentionees {
+		if !m.IsSelf && m.UserID != b.botUserID {
+			continue
+		}
+		units := utf16.Encode([]rune(text))
+		if m.Index < 0 || m.Length < 0 || m.Index+m.Length > len(units) {
+			return text, true
+		}
+		rest := append(units[:m.Index:m.Index], units[m.Index+m.Length:]...)
+		return string(utf16.Decode(rest)), true
+	}
+	return text, false
+}
+
+func (b *Bot) allowed(userID, sourceID string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if len(b.cfg.Whitelist) == 0 {
+		return true
+	}
+	for _, id := range b.cfg.Whitelist {
+		if id == userID || id == sourceID {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bot) HandleResult(req *service.Message, r *service.Result) {
+	if r.Err != nil && r.IgnoreIfError {
+		return
+	}
+
+	to := req.Context.Value(replyKey{}).(reply)
+	// the empty texts are rejected by the api
+	var parts []string
+	for _, part := range r.Parts(service.FormatPlain, messageLimit, service.UTF16Length) {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	for len(parts) > 0 {
+		n := len(parts)
+		if n > messagesPerRequest {
+			n = messagesPerRequest
+		}
+		if err := b.send(&to, parts[:n]); err != nil {
+			b.logger.WithError(err).Error("send message error")
+			return
+		}
+		parts = parts[n:]
+	}
+}
+
+// send replies by the token if it's still valid, or pushes the messages.
+func (b *Bot) send(to *reply, texts []string) error {
+	ctx := context.Background()
+	if to.token != "" && time.Since(to.receivedAt) < replyTokenTTL {
+		token := to.token
+		// the token can be used only once
+		to.token = ""
+		err := b.client.reply(ctx, token, texts)
+		if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusBadRequest {
+			return err
+		}
+		b.logger.WithError(err).Warn("reply error, push instead")
+	}
+	return b.client.push(ctx, to.to, texts)
+}
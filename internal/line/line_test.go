@@ -0,0 +1,302 @@
+package line
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pandodao/PAL9000/internal/webhook/webhooktest"
+	"github.com/pandodao/PAL9000/service"
+)
+
+// newStub serves the messaging api, the reply token "expired" is rejected.
+func newStub(t *testing.T) *webhooktest.Stub {
+	authorized := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			h(w, r)
+		}
+	}
+	return webhooktest.NewStub(t, map[string]http.HandlerFunc{
+		"/v2/bot/info": authorized(func(w http.ResponseWriter, r *http.Request) {
+			webhooktest.WriteJSON(w, `{"userId":"Ubot","displayName":"PAL"}`)
+		}),
+		"/v2/bot/message/reply": authorized(func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				ReplyToken string `json:"replyToken"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.ReplyToken == "expired" {
+				w.WriteHeader(http.StatusBadRequest)
+				webhooktest.WriteJSON(w, `{"message":"Invalid reply token"}`)
+				return
+			}
+			webhooktest.WriteJSON(w, `{}`)
+		}),
+		"/v2/bot/message/push": authorized(func(w http.ResponseWriter, r *http.Request) {
+			webhooktest.WriteJSON(w, `{}`)
+		}),
+	})
+}
+
+// newBot runs the channel against the stub.
+func newBot(t *testing.T, stub *webhooktest.Stub) (*Bot, http.Handler, chan *service.Message) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	b, err := New(ctx, "test", Config{
+		ChannelSecret:      "secret",
+		ChannelAccessToken: "token",
+		Address:            "127.0.0.1:0",
+		Path:               defaultPath,
+		APIURL:             stub.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	msgChan := make(chan *service.Message)
+	return b, b.webhookHandler(ctx, msgChan), msgChan
+}
+
+func signedRequest(secret, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, defaultPath, strings.NewReader(body))
+	req.Header.Set("X-Line-Signature", signature(secret, []byte(body)))
+	return req
+}
+
+const (
+	user  = `{"type":"user","userId":"U1"}`
+	group = `{"type":"group","groupId":"Cgroup","userId":"U1"}`
+	room  = `{"type":"room","roomId":"Rroom","userId":"U1"}`
+)
+
+type webhookEvent struct {
+	id, replyToken, source, text, mentionees string
+}
+
+func (e webhookEvent) String() string {
+	if e.replyToken == "" {
+		e.replyToken = "r-" + e.id
+	}
+	return `{"type":"message","mode":"active","webhookEventId":"` + e.id + `","replyToken":"` + e.replyToken + `",` +
+		`"source":` + e.source + `,"message":{"type":"text","id":"1","text":"` + e.text + `",` +
+		`"mention":{"mentionees":[` + e.mentionees + `]}}}`
+}
+
+// payload is the webhook body of the events.
+func payload(events ...webhookEvent) string {
+	s := make([]string, len(events))
+	for i, e := range events {
+		s[i] = e.String()
+	}
+	return `{"destination":"Ubot","events":[` + strings.Join(s, ",") + `]}`
+}
+
+// text is the first text of the messages sent.
+func text(t *testing.T, call webhooktest.Call) string {
+	t.Helper()
+	messages, _ := call.JSON(t)["messages"].([]interface{})
+	if len(messages) == 0 {
+		t.Fatalf("%s: no messages", call.Path)
+	}
+	return messages[0].(map[string]interface{})["text"].(string)
+}
+
+func TestSignature(t *testing.T) {
+	_, h, _ := newBot(t, newStub(t))
+
+	cases := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{name: "verification", req: signedRequest("secret", payload()), status: http.StatusOK},
+		{name: "wrong secret", req: signedRequest("wrong", payload()), status: http.StatusUnauthorized},
+		{
+			name:   "not signed",
+			req:    httptest.NewRequest(http.MethodPost, defaultPath, strings.NewReader(payload())),
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "unknown path",
+			req:    httptest.NewRequest(http.MethodPost, "/other", strings.NewReader(payload())),
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, c.req)
+			if w.Code != c.status {
+				t.Errorf("status = %d, want %d", w.Code, c.status)
+			}
+		})
+	}
+}
+
+func TestMention(t *testing.T) {
+	self := `{"index":6,"length":4,"userId":"Ubot","type":"user","isSelf":true}`
+	cases := []struct {
+		name  string
+		event webhookEvent
+		// nil if the message is ignored
+		want *service.Message
+	}{
+		{
+			name:  "not mentioned in the group",
+			event: webhookEvent{source: group, text: "hello"},
+		},
+		{
+			name:  "mentioned after a surrogate pair",
+			event: webhookEvent{source: group, text: "hi 🙂 @PAL how are you", mentionees: self},
+			want:  &service.Message{Content: "hi 🙂  how are you", ConvKey: "Cgroup", UserIdentity: "U1"},
+		},
+		{
+			name:  "mentioned by the user id in the room",
+			event: webhookEvent{source: room, text: "@PAL hello", mentionees: `{"index":0,"length":4,"userId":"Ubot"}`},
+			want:  &service.Message{Content: "hello", ConvKey: "Rroom", UserIdentity: "U1"},
+		},
+		{
+			name:  "another user mentioned",
+			event: webhookEvent{source: group, text: "@Bob hello", mentionees: `{"index":0,"length":4,"userId":"U2"}`},
+		},
+		{
+			name:  "user chat",
+			event: webhookEvent{source: user, text: "hello"},
+			want:  &service.Message{Content: "hello", ConvKey: "U1", UserIdentity: "U1"},
+		},
+	}
+
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, h, msgChan := newBot(t, newStub(t))
+			c.event.id = "e" + strconv.Itoa(i)
+			webhooktest.CheckMessage(t, webhooktest.Receive(t, h, signedRequest("secret", payload(c.event)), msgChan), c.want)
+		})
+	}
+}
+
+func TestDedup(t *testing.T) {
+	_, h, msgChan := newBot(t, newStub(t))
+
+	body := payload(webhookEvent{id: "e1", source: user, text: "hello"})
+	webhooktest.MustReceive(t, h, signedRequest("secret", body), msgChan)
+	if msg := webhooktest.Receive(t, h, signedRequest("secret", body), msgChan); msg != nil {
+		t.Errorf("redelivered event received: %+v", msg)
+	}
+}
+
+func TestOrder(t *testing.T) {
+	_, h, msgChan := newBot(t, newStub(t))
+
+	var events []webhookEvent
+	for i := 0; i < 3; i++ {
+		events = append(events, webhookEvent{id: "e" + strconv.Itoa(i), source: user, text: strconv.Itoa(i)})
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, signedRequest("secret", payload(events...)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	for i := range events {
+		select {
+		case msg := <-msgChan:
+			if msg.Content != strconv.Itoa(i) {
+				t.Errorf("message %d = %q", i, msg.Content)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d not received", i)
+		}
+	}
+}
+
+func TestHandleResult(t *testing.T) {
+	stub := newStub(t)
+	b, h, msgChan := newBot(t, stub)
+
+	receive := func(e webhookEvent) *service.Message {
+		t.Helper()
+		return webhooktest.MustReceive(t, h, signedRequest("secret", payload(e)), msgChan)
+	}
+
+	msg := receive(webhookEvent{id: "e1", source: user, text: "hello"})
+	b.HandleResult(msg, webhooktest.Reply("**fine**"))
+	call := stub.Next(t, "/v2/bot/message/reply")
+	if call.JSON(t)["replyToken"] != "r-e1" || text(t, call) != "fine" {
+		t.Errorf("reply = %s", call.Body)
+	}
+
+	// nothing is sent for the empty reply, the token is kept for the next one
+	msg = receive(webhookEvent{id: "e4", source: user, text: "hello"})
+	b.HandleResult(msg, webhooktest.Reply(""))
+	b.HandleResult(msg, webhooktest.Reply("next"))
+	call = stub.Next(t, "/v2/bot/message/reply")
+	if call.JSON(t)["replyToken"] != "r-e4" || text(t, call) != "next" {
+		t.Errorf("reply = %s", call.Body)
+	}
+
+	// the rejected reply token falls back to push
+	msg = receive(webhookEvent{id: "e2", replyToken: "expired", source: user, text: "hello"})
+	b.HandleResult(msg, webhooktest.Reply("pushed"))
+	stub.Next(t, "/v2/bot/message/reply")
+	call = stub.Next(t, "/v2/bot/message/push")
+	if call.JSON(t)["to"] != "U1" || text(t, call) != "pushed" {
+		t.Errorf("push = %s", call.Body)
+	}
+
+	// the reply token expired while the turn was running
+	msg = receive(webhookEvent{id: "e3", source: room, text: "@PAL hello", mentionees: `{"index":0,"length":4,"userId":"Ubot"}`})
+	to := msg.Context.Value(replyKey{}).(reply)
+	to.receivedAt = time.Now().Add(-time.Minute)
+	msg.Context = context.WithValue(msg.Context, replyKey{}, to)
+	b.HandleResult(msg, webhooktest.Reply("late"))
+	call = stub.Next(t, "/v2/bot/message/push")
+	if call.JSON(t)["to"] != "Rroom" || text(t, call) != "late" {
+		t.Errorf("push = %s", call.Body)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  *Config
+		want []string
+	}{
+		{
+			name: "valid",
+			cfg:  &Config{ChannelSecret: "secret", ChannelAccessToken: "token", Address: ":8080", Path: defaultPath},
+		},
+		{
+			name: "missing",
+			cfg:  &Config{Path: "line"},
+			want: []string{
+				"address: address is required",
+				"channel_access_token: channel_access_token is required",
+				"channel_secret: channel_secret is required",
+				"path: path must start with /",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var got []string
+			for _, p := range validate(c.cfg) {
+				got = append(got, p.String())
+			}
+			if strings.Join(got, "\n") != strings.Join(c.want, "\n") {
+				t.Errorf("validate() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
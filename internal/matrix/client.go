@@ -0,0 +1,173 @@
+package matrix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// client is a minimal client of the matrix client-server api.
+type client struct {
+	homeserver  string
+	accessToken string
+	http        *http.Client
+}
+
+// Error is the error response of the homeserver.
+type Error struct {
+	StatusCode int
+	Code       string `json:"errcode"`
+	Message    string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("matrix %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+type Event struct {
+	Type     string                 `json:"type"`
+	EventID  string                 `json:"event_id"`
+	Sender   string                 `json:"sender"`
+	StateKey *string                `json:"state_key,omitempty"`
+	Content  map[string]interface{} `json:"content"`
+}
+
+type syncResponse struct {
+	NextBatch   string `json:"next_batch"`
+	AccountData struct {
+		Events []Event `json:"events"`
+	} `json:"account_data"`
+	Rooms struct {
+		Join map[string]struct {
+			Summary struct {
+				JoinedMemberCount  *int `json:"m.joined_member_count"`
+				InvitedMemberCount *int `json:"m.invited_member_count"`
+			} `json:"summary"`
+			State struct {
+				Events []Event `json:"events"`
+			} `json:"state"`
+			Timeline struct {
+				Events []Event `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]struct {
+			InviteState struct {
+				Events []Event `json:"events"`
+			} `json:"invite_state"`
+		} `json:"invite"`
+	} `json:"rooms"`
+}
+
+func (c *client) do(ctx context.Context, method, path string, query url.Values, body, result interface{}) error {
+	u := strings.TrimRight(c.homeserver, "/") + "/_matrix/client/v3" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		e := &Error{StatusCode: resp.StatusCode}
+		json.Unmarshal(data, e)
+		return e
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+func (c *client) whoami(ctx context.Context) (string, error) {
+	var resp struct {
+		UserID string `json:"user_id"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/account/whoami", nil, nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.UserID, nil
+}
+
+func (c *client) displayName(ctx context.Context, userID string) (string, error) {
+	var resp struct {
+		DisplayName string `json:"displayname"`
+	}
+	err := c.do(ctx, http.MethodGet, "/profile/"+url.PathEscape(userID)+"/displayname", nil, nil, &resp)
+	return resp.DisplayName, err
+}
+
+func (c *client) sync(ctx context.Context, since string, timeout time.Duration) (*syncResponse, error) {
+	query := url.Values{}
+	query.Set("timeout", fmt.Sprint(timeout.Milliseconds()))
+	if since != "" {
+		query.Set("since", since)
+	} else {
+		// only the position is needed at the first sync, the history is
+		// never answered
+		query.Set("filter", `{"room":{"timeline":{"limit":1}}}`)
+	}
+
+	var resp syncResponse
+	if err := c.do(ctx, http.MethodGet, "/sync", query, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *client) join(ctx context.Context, roomID string) error {
+	return c.do(ctx, http.MethodPost, "/rooms/"+url.PathEscape(roomID)+"/join", nil, struct{}{}, nil)
+}
+
+func (c *client) event(ctx context.Context, roomID, eventID string) (*Event, error) {
+	var e Event
+	if err := c.do(ctx, http.MethodGet, "/rooms/"+url.PathEscape(roomID)+"/event/"+url.PathEscape(eventID), nil, nil, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (c *client) send(ctx context.Context, roomID, txnID string, content interface{}) (string, error) {
+	var resp struct {
+		EventID string `json:"event_id"`
+	}
+	path := "/rooms/" + url.PathEscape(roomID) + "/send/m.room.message/" + url.PathEscape(txnID)
+	if err := c.do(ctx, http.MethodPut, path, nil, content, &resp); err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
+
+func (c *client) typing(ctx context.Context, roomID, userID string, timeout time.Duration) error {
+	body := map[string]interface{}{"typing": true, "timeout": timeout.Milliseconds()}
+	return c.do(ctx, http.MethodPut, "/rooms/"+url.PathEscape(roomID)+"/typing/"+url.PathEscape(userID), nil, body, nil)
+}
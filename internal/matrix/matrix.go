@@ -0,0 +1,478 @@
+// Package matrix is the adapter of the matrix driver, it long-polls /sync of
+// the homeserver. End-to-end encryption is out of scope, the bot can't read
+// the messages of the encrypted rooms, so it doesn't join them when invited
+// and warns about the ones it's already in.
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pandodao/PAL9000/config"
+	"github.com/pandodao/PAL9000/service"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	_ service.Adapter           = (*Bot)(nil)
+	_ service.TypingAdapter     = (*Bot)(nil)
+	_ service.ReloadableAdapter = (*Bot)(nil)
+)
+
+const (
+	defaultSyncTimeout = 30 // seconds
+	// max bytes of an event, the html and the plain body share it
+	eventLimit = 64 * 1024
+	// max bytes of the html of a message, the plain body rendered from it is
+	// about as long, so both fit into an event
+	messageLimit  = 30 * 1024
+	typingTimeout = 10 * time.Second
+)
+
+type Config struct {
+	config.GeneralConfig `yaml:",inline"`
+
+	Homeserver  string `yaml:"homeserver"` // e.g. https://matrix.org
+	AccessToken string `yaml:"access_token"`
+	// the conversation is per room and user instead of per room
+	ConvPerUser bool `yaml:"conv_per_user"`
+	// join the rooms invited to by the allowed users, defaults to true
+	AutoJoin bool `yaml:"auto_join"`
+	// room ids or mxids allowed to talk to the bot, e.g. !abc:matrix.org or
+	// @alice:matrix.org
+	Whitelist   []string `yaml:"whitelist"`
+	SyncTimeout int64    `yaml:"sync_timeout"` // seconds of the long poll, defaults to 30
+}
+
+func init() {
+	service.RegisterDriver("matrix", service.Driver{
+		Config: config.Driver{
+			NewConfig: func() config.DriverConfig {
+				return &Config{AutoJoin: true, SyncTimeout: defaultSyncTimeout}
+			},
+			Validate: func(cfg config.DriverConfig) []config.Problem {
+				c := cfg.(*Config)
+				var problems []config.Problem
+				if !strings.HasPrefix(c.Homeserver, "http://") && !strings.HasPrefix(c.Homeserver, "https://") {
+					problems = append(problems, config.Problem{Path: "homeserver", Message: "homeserver must be an http or https url"})
+				}
+				if c.AccessToken == "" {
+					problems = append(problems, config.Problem{Path: "access_token", Message: "access_token is required"})
+				}
+				return problems
+			},
+		},
+		New: func(ctx context.Context, name string, cfg config.DriverConfig) (service.Adapter, error) {
+			return New(ctx, name, *cfg.(*Config))
+		},
+	})
+}
+
+type messageKey struct{}
+
+// message is the event replied to
+type message struct {
+	roomID  string
+	eventID string
+}
+
+type Bot struct {
+	name        string
+	client      *client
+	userID      string
+	displayName string
+	logger      logrus.FieldLogger
+	txnID       int64
+
+	// updated by the sync loop only
+	directRooms map[string]bool
+	memberCount map[string]int
+	encrypted   map[string]bool
+
+	mu  sync.RWMutex
+	cfg Config
+}
+
+func New(ctx context.Context, name string, cfg Config) (*Bot, error) {
+	timeout := time.Duration(cfg.SyncTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultSyncTimeout * time.Second
+	}
+	c := &client{
+		homeserver:  cfg.Homeserver,
+		accessToken: cfg.AccessToken,
+		http:        &http.Client{Timeout: timeout + 30*time.Second},
+	}
+
+	userID, err := c.whoami(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("matrix whoami error: %w", err)
+	}
+	b := &Bot{
+		name:        name,
+		client:      c,
+		userID:      userID,
+		logger:      logrus.WithField("adapter", "matrix").WithField("name", name),
+		directRooms: make(map[string]bool),
+		memberCount: make(map[string]int),
+		encrypted:   make(map[string]bool),
+		cfg:         cfg,
+	}
+	// the clients mention the bot by the display name in the plain body
+	if b.displayName, err = c.displayName(ctx, userID); err != nil {
+		b.logger.WithError(err).Warn("get display name error")
+	}
+	return b, nil
+}
+
+func (b *Bot) GetName() string {
+	return b.name
+}
+
+func (b *Bot) getConfig() Config {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.cfg
+}
+
+// Reload applies the whitelist and the conversation and join options, a new
+// homeserver or access token needs a restart.
+func (b *Bot) Reload(cfg config.AdapterConfig) bool {
+	c, ok := cfg.Config.(*Config)
+	if !ok {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.Homeserver != b.cfg.Homeserver || c.AccessToken != b.cfg.AccessToken {
+		return false
+	}
+	b.cfg = *c
+	return true
+}
+
+func (b *Bot) GetMessageChan(ctx context.Context) <-chan *service.Message {
+	msgChan := make(chan *service.Message)
+	go func() {
+		defer close(msgChan)
+
+		since := ""
+		backoff := time.Second
+		for {
+			timeout := time.Duration(b.getConfig().SyncTimeout) * time.Second
+			if timeout <= 0 {
+				timeout = defaultSyncTimeout * time.Second
+			}
+			resp, err := b.client.sync(ctx, since, timeout)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				b.logger.WithError(err).Error("sync error")
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return
+				}
+				if backoff *= 2; backoff > 30*time.Second {
+					backoff = 30 * time.Second
+				}
+				continue
+			}
+
+			backoff = time.Second
+			b.handleSync(ctx, msgChan, resp, since == "")
+			since = resp.NextBatch
+		}
+	}()
+	return msgChan
+}
+
+// Close does nothing, the sync loop is stopped with the context of
+// GetMessageChan and the replies are sent by plain requests.
+func (b *Bot) Close() error {
+	return nil
+}
+
+// handleSync handles the events of a sync, the timeline of the first one is
+// the history which is skipped.
+func (b *Bot) handleSync(ctx context.Context, msgChan chan<- *service.Message, resp *syncResponse, first bool) {
+	for _, e := range resp.AccountData.Events {
+		if e.Type == "m.direct" {
+			b.updateDirectRooms(e.Content)
+		}
+	}
+
+	for roomID, room := range resp.Rooms.Invite {
+		b.handleInvite(ctx, roomID, room.InviteState.Events)
+	}
+
+	for roomID, room := range resp.Rooms.Join {
+		if encrypted(room.State.Events) || encrypted(room.Timeline.Events) {
+			b.markEncrypted(roomID)
+		}
+		if room.Summary.JoinedMemberCount != nil {
+			count := *room.Summary.JoinedMemberCount
+			if room.Summary.InvitedMemberCount != nil {
+				count += *room.Summary.InvitedMemberCount
+			}
+			b.memberCount[roomID] = count
+		}
+		if first {
+			continue
+		}
+		for _, e := range room.Timeline.Events {
+			b.handleEvent(ctx, msgChan, roomID, e)
+		}
+	}
+}
+
+// updateDirectRooms adds the rooms of the m.direct account data, which is a
+// map of the users to their dm rooms.
+func (b *Bot) updateDirectRooms(content map[string]interface{}) {
+	for _, rooms := range content {
+		list, _ := rooms.([]interface{})
+		for _, r := range list {
+			if id, ok := r.(string); ok {
+				b.directRooms[id] = true
+			}
+		}
+	}
+}
+
+func (b *Bot) handleInvite(ctx context.Context, roomID string, events []Event) {
+	if !b.getConfig().AutoJoin {
+		return
+	}
+
+	for _, e := range events {
+		if e.Type != "m.room.member" || e.StateKey == nil || *e.StateKey != b.userID || e.Content["membership"] != "invite" {
+			continue
+		}
+		if !b.allowed(e.Sender, roomID) {
+			b.logger.WithField("room", roomID).WithField("inviter", e.Sender).Info("invite ignored")
+			return
+		}
+		if encrypted(events) {
+			b.logger.WithField("room", roomID).WithField("inviter", e.Sender).Warn("invite to the encrypted room ignored, end-to-end encryption is not supported")
+			return
+		}
+		if isDirect, _ := e.Content["is_direct"].(bool); isDirect {
+			b.directRooms[roomID] = true
+		}
+		if err := b.client.join(ctx, roomID); err != nil {
+			b.logger.WithError(err).WithField("room", roomID).Error("join room error")
+		}
+		return
+	}
+}
+
+// encrypted reports whether the state events enable the encryption.
+func encrypted(events []Event) bool {
+	for _, e := range events {
+		if e.Type == "m.room.encryption" {
+			return true
+		}
+	}
+	return false
+}
+
+// markEncrypted warns once that the messages of the room can't be read.
+func (b *Bot) markEncrypted(roomID string) {
+	if b.encrypted[roomID] {
+		return
+	}
+	b.encrypted[roomID] = true
+	b.logger.WithField("room", roomID).Warn("the messages of the encrypted room can't be read, end-to-end encryption is not supported")
+}
+
+func (b *Bot) isDirect(roomID string) bool {
+	return b.directRooms[roomID] || b.memberCount[roomID] == 2
+}
+
+func (b *Bot) handleEvent(ctx context.Context, msgChan chan<- *service.Message, roomID string, e Event) {
+	if e.Sender == b.userID {
+		return
+	}
+	if e.Type == "m.room.encrypted" {
+		b.markEncrypted(roomID)
+		return
+	}
+	if e.Type != "m.room.message" || e.Content["msgtype"] != "m.text" {
+		return
+	}
+	relatesTo, _ := e.Content["m.relates_to"].(map[string]interface{})
+	// edits
+	if relatesTo["rel_type"] == "m.replace" {
+		return
+	}
+	if !b.allowed(e.Sender, roomID) {
+		return
+	}
+
+	body, _ := e.Content["body"].(string)
+	replyContent := ""
+	repliedToBot := false
+	if inReplyTo, ok := relatesTo["m.in_reply_to"].(map[string]interface{}); ok {
+		body = stripReplyFallback(body)
+		if eventID, _ := inReplyTo["event_id"].(string); eventID != "" {
+			parent, err := b.client.event(ctx, roomID, eventID)
+			if err != nil {
+				b.logger.WithError(err).Error("get replied event error")
+			} else {
+				repliedToBot = parent.Sender == b.userID
+				replyContent, _ = parent.Content["body"].(string)
+				replyContent = stripReplyFallback(replyContent)
+			}
+		}
+	}
+
+	if !b.isDirect(roomID) && !repliedToBot && !b.mentioned(e.Content, body) {
+		return
+	}
+
+	convKey := roomID
+	if b.getConfig().ConvPerUser {
+		convKey = roomID + ":" + e.Sender
+	}
+	msg := &service.Message{
+		Context:      context.WithValue(context.Background(), messageKey{}, &message{roomID: roomID, eventID: e.EventID}),
+		ReplyContent: replyContent,
+		UserIdentity: e.Sender,
+		ConvKey:      convKey,
+		Content:      b.stripMention(body),
+	}
+	select {
+	case msgChan <- msg:
+	case <-ctx.Done():
+	}
+}
+
+// mentioned checks the m.mentions of the message, and the mxid or display
+// name in the body for the clients not setting it.
+func (b *Bot) mentioned(content map[string]interface{}, body string) bool {
+	if mentions, ok := content["m.mentions"].(map[string]interface{}); ok {
+		ids, _ := mentions["user_ids"].([]interface{})
+		for _, id := range ids {
+			if id == b.userID {
+				return true
+			}
+		}
+	}
+	if formatted, _ := content["formatted_body"].(string); strings.Contains(formatted, "https://matrix.to/#/"+b.userID) {
+		return true
+	}
+	return strings.Contains(body, b.userID) || (b.displayName != "" && strings.HasPrefix(body, b.displayName))
+}
+
+func (b *Bot) stripMention(body string) string {
+	body = strings.TrimSpace(strings.ReplaceAll(body, b.userID, ""))
+	if b.displayName != "" && strings.HasPrefix(body, b.displayName) {
+		body = strings.TrimPrefix(body, b.displayName)
+	}
+	return strings.TrimSpace(strings.TrimLeft(body, ":,"))
+}
+
+// stripReplyFallback removes the quote of the replied message the clients
+// put before the body.
+func stripReplyFallback(body string) string {
+	if !strings.HasPrefix(body, "> ") {
+		return body
+	}
+	lines := strings.Split(body, "\n")
+	i := 0
+	for i < len(lines) && strings.HasPrefix(lines[i], ">") {
+		i++
+	}
+	return strings.TrimSpace(strings.Join(lines[i:], "\n"))
+}
+
+func (b *Bot) allowed(userID, roomID string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if len(b.cfg.Whitelist) == 0 {
+		return true
+	}
+	for _, id := range b.cfg.Whitelist {
+		if id == userID || id == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bot) HandleResult(req *service.Message, r *service.Result) {
+	if r.Err != nil && r.IgnoreIfError {
+		return
+	}
+	m := req.Context.Value(messageKey{}).(*message)
+
+	for i, part := range r.Parts(service.FormatTelegramHTML, messageLimit, service.ByteLength) {
+		content := map[string]interface{}{
+			"msgtype":        "m.text",
+			"body":           plainBody(part),
+			"format":         "org.matrix.custom.html",
+			"formatted_body": part,
+		}
+		if i == 0 {
+			content["m.relates_to"] = map[string]interface{}{
+				"m.in_reply_to": map[string]interface{}{"event_id": m.eventID},
+			}
+		}
+		// the quotes and links may make the plain body longer, the html is
+		// dropped if they don't fit together
+		if data, _ := json.Marshal(content); len(data) > eventLimit {
+			delete(content, "format")
+			delete(content, "formatted_body")
+		}
+
+		txnID := fmt.Sprintf("pal9000-%d-%d", time.Now().UnixNano(), atomic.AddInt64(&b.txnID, 1))
+		if _, err := b.client.send(context.Background(), m.roomID, txnID, content); err != nil {
+			b.logger.WithError(err).Error("send message error")
+			return
+		}
+	}
+}
+
+var (
+	linkTag  = regexp.MustCompile(`(?s)<a href="([^"]*)">(.*?)</a>`)
+	quoteTag = regexp.MustCompile(`(?s)<blockquote>(.*?)</blockquote>`)
+	htmlTag  = regexp.MustCompile(`<[^>]*>`)
+)
+
+// plainBody is the plain text of the html rendered by service.Render, it's
+// the body of the message for the clients not showing the html.
+func plainBody(s string) string {
+	s = linkTag.ReplaceAllStringFunc(s, func(a string) string {
+		m := linkTag.FindStringSubmatch(a)
+		url, label := m[1], htmlTag.ReplaceAllString(m[2], "")
+		if html.UnescapeString(label) == html.UnescapeString(url) {
+			return url
+		}
+		return label + " (" + url + ")"
+	})
+	s = quoteTag.ReplaceAllStringFunc(s, func(q string) string {
+		return "> " + strings.ReplaceAll(quoteTag.FindStringSubmatch(q)[1], "\n", "\n> ")
+	})
+	return html.UnescapeString(htmlTag.ReplaceAllString(s, ""))
+}
+
+func (b *Bot) SendTyping(req *service.Message) error {
+	m := req.Context.Value(messageKey{}).(*message)
+	return b.client.typing(context.Background(), m.roomID, b.userID, typingTimeout)
+}
+
+// TypingInterval refreshes the typing notification before it times out.
+func (b *Bot) TypingInterval() time.Duration {
+	return typingTimeout - 2*time.Second
+}
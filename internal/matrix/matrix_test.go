@@ -0,0 +1,178 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pandodao/PAL9000/service"
+	"github.com/pandodao/botastic-go"
+)
+
+const stubSync = `{"next_batch":"s2","rooms":{
+"invite":{"!new:hs":{"invite_state":{"events":[
+  {"type":"m.room.member","sender":"@alice:hs","state_key":"@bot:hs","content":{"membership":"invite","is_direct":true}}]}},
+  "!secret:hs":{"invite_state":{"events":[
+  {"type":"m.room.encryption","sender":"@alice:hs","state_key":"","content":{"algorithm":"m.megolm.v1.aes-sha2"}},
+  {"type":"m.room.member","sender":"@alice:hs","state_key":"@bot:hs","content":{"membership":"invite"}}]}}},
+"join":{
+  "!dm:hs":{"summary":{"m.joined_member_count":2},"timeline":{"events":[
+    {"type":"m.room.message","event_id":"$1","sender":"@alice:hs","content":{"msgtype":"m.text","body":"hi there"}}]}},
+  "!room:hs":{"summary":{"m.joined_member_count":5},"timeline":{"events":[
+    {"type":"m.room.message","event_id":"$2","sender":"@alice:hs","content":{"msgtype":"m.text","body":"not for the bot"}},
+    {"type":"m.room.message","event_id":"$3","sender":"@bob:hs","content":{"msgtype":"m.text","body":"PAL: what is up","m.mentions":{"user_ids":["@bot:hs"]}}},
+    {"type":"m.room.message","event_id":"$4","sender":"@carol:hs","content":{"msgtype":"m.text","body":"> <@bot:hs> earlier answer\n\nand then?",
+      "m.relates_to":{"m.in_reply_to":{"event_id":"$0"}}}}]}}}}}`
+
+// stubHomeserver serves the client-server api used by the bot, the first
+// sync returns the history which must be skipped.
+type stubHomeserver struct {
+	mu     sync.Mutex
+	syncs  int
+	joined []string
+	sent   []map[string]interface{}
+}
+
+func (s *stubHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"invalid token"}`))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/_matrix/client/v3")
+	switch {
+	case path == "/account/whoami":
+		w.Write([]byte(`{"user_id":"@bot:hs"}`))
+	case strings.HasPrefix(path, "/profile/"):
+		w.Write([]byte(`{"displayname":"PAL"}`))
+	case path == "/sync":
+		s.syncs++
+		switch s.syncs {
+		case 1:
+			w.Write([]byte(`{"next_batch":"s1","rooms":{"join":{"!dm:hs":{"timeline":{"events":[
+				{"type":"m.room.message","event_id":"$old","sender":"@alice:hs","content":{"msgtype":"m.text","body":"old"}}]}},
+				"!e2e:hs":{"state":{"events":[{"type":"m.room.encryption","sender":"@alice:hs","state_key":"","content":{}}]}}}}}`))
+		case 2:
+			if r.URL.Query().Get("since") != "s1" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(stubSync))
+		default:
+			s.mu.Unlock()
+			<-r.Context().Done()
+			s.mu.Lock()
+		}
+	case strings.HasSuffix(path, "/join"):
+		s.joined = append(s.joined, strings.Split(path, "/")[2])
+		w.Write([]byte(`{}`))
+	case strings.HasSuffix(path, "/event/$0"):
+		w.Write([]byte(`{"type":"m.room.message","event_id":"$0","sender":"@bot:hs","content":{"msgtype":"m.text","body":"earlier answer"}}`))
+	case strings.Contains(path, "/send/m.room.message/"):
+		var content map[string]interface{}
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &content)
+		s.sent = append(s.sent, content)
+		w.Write([]byte(`{"event_id":"$sent"}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestBot(t *testing.T) {
+	stub := &stubHomeserver{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b, err := New(ctx, "test", Config{Homeserver: server.URL, AccessToken: "token", AutoJoin: true, ConvPerUser: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.userID != "@bot:hs" || b.displayName != "PAL" {
+		t.Fatalf("user = %s, display name = %s", b.userID, b.displayName)
+	}
+
+	msgChan := b.GetMessageChan(ctx)
+	var msgs []*service.Message
+	for len(msgs) < 3 {
+		select {
+		case msg := <-msgChan:
+			msgs = append(msgs, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d messages", len(msgs))
+		}
+	}
+
+	// the rooms are iterated in random order
+	got := map[string]*service.Message{}
+	for _, msg := range msgs {
+		got[msg.UserIdentity] = msg
+	}
+	if m := got["@alice:hs"]; m == nil || m.Content != "hi there" || m.ConvKey != "!dm:hs:@alice:hs" {
+		t.Errorf("dm = %+v", m)
+	}
+	if m := got["@bob:hs"]; m == nil || m.Content != "what is up" {
+		t.Errorf("mention = %+v", m)
+	}
+	if m := got["@carol:hs"]; m == nil || m.Content != "and then?" || m.ReplyContent != "earlier answer" {
+		t.Errorf("reply = %+v", m)
+	}
+
+	// marked by the first sync, before the messages are sent
+	if !b.encrypted["!e2e:hs"] {
+		t.Error("encrypted room not found")
+	}
+
+	b.HandleResult(got["@bob:hs"], &service.Result{ConvTurn: &botastic.ConvTurn{Response: "**fine**"}})
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	// the encrypted room is not joined
+	if len(stub.joined) != 1 || stub.joined[0] != "!new:hs" {
+		t.Errorf("joined = %v", stub.joined)
+	}
+	if len(stub.sent) != 1 {
+		t.Fatalf("sent = %v", stub.sent)
+	}
+	sent := stub.sent[0]
+	if sent["body"] != "fine" || sent["formatted_body"] != "<b>fine</b>" {
+		t.Errorf("sent = %v", sent)
+	}
+	relatesTo, _ := sent["m.relates_to"].(map[string]interface{})
+	if inReplyTo, _ := relatesTo["m.in_reply_to"].(map[string]interface{}); inReplyTo["event_id"] != "$3" {
+		t.Errorf("m.relates_to = %v", relatesTo)
+	}
+}
+
+func TestPlainBody(t *testing.T) {
+	cases := []struct {
+		name     string
+		markdown string
+		want     string
+	}{
+		{name: "formatting", markdown: "**a** & `<b>`", want: "a & <b>"},
+		{name: "link", markdown: "[docs](https://example.com/?a=1&b=2)", want: "docs (https://example.com/?a=1&b=2)"},
+		{name: "bare link", markdown: "see https://example.com", want: "see https://example.com"},
+		{name: "quote", markdown: "> one\n> two", want: "> one\n> two"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			parts := (&service.Result{ConvTurn: &botastic.ConvTurn{Response: c.markdown}}).Parts(service.FormatTelegramHTML, messageLimit, service.ByteLength)
+			if got := plainBody(parts[0]); got != c.want {
+				t.Errorf("plainBody(%q) = %q, want %q", parts[0], got, c.want)
+			}
+		})
+	}
+}
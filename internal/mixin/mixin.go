@@ -1,12 +1,14 @@
 package mixin
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fox-one/mixin-sdk-go"
@@ -28,7 +30,26 @@ type (
 	convKey    struct{}
 )
 
-var _ service.Adapter = (*Bot)(nil)
+// max bytes of the text of a message, the base64 encoded data must be within
+// 64KB
+const messageLimit = 32 * 1024
+
+// seconds the messages are cached for the quotes
+const defaultMessageCacheExpiration = 60 * 60 * 24
+
+var (
+	_ service.Adapter           = (*Bot)(nil)
+	_ service.TypingAdapter     = (*Bot)(nil)
+	_ service.ReloadableAdapter = (*Bot)(nil)
+)
+
+type Config struct {
+	config.GeneralConfig `yaml:",inline"`
+
+	Keystore               string   `yaml:"keystore"` // base64 encoded keystore (json format)
+	Whitelist              []string `yaml:"whitelist"`
+	MessageCacheExpiration int64    `yaml:"message_cache_expiration"`
+}
 
 type Bot struct {
 	name    string
@@ -38,12 +59,55 @@ type Bot struct {
 	client       *mixin.Client
 	msgChan      chan *service.Message
 	me           *mixin.User
-	cfg          config.MixinConfig
 	logger       logrus.FieldLogger
 	messageCache *cache.Cache
+
+	mu  sync.RWMutex
+	cfg Config
 }
 
-func Init(ctx context.Context, name string, cfg config.MixinConfig) (*Bot, error) {
+func init() {
+	service.RegisterDriver("mixin", service.Driver{
+		Config: config.Driver{
+			NewConfig: func() config.DriverConfig { return &Config{} },
+			Validate: func(cfg config.DriverConfig) []config.Problem {
+				return keystoreProblems(cfg.(*Config).Keystore)
+			},
+		},
+		New: func(ctx context.Context, name string, cfg config.DriverConfig) (service.Adapter, error) {
+			b, err := Init(ctx, name, *cfg.(*Config))
+			if err != nil {
+				return nil, err
+			}
+			return b, nil
+		},
+	})
+}
+
+func keystoreProblems(keystore string) []config.Problem {
+	problem := func(format string, args ...interface{}) config.Problem {
+		return config.Problem{Path: "keystore", Message: fmt.Sprintf(format, args...)}
+	}
+
+	data, err := base64.StdEncoding.DecodeString(keystore)
+	if err != nil {
+		return []config.Problem{problem("keystore is not valid base64: %v", err)}
+	}
+
+	var fields map[string]interface{}
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&fields); err != nil {
+		return []config.Problem{problem("keystore is not valid json: %v", err)}
+	}
+	var problems []config.Problem
+	for _, key := range []string{"client_id", "session_id", "private_key"} {
+		if v, _ := fields[key].(string); v == "" {
+			problems = append(problems, problem("%s of the keystore is empty", key))
+		}
+	}
+	return problems
+}
+
+func Init(ctx context.Context, name string, cfg Config) (*Bot, error) {
 	data, err := base64.StdEncoding.DecodeString(cfg.Keystore)
 	if err != nil {
 		return nil, fmt.Errorf("base64 decode keystore error: %w", err)
@@ -65,7 +129,7 @@ func Init(ctx context.Context, name string, cfg config.MixinConfig) (*Bot, error
 	}
 
 	if cfg.MessageCacheExpiration == 0 {
-		cfg.MessageCacheExpiration = 60 * 60 * 24
+		cfg.MessageCacheExpiration = defaultMessageCacheExpiration
 	}
 
 	return &Bot{
@@ -106,8 +170,15 @@ func (b *Bot) GetMessageChan(ctx context.Context) <-chan *service.Message {
 	return b.msgChan
 }
 
+// Close does nothing, the blaze loop is stopped with the context of
+// GetMessageChan and the replies are sent by plain requests.
+func (b *Bot) Close() error {
+	return nil
+}
+
 func (b *Bot) HandleResult(req *service.Message, r *service.Result) {
-	defer close(req.DoneChan)
+	msg := req.Context.Value(messageKey{}).(*mixin.MessageView)
+	defer b.ack(msg)
 
 	b.logger.WithField("result", r).Info("get result")
 	if r.Err != nil && r.IgnoreIfError {
@@ -115,34 +186,68 @@ func (b *Bot) HandleResult(req *service.Message, r *service.Result) {
 		return
 	}
 
-	msg := req.Context.Value(messageKey{}).(*mixin.MessageView)
 	user := req.Context.Value(userKey{}).(*mixin.User)
 	conv := req.Context.Value(convKey{}).(*mixin.Conversation)
 
-	mq := &mixin.MessageRequest{
-		ConversationID: msg.ConversationID,
-		MessageID:      uuid.Modify(msg.MessageID, "reply"),
-		Category:       msg.Category,
+	quote := ""
+	if conv.Category == mixin.ConversationCategoryGroup {
+		quote = fmt.Sprintf("> @%s %s\n\n", user.IdentityNumber, req.Content)
 	}
 
-	text := ""
-	if r.Err != nil {
-		text = r.Err.Error()
-	} else {
-		text = r.ConvTurn.Response
+	// markdown replies are sent as posts, which mixin renders
+	category, format := msg.Category, service.FormatPlain
+	if !service.ParseMarkdown(r.Text()).IsPlain() {
+		category, format = mixin.MessageCategoryPlainPost, service.FormatMarkdown
 	}
 
-	b.messageCache.Add(mq.MessageID, &Message{
-		Content: text,
-		UserID:  b.me.UserID,
-	}, cache.DefaultExpiration)
+	for i, text := range r.Parts(format, messageLimit-len(quote), service.ByteLength) {
+		mq := &mixin.MessageRequest{
+			ConversationID: msg.ConversationID,
+			MessageID:      uuid.Modify(msg.MessageID, "reply"),
+			Category:       category,
+		}
+		if i > 0 {
+			mq.MessageID = uuid.Modify(msg.MessageID, fmt.Sprintf("reply-%d", i))
+		}
 
-	if conv.Category == mixin.ConversationCategoryGroup {
-		text = fmt.Sprintf("> @%s %s\n\n%s", user.IdentityNumber, req.Content, text)
+		b.messageCache.Add(mq.MessageID, &Message{
+			Content: text,
+			UserID:  b.me.UserID,
+		}, cache.DefaultExpiration)
+
+		if i == 0 {
+			text = quote + text
+		}
+		mq.Data = base64.StdEncoding.EncodeToString([]byte(text))
+		if err := b.client.SendMessage(req.Context, mq); err != nil {
+			b.logger.WithError(err).Error("send message error")
+			return
+		}
 	}
-	mq.Data = base64.StdEncoding.EncodeToString([]byte(text))
-	if err := b.client.SendMessage(req.Context, mq); err != nil {
-		b.logger.WithError(err).Error("send message error")
+}
+
+// SendTyping marks the message as read, mixin has no typing indicator and the
+// message is only acknowledged after it is handled.
+func (b *Bot) SendTyping(req *service.Message) error {
+	msg := req.Context.Value(messageKey{}).(*mixin.MessageView)
+	return b.client.SendAcknowledgement(req.Context, &mixin.AcknowledgementRequest{
+		MessageID: msg.MessageID,
+		Status:    mixin.MessageStatusRead,
+	})
+}
+
+func (b *Bot) TypingInterval() time.Duration {
+	return 0
+}
+
+// ack acknowledges the message handed off by the blaze loop, mixin delivers
+// it again if the bot stops before that.
+func (b *Bot) ack(msg *mixin.MessageView) {
+	if err := b.client.SendAcknowledgement(context.Background(), &mixin.AcknowledgementRequest{
+		MessageID: msg.MessageID,
+		Status:    mixin.MessageStatusRead,
+	}); err != nil {
+		b.logger.WithError(err).Error("ack message error")
 	}
 }
 
@@ -181,14 +286,7 @@ func (b *Bot) run(ctx context.Context, msg *mixin.MessageView, userID string) er
 		Content: strings.TrimPrefix(content, prefix),
 	}, cache.DefaultExpiration)
 
-	allowed := len(b.cfg.Whitelist) == 0
-	for _, id := range b.cfg.Whitelist {
-		if id == user.IdentityNumber || conv.ConversationID == id {
-			allowed = true
-			break
-		}
-	}
-	if !allowed {
+	if !b.allowed(user.IdentityNumber, conv.ConversationID) {
 		return nil
 	}
 
@@ -217,24 +315,68 @@ func (b *Bot) run(ctx context.Context, msg *mixin.MessageView, userID string) er
 	}
 	content = strings.TrimSpace(strings.TrimPrefix(content, prefix))
 
-	ctx = context.WithValue(ctx, messageKey{}, msg)
-	ctx = context.WithValue(ctx, userKey{}, user)
-	ctx = context.WithValue(ctx, convKey{}, conv)
-
-	doneChan := make(chan struct{})
-	b.msgChan <- &service.Message{
-		Context:      ctx,
+	// the reply is sent with the message context, which must outlive the
+	// blaze loop stopped on shutdown. The view is reused by the blaze loop
+	// for the next message, so it's copied.
+	view := *msg
+	msgCtx := context.WithValue(context.Background(), messageKey{}, &view)
+	msgCtx = context.WithValue(msgCtx, userKey{}, user)
+	msgCtx = context.WithValue(msgCtx, convKey{}, conv)
+
+	select {
+	case b.msgChan <- &service.Message{
+		Context:      msgCtx,
 		UserIdentity: msg.UserID,
 		ConvKey:      conversationKey,
 		ReplyContent: replyContent,
 		Content:      content,
-		DoneChan:     doneChan,
+	}:
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 
-	<-doneChan
+	// the blaze loop goes on with the next message, it's acknowledged by
+	// HandleResult
+	msg.Ack()
 	return nil
 }
 
+func (b *Bot) allowed(identityNumber, convID string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if len(b.cfg.Whitelist) == 0 {
+		return true
+	}
+	for _, id := range b.cfg.Whitelist {
+		if id == identityNumber || id == convID {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload applies the whitelist, a new keystore or cache expiration needs a
+// restart.
+func (b *Bot) Reload(cfg config.AdapterConfig) bool {
+	c, ok := cfg.Config.(*Config)
+	if !ok {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	expiration := c.MessageCacheExpiration
+	if expiration == 0 {
+		expiration = defaultMessageCacheExpiration
+	}
+	if c.Keystore != b.cfg.Keystore || expiration != b.cfg.MessageCacheExpiration {
+		return false
+	}
+	b.cfg.Whitelist = c.Whitelist
+	return true
+}
+
 func (b *Bot) getConversation(ctx context.Context, convID string) (*mixin.Conversation, error) {
 	if conv, ok := b.convMap[convID]; ok {
 		return conv, nil
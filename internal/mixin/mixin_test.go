@@ -0,0 +1,49 @@
+package mixin
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestKeystoreProblems(t *testing.T) {
+	cases := []struct {
+		name     string
+		keystore string
+		want     []string
+	}{
+		{
+			name:     "valid",
+			keystore: base64.StdEncoding.EncodeToString([]byte(`{"client_id":"a","session_id":"b","private_key":"c"}`)),
+		},
+		{
+			name:     "not base64",
+			keystore: "{}",
+			want:     []string{"keystore: keystore is not valid base64: illegal base64 data at input byte 0"},
+		},
+		{
+			name:     "missing keys",
+			keystore: base64.StdEncoding.EncodeToString([]byte(`{"client_id":"a"}`)),
+			want: []string{
+				"keystore: session_id of the keystore is empty",
+				"keystore: private_key of the keystore is empty",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var got []string
+			for _, p := range keystoreProblems(c.keystore) {
+				got = append(got, p.String())
+			}
+			if len(got) != len(c.want) {
+				t.Fatalf("keystoreProblems() = %q, want %q", got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Errorf("keystoreProblems() = %q, want %q", got, c.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,441 @@
+package slack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pandodao/PAL9000/config"
+	"github.com/pandodao/PAL9000/internal/webhook"
+	"github.com/pandodao/PAL9000/service"
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+	"github.com/slack-go/slack/socketmode"
+)
+
+var (
+	_ service.Adapter           = (*Bot)(nil)
+	_ service.StreamingAdapter  = (*Bot)(nil)
+	_ service.ReloadableAdapter = (*Bot)(nil)
+	_ config.ServerConfig       = (*Config)(nil)
+)
+
+const (
+	ModeSocket = "socket"
+	ModeEvents = "events"
+
+	defaultEventsPath = "/slack/events"
+	// slack truncates the text longer than 40000 characters, but it's
+	// suggested to keep it within 4000
+	messageLimit = 4000
+	// how long the bot keeps answering the thread it replied in without
+	// being mentioned
+	threadExpiration = 24 * time.Hour
+	// slack retries the events not answered in 3 seconds for about an hour
+	eventDedupExpiration = time.Hour
+)
+
+// Config receives the messages by Socket Mode, or by the Events API if the
+// app can be reached. The app subscribes to the message.channels,
+// message.groups, message.im and message.mpim events.
+type Config struct {
+	config.GeneralConfig `yaml:",inline"`
+
+	Token string `yaml:"token"` // bot token, xoxb-
+	Mode  string `yaml:"mode"`  // socket or events, defaults to socket
+	// app-level token with connections:write, xapp-, socket mode only
+	AppToken string `yaml:"app_token"`
+	// events mode only, the requests are verified by the signing secret
+	SigningSecret string `yaml:"signing_secret"`
+	Address       string `yaml:"address"` // e.g. :8080
+	Path          string `yaml:"path"`    // defaults to /slack/events
+	// user, channel or workspace ids allowed to talk to the bot
+	Whitelist []string `yaml:"whitelist"`
+	// defaults to https://slack.com/api/, e.g. a local stub for testing
+	APIURL string `yaml:"api_url"`
+}
+
+func (c *Config) ListenAddress() string {
+	if c.Mode != ModeEvents {
+		return ""
+	}
+	return c.Address
+}
+
+func init() {
+	service.RegisterDriver("slack", service.Driver{
+		Config: config.Driver{
+			NewConfig: func() config.DriverConfig {
+				return &Config{Mode: ModeSocket, Path: defaultEventsPath}
+			},
+			Validate: validate,
+		},
+		New: func(ctx context.Context, name string, cfg config.DriverConfig) (service.Adapter, error) {
+			return New(ctx, name, *cfg.(*Config))
+		},
+	})
+}
+
+func validate(cfg config.DriverConfig) []config.Problem {
+	c := cfg.(*Config)
+	var problems []config.Problem
+	required := func(key, value string) {
+		if value == "" {
+			problems = append(problems, config.Problem{Path: key, Message: fmt.Sprintf("%s is required in %s mode", key, c.Mode)})
+		}
+	}
+
+	if c.Token == "" {
+		problems = append(problems, config.Problem{Path: "token", Message: "token is required"})
+	}
+	switch c.Mode {
+	case ModeSocket:
+		required("app_token", c.AppToken)
+	case ModeEvents:
+		required("signing_secret", c.SigningSecret)
+		required("address", c.Address)
+		if !strings.HasPrefix(c.Path, "/") {
+			problems = append(problems, config.Problem{Path: "path", Message: "path must start with /"})
+		}
+	default:
+		problems = append(problems, config.Problem{Path: "mode", Message: "invalid mode: " + c.Mode})
+	}
+	return problems
+}
+
+type messageKey struct{}
+
+// message is where the reply goes
+type message struct {
+	channel  string
+	threadTS string
+}
+
+type Bot struct {
+	name      string
+	api       *slack.Client
+	botUserID string
+	server    *webhook.Server
+	// the threads the bot replied in, by channel:thread_ts
+	threads *cache.Cache
+	events  *cache.Cache
+	logger  logrus.FieldLogger
+
+	mu  sync.RWMutex
+	cfg Config
+}
+
+func New(ctx context.Context, name string, cfg Config) (*Bot, error) {
+	opts := []slack.Option{slack.OptionAppLevelToken(cfg.AppToken)}
+	if cfg.APIURL != "" {
+		opts = append(opts, slack.OptionAPIURL(cfg.APIURL))
+	}
+	api := slack.New(cfg.Token, opts...)
+	auth, err := api.AuthTestContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("slack auth.test error: %w", err)
+	}
+
+	b := &Bot{
+		name:      name,
+		api:       api,
+		botUserID: auth.UserID,
+		threads:   cache.New(threadExpiration, 10*time.Minute),
+		events:    cache.New(eventDedupExpiration, 10*time.Minute),
+		logger:    logrus.WithField("adapter", "slack").WithField("name", name),
+		cfg:       cfg,
+	}
+	if cfg.Mode == ModeEvents {
+		if b.server, err = webhook.Listen(cfg.Address, b.logger); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (b *Bot) GetName() string {
+	return b.name
+}
+
+func (b *Bot) getConfig() Config {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.cfg
+}
+
+// Reload applies the whitelist, signing secret and path, the others need a
+// restart.
+func (b *Bot) Reload(cfg config.AdapterConfig) bool {
+	c, ok := cfg.Config.(*Config)
+	if !ok {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.Token != b.cfg.Token || c.Mode != b.cfg.Mode || c.AppToken != b.cfg.AppToken ||
+		c.Address != b.cfg.Address || c.APIURL != b.cfg.APIURL {
+		return false
+	}
+	b.cfg = *c
+	return true
+}
+
+func (b *Bot) GetMessageChan(ctx context.Context) <-chan *service.Message {
+	msgChan := make(chan *service.Message)
+	if b.server != nil {
+		b.server.Serve(b.eventsHandler(ctx, msgChan))
+		return msgChan
+	}
+
+	client := socketmode.New(b.api)
+	go func() {
+		if err := client.RunContext(ctx); err != nil && ctx.Err() == nil {
+			b.logger.WithError(err).Error("socket mode stopped")
+		}
+	}()
+	go func() {
+		defer close(msgChan)
+		for {
+			select {
+			case evt := <-client.Events:
+				if evt.Type != socketmode.EventTypeEventsAPI {
+					continue
+				}
+				client.Ack(*evt.Request)
+				if e, ok := evt.Data.(slackevents.EventsAPIEvent); ok {
+					b.handleEvent(ctx, msgChan, e)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return msgChan
+}
+
+// Close stops the server of the events mode, the socket mode connection is
+// closed with the context of GetMessageChan.
+func (b *Bot) Close() error {
+	if b.server == nil {
+		return nil
+	}
+	return b.server.Close()
+}
+
+func (b *Bot) eventsHandler(ctx context.Context, msgChan chan<- *service.Message) http.HandlerFunc {
+	// slack expects the response within 3 seconds, the events are handled
+	// after it in order
+	queue := webhook.NewQueue(ctx)
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := b.getConfig()
+		if r.URL.Path != cfg.Path {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := webhook.ReadBody(w, r)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		sv, err := slack.NewSecretsVerifier(r.Header, cfg.SigningSecret)
+		if err != nil {
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+		sv.Write(body)
+		if err := sv.Ensure(); err != nil {
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		e, err := slackevents.ParseEvent(json.RawMessage(body), slackevents.OptionNoVerifyToken())
+		if err != nil {
+			http.Error(w, "Failed to parse event", http.StatusBadRequest)
+			return
+		}
+
+		switch e.Type {
+		case slackevents.URLVerification:
+			var v slackevents.EventsAPIURLVerificationEvent
+			if err := json.Unmarshal(body, &v); err != nil {
+				http.Error(w, "Failed to parse event", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(v.Challenge))
+		case slackevents.CallbackEvent:
+			queue.Push(func() {
+				b.handleEvent(ctx, msgChan, e)
+			})
+		}
+	}
+}
+
+func (b *Bot) handleEvent(ctx context.Context, msgChan chan<- *service.Message, e slackevents.EventsAPIEvent) {
+	m, ok := e.InnerEvent.Data.(*slackevents.MessageEvent)
+	// stop receiving, the client is kept to deliver the results
+	if !ok || ctx.Err() != nil {
+		return
+	}
+	// the retries of the event answered too late
+	if cb, ok := e.Data.(*slackevents.EventsAPICallbackEvent); ok && cb.EventID != "" {
+		if b.events.Add(cb.EventID, true, cache.DefaultExpiration) != nil {
+			return
+		}
+	}
+	// only the messages of the users, not the edits or the bots
+	if m.SubType != "" || m.BotID != "" || m.User == "" || m.User == b.botUserID {
+		return
+	}
+	if !b.allowed(m.User, m.Channel, e.TeamID) {
+		return
+	}
+
+	mention := fmt.Sprintf("<@%s>", b.botUserID)
+	isDM := m.ChannelType == "im"
+	if !isDM && !strings.Contains(m.Text, mention) && !b.inThread(m.Channel, m.ThreadTimeStamp) {
+		return
+	}
+
+	// the replies in the channels start a thread of the message
+	reply := &message{channel: m.Channel, threadTS: m.ThreadTimeStamp}
+	if reply.threadTS == "" && !isDM {
+		reply.threadTS = m.TimeStamp
+	}
+	convKey := m.Channel
+	if reply.threadTS != "" {
+		convKey = m.Channel + ":" + reply.threadTS
+	}
+
+	replyContent := ""
+	if m.ThreadTimeStamp != "" && m.ThreadTimeStamp != m.TimeStamp {
+		replyContent = b.threadParent(ctx, m.Channel, m.ThreadTimeStamp)
+	}
+
+	msg := &service.Message{
+		Context:      context.WithValue(context.Background(), messageKey{}, reply),
+		ReplyContent: replyContent,
+		UserIdentity: m.User,
+		ConvKey:      convKey,
+		Content:      strings.TrimSpace(unescape(strings.ReplaceAll(m.Text, mention, ""))),
+	}
+	select {
+	case msgChan <- msg:
+	case <-ctx.Done():
+	}
+}
+
+func (b *Bot) allowed(userID, channelID, teamID string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if len(b.cfg.Whitelist) == 0 {
+		return true
+	}
+	for _, id := range b.cfg.Whitelist {
+		if id == userID || id == channelID || (teamID != "" && id == teamID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bot) inThread(channel, threadTS string) bool {
+	if threadTS == "" {
+		return false
+	}
+	_, ok := b.threads.Get(channel + ":" + threadTS)
+	return ok
+}
+
+// threadParent returns the text of the first message of the thread, it's
+// empty if failed.
+func (b *Bot) threadParent(ctx context.Context, channel, threadTS string) string {
+	msgs, _, _, err := b.api.GetConversationRepliesContext(ctx, &slack.GetConversationRepliesParameters{
+		ChannelID: channel,
+		Timestamp: threadTS,
+		Limit:     1,
+	})
+	if err != nil || len(msgs) == 0 {
+		if err != nil {
+			b.logger.WithError(err).Error("get thread parent error")
+		}
+		return ""
+	}
+	return unescape(msgs[0].Text)
+}
+
+var unescaper = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&")
+
+// unescape decodes the text escaped by slack.
+func unescape(s string) string {
+	return unescaper.Replace(s)
+}
+
+func (b *Bot) HandleResult(req *service.Message, r *service.Result) {
+	m := req.Context.Value(messageKey{}).(*message)
+	if r.Err != nil && r.IgnoreIfError {
+		// the placeholder must not be left with the half streamed reply
+		if r.StreamMessageID != "" {
+			if _, _, err := b.api.DeleteMessageContext(context.Background(), m.channel, r.StreamMessageID); err != nil {
+				b.logger.WithError(err).Error("delete message error")
+			}
+		}
+		return
+	}
+	parts := r.Parts(service.FormatSlack, messageLimit, service.RuneLength)
+	if r.StreamMessageID != "" {
+		if err := b.update(m, r.StreamMessageID, parts[0]); err != nil {
+			b.logger.WithError(err).Error("update message error")
+		}
+		parts = parts[1:]
+	}
+
+	for _, text := range parts {
+		if _, err := b.post(m, text); err != nil {
+			b.logger.WithError(err).Error("post message error")
+			return
+		}
+	}
+}
+
+func (b *Bot) post(m *message, text string) (string, error) {
+	opts := []slack.MsgOption{slack.MsgOptionText(text, false)}
+	if m.threadTS != "" {
+		opts = append(opts, slack.MsgOptionTS(m.threadTS))
+		b.threads.SetDefault(m.channel+":"+m.threadTS, true)
+	}
+	_, ts, err := b.api.PostMessageContext(context.Background(), m.channel, opts...)
+	return ts, err
+}
+
+func (b *Bot) update(m *message, ts, text string) error {
+	_, _, _, err := b.api.UpdateMessageContext(context.Background(), m.channel, ts, slack.MsgOptionText(text, false))
+	return err
+}
+
+func (b *Bot) SendPlaceholder(req *service.Message, text string) (string, error) {
+	return b.post(req.Context.Value(messageKey{}).(*message), renderPartial(text))
+}
+
+func (b *Bot) EditMessage(req *service.Message, id string, text string) error {
+	return b.update(req.Context.Value(messageKey{}).(*message), id, renderPartial(text))
+}
+
+// renderPartial renders the text streamed so far, only the first part fits
+// into the placeholder.
+func renderPartial(text string) string {
+	return service.FormatText(text, service.FormatSlack, service.RenderOptions{}, messageLimit, service.RuneLength, false)[0]
+}
@@ -0,0 +1,226 @@
+package slack
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pandodao/PAL9000/internal/webhook/webhooktest"
+	"github.com/pandodao/PAL9000/service"
+)
+
+// newStub serves the slack web api methods used by the bot.
+func newStub(t *testing.T) *webhooktest.Stub {
+	ok := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			webhooktest.WriteJSON(w, body)
+		}
+	}
+	return webhooktest.NewStub(t, map[string]http.HandlerFunc{
+		"/auth.test":             ok(`{"ok":true,"user_id":"UBOT","team_id":"T1"}`),
+		"/chat.postMessage":      ok(`{"ok":true,"channel":"C1","ts":"2.0"}`),
+		"/chat.update":           ok(`{"ok":true,"channel":"C1","ts":"2.0"}`),
+		"/chat.delete":           ok(`{"ok":true,"channel":"C1","ts":"2.0"}`),
+		"/conversations.replies": ok(`{"ok":true,"messages":[{"text":"the question &amp; more","ts":"1.0"}]}`),
+	})
+}
+
+// newBot runs the bot of the events mode against the stub.
+func newBot(t *testing.T, stub *webhooktest.Stub) (*Bot, http.Handler, chan *service.Message) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	b, err := New(ctx, "test", Config{
+		Token:         "xoxb-test",
+		Mode:          ModeEvents,
+		SigningSecret: "secret",
+		Address:       "127.0.0.1:0",
+		Path:          defaultEventsPath,
+		APIURL:        stub.URL + "/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	msgChan := make(chan *service.Message)
+	return b, b.eventsHandler(ctx, msgChan), msgChan
+}
+
+func signedRequest(secret, body string) *http.Request {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + ts + ":" + body))
+
+	req := httptest.NewRequest(http.MethodPost, defaultEventsPath, strings.NewReader(body))
+	req.Header.Set("X-Slack-Request-Timestamp", ts)
+	req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+type event struct {
+	id, channelType, user, text, ts, threadTS string
+}
+
+func (e event) String() string {
+	if e.channelType == "" {
+		e.channelType = "channel"
+	}
+	if e.user == "" {
+		e.user = "U1"
+	}
+	if e.ts == "" {
+		e.ts = "1.0"
+	}
+	return `{"type":"event_callback","team_id":"T1","event_id":"` + e.id + `","event":{"type":"message","channel":"C1",` +
+		`"channel_type":"` + e.channelType + `","user":"` + e.user + `","text":"` + e.text + `","ts":"` + e.ts + `",` +
+		`"thread_ts":"` + e.threadTS + `"}}`
+}
+
+func TestSignature(t *testing.T) {
+	_, h, _ := newBot(t, newStub(t))
+
+	cases := []struct {
+		name   string
+		req    *http.Request
+		status int
+		body   string
+	}{
+		{
+			name:   "wrong secret",
+			req:    signedRequest("wrong", `{"type":"url_verification","challenge":"abc"}`),
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "not signed",
+			req:    httptest.NewRequest(http.MethodPost, defaultEventsPath, strings.NewReader(`{"type":"url_verification","challenge":"abc"}`)),
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "challenge",
+			req:    signedRequest("secret", `{"type":"url_verification","challenge":"abc"}`),
+			status: http.StatusOK,
+			body:   "abc",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, c.req)
+			if w.Code != c.status || (c.body != "" && w.Body.String() != c.body) {
+				t.Errorf("status = %d, body = %q", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestMention(t *testing.T) {
+	cases := []struct {
+		name  string
+		event event
+		// the thread the bot replied in
+		thread string
+		// nil if the message is ignored
+		want *service.Message
+	}{
+		{
+			name:  "not mentioned in the channel",
+			event: event{text: "hello"},
+		},
+		{
+			name:  "mentioned",
+			event: event{text: "<@UBOT> a &lt; b?"},
+			want:  &service.Message{Content: "a < b?", ConvKey: "C1:1.0", UserIdentity: "U1"},
+		},
+		{
+			name:  "direct message",
+			event: event{channelType: "im", text: "hello"},
+			want:  &service.Message{Content: "hello", ConvKey: "C1", UserIdentity: "U1"},
+		},
+		{
+			name:  "message of the bot",
+			event: event{channelType: "im", user: "UBOT", text: "hello"},
+		},
+		{
+			name:   "thread replied in",
+			event:  event{text: "and then?", ts: "1.5", threadTS: "1.0"},
+			thread: "C1:1.0",
+			want:   &service.Message{Content: "and then?", ConvKey: "C1:1.0", UserIdentity: "U1", ReplyContent: "the question & more"},
+		},
+	}
+
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b, h, msgChan := newBot(t, newStub(t))
+			if c.thread != "" {
+				b.threads.SetDefault(c.thread, true)
+			}
+
+			c.event.id = "Ev" + strconv.Itoa(i)
+			webhooktest.CheckMessage(t, webhooktest.Receive(t, h, signedRequest("secret", c.event.String()), msgChan), c.want)
+		})
+	}
+}
+
+func TestDedup(t *testing.T) {
+	_, h, msgChan := newBot(t, newStub(t))
+	body := event{id: "Ev1", text: "<@UBOT> hi"}.String()
+
+	webhooktest.MustReceive(t, h, signedRequest("secret", body), msgChan)
+	// the retry of the event answered too late
+	req := signedRequest("secret", body)
+	req.Header.Set("X-Slack-Retry-Num", "1")
+	if msg := webhooktest.Receive(t, h, req, msgChan); msg != nil {
+		t.Errorf("retried event received: %+v", msg)
+	}
+
+	// the retry of an event never received
+	req = signedRequest("secret", event{id: "Ev2", text: "<@UBOT> hi again", ts: "1.1"}.String())
+	req.Header.Set("X-Slack-Retry-Num", "1")
+	if msg := webhooktest.Receive(t, h, req, msgChan); msg == nil {
+		t.Error("retry of a new event not received")
+	}
+}
+
+func TestHandleResult(t *testing.T) {
+	stub := newStub(t)
+	b, h, msgChan := newBot(t, stub)
+	msg := webhooktest.MustReceive(t, h, signedRequest("secret", event{id: "Ev1", text: "<@UBOT> hi"}.String()), msgChan)
+
+	b.HandleResult(msg, webhooktest.Reply("**yes**"))
+	post := stub.Next(t, "/chat.postMessage").Form(t)
+	if post.Get("channel") != "C1" || post.Get("thread_ts") != "1.0" || post.Get("text") != "*yes*" {
+		t.Errorf("post = %v", post)
+	}
+
+	// the placeholder with the half streamed reply is deleted
+	b.HandleResult(msg, &service.Result{Err: errors.New("failed"), IgnoreIfError: true, StreamMessageID: "2.0"})
+	if del := stub.Next(t, "/chat.delete").Form(t); del.Get("channel") != "C1" || del.Get("ts") != "2.0" {
+		t.Errorf("delete = %v", del)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	b := &Bot{cfg: Config{Whitelist: []string{"U1", "C2", "T3"}}}
+	for _, c := range []struct {
+		user, channel, team string
+		want                bool
+	}{
+		{"U1", "C1", "T1", true},
+		{"U2", "C2", "T1", true},
+		{"U2", "C1", "T3", true},
+		{"U2", "C1", "T1", false},
+	} {
+		if got := b.allowed(c.user, c.channel, c.team); got != c.want {
+			t.Errorf("allowed(%s, %s, %s) = %v", c.user, c.channel, c.team, got)
+		}
+	}
+}
@@ -5,25 +5,65 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/pandodao/PAL9000/config"
 	"github.com/pandodao/PAL9000/service"
 )
 
-var _ service.Adapter = (*Bot)(nil)
+var (
+	_ service.Adapter           = (*Bot)(nil)
+	_ service.StreamingAdapter  = (*Bot)(nil)
+	_ service.TypingAdapter     = (*Bot)(nil)
+	_ service.ReloadableAdapter = (*Bot)(nil)
+)
 
 type (
 	messageKey struct{}
 )
 
+// max length of a message in UTF-16 code units
+const messageLimit = 4096
+
+type Config struct {
+	config.GeneralConfig `yaml:",inline"`
+
+	Debug     bool     `yaml:"debug"`
+	Token     string   `yaml:"token"`
+	Whitelist []string `yaml:"whitelist"`
+}
+
 type Bot struct {
 	name   string
-	cfg    config.TelegramConfig
 	client *tgbotapi.BotAPI
+	// stops the long polling, it panics if called twice
+	stopOnce sync.Once
+
+	mu  sync.RWMutex
+	cfg Config
 }
 
-func Init(name string, cfg config.TelegramConfig) (*Bot, error) {
+func init() {
+	service.RegisterDriver("telegram", service.Driver{
+		Config: config.Driver{
+			NewConfig: func() config.DriverConfig { return &Config{} },
+			Validate: func(cfg config.DriverConfig) []config.Problem {
+				return config.Required(map[string]string{"token": cfg.(*Config).Token})
+			},
+		},
+		New: func(ctx context.Context, name string, cfg config.DriverConfig) (service.Adapter, error) {
+			b, err := Init(name, *cfg.(*Config))
+			if err != nil {
+				return nil, err
+			}
+			return b, nil
+		},
+	})
+}
+
+func Init(name string, cfg Config) (*Bot, error) {
 	bot, err := tgbotapi.NewBotAPI(cfg.Token)
 	if err != nil {
 		return nil, err
@@ -46,19 +86,24 @@ func (b *Bot) GetMessageChan(ctx context.Context) <-chan *service.Message {
 	go func() {
 		u := tgbotapi.NewUpdate(0)
 		updates := b.client.GetUpdatesChan(u)
-		for update := range updates {
+		defer close(msgChan)
+		for {
+			var update tgbotapi.Update
+			select {
+			case u, ok := <-updates:
+				if !ok {
+					return
+				}
+				update = u
+			case <-ctx.Done():
+				b.stopReceiving()
+				return
+			}
 			if update.Message == nil || update.Message.Chat == nil || update.Message.Text == "" {
 				continue
 			}
 
-			allowed := len(b.cfg.Whitelist) == 0
-			for _, id := range b.cfg.Whitelist {
-				if strconv.FormatInt(update.Message.Chat.ID, 10) == id || strconv.FormatInt(update.Message.From.ID, 10) == id {
-					allowed = true
-					break
-				}
-			}
-			if !allowed {
+			if !b.allowed(update.Message.Chat.ID, update.Message.From.ID) {
 				continue
 			}
 
@@ -77,39 +122,145 @@ func (b *Bot) GetMessageChan(ctx context.Context) <-chan *service.Message {
 
 			content := strings.TrimSpace(strings.TrimPrefix(update.Message.Text, prefix))
 			messageCtx := context.WithValue(ctx, messageKey{}, update.Message)
-			msgChan <- &service.Message{
+			msg := &service.Message{
 				ReplyContent: replyContent,
 				Context:      messageCtx,
 				Content:      content,
 				UserIdentity: strconv.FormatInt(update.Message.From.ID, 10),
 				ConvKey:      strconv.FormatInt(update.Message.Chat.ID, 10),
 			}
-		}
-		select {
-		case <-ctx.Done():
-			b.client.StopReceivingUpdates()
-			close(msgChan)
-			return
+			select {
+			case msgChan <- msg:
+			case <-ctx.Done():
+			}
 		}
 	}()
 
 	return msgChan
 }
 
+func (b *Bot) stopReceiving() {
+	b.stopOnce.Do(b.client.StopReceivingUpdates)
+}
+
+// Close stops the long polling if it's not stopped yet, the replies are sent
+// by plain requests which need no cleanup.
+func (b *Bot) Close() error {
+	b.stopReceiving()
+	return nil
+}
+
+func (b *Bot) allowed(chatID, userID int64) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if len(b.cfg.Whitelist) == 0 {
+		return true
+	}
+	for _, id := range b.cfg.Whitelist {
+		if strconv.FormatInt(chatID, 10) == id || strconv.FormatInt(userID, 10) == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload applies the whitelist, a new token or debug mode needs a restart.
+func (b *Bot) Reload(cfg config.AdapterConfig) bool {
+	c, ok := cfg.Config.(*Config)
+	if !ok {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.Token != b.cfg.Token || c.Debug != b.cfg.Debug {
+		return false
+	}
+	b.cfg = *c
+	return true
+}
+
 func (b *Bot) HandleResult(req *service.Message, r *service.Result) {
+	msg := req.Context.Value(messageKey{}).(*tgbotapi.Message)
 	if r.Err != nil && r.IgnoreIfError {
+		// the placeholder must not be left with the half streamed reply
+		if r.StreamMessageID != "" {
+			if err := b.deleteMessage(msg.Chat.ID, r.StreamMessageID); err != nil {
+				fmt.Printf("delete placeholder failed: %v\n", err)
+			}
+		}
 		return
 	}
-	text := ""
-	if r.Err != nil {
-		text = r.Err.Error()
-	} else {
-		text = r.ConvTurn.Response
+	parts := r.Parts(service.FormatTelegramHTML, messageLimit, service.UTF16Length)
+	if r.StreamMessageID != "" {
+		if err := b.editMessage(req, r.StreamMessageID, parts[0]); err != nil {
+			fmt.Printf("edit reply failed: %v\n", err)
+		}
+		parts = parts[1:]
 	}
+
+	for _, text := range parts {
+		reply := tgbotapi.NewMessage(msg.Chat.ID, text)
+		reply.ParseMode = tgbotapi.ModeHTML
+		// reply.ReplyToMessageID = msg.MessageID
+		if _, err := b.client.Send(reply); err != nil {
+			fmt.Printf("send reply failed: %v\n", err)
+			return
+		}
+	}
+}
+
+func (b *Bot) SendPlaceholder(req *service.Message, text string) (string, error) {
+	msg := req.Context.Value(messageKey{}).(*tgbotapi.Message)
+	reply := tgbotapi.NewMessage(msg.Chat.ID, renderPartial(text))
+	reply.ParseMode = tgbotapi.ModeHTML
+	sent, err := b.client.Send(reply)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(sent.MessageID), nil
+}
+
+func (b *Bot) EditMessage(req *service.Message, id string, text string) error {
+	return b.editMessage(req, id, renderPartial(text))
+}
+
+// editMessage edits the message with the rendered html.
+func (b *Bot) editMessage(req *service.Message, id string, text string) error {
 	msg := req.Context.Value(messageKey{}).(*tgbotapi.Message)
-	reply := tgbotapi.NewMessage(msg.Chat.ID, text)
-	// reply.ReplyToMessageID = msg.MessageID
-	if _, err := b.client.Send(reply); err != nil {
-		fmt.Printf("send reply failed: %v\n", err)
+	messageID, err := strconv.Atoi(id)
+	if err != nil {
+		return err
+	}
+	edit := tgbotapi.NewEditMessageText(msg.Chat.ID, messageID, text)
+	edit.ParseMode = tgbotapi.ModeHTML
+	_, err = b.client.Send(edit)
+	return err
+}
+
+func (b *Bot) deleteMessage(chatID int64, id string) error {
+	messageID, err := strconv.Atoi(id)
+	if err != nil {
+		return err
 	}
+	_, err = b.client.Request(tgbotapi.NewDeleteMessage(chatID, messageID))
+	return err
+}
+
+// renderPartial renders the text streamed so far, only the first part fits
+// into the placeholder.
+func renderPartial(text string) string {
+	return service.FormatText(text, service.FormatTelegramHTML, service.RenderOptions{}, messageLimit, service.UTF16Length, false)[0]
+}
+
+func (b *Bot) SendTyping(req *service.Message) error {
+	msg := req.Context.Value(messageKey{}).(*tgbotapi.Message)
+	_, err := b.client.Request(tgbotapi.NewChatAction(msg.Chat.ID, tgbotapi.ChatTyping))
+	return err
+}
+
+// TypingInterval refreshes the typing action before it expires after 5 seconds.
+func (b *Bot) TypingInterval() time.Duration {
+	return 4 * time.Second
 }
@@ -0,0 +1,158 @@
+package terminal
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pandodao/PAL9000/service"
+)
+
+const (
+	prompt         = "> "
+	continuePrompt = ". "
+	// a message wrapped in the delimiters can span multiple lines
+	blockDelimiter = `"""`
+)
+
+var _ service.Adapter = (*Bot)(nil)
+
+type Options struct {
+	// BotID and Lang override the ones of the general config if set
+	BotID   uint64
+	Lang    string
+	ConvKey string
+}
+
+// Bot chats through stdin and stdout, it's for trying a config locally.
+type Bot struct {
+	name string
+	opts Options
+	in   io.Reader
+	out  io.Writer
+}
+
+func New(name string, opts Options, in io.Reader, out io.Writer) *Bot {
+	if opts.ConvKey == "" {
+		opts.ConvKey = name
+	}
+
+	return &Bot{
+		name: name,
+		opts: opts,
+		in:   in,
+		out:  out,
+	}
+}
+
+func (b *Bot) GetName() string {
+	return b.name
+}
+
+// Close does nothing, the input and output are owned by the caller.
+func (b *Bot) Close() error {
+	return nil
+}
+
+// GetMessageChan reads the messages from the input one by one, the next one
+// is only read after the reply of the last one is shown. The channel is
+// closed at the end of the input.
+func (b *Bot) GetMessageChan(ctx context.Context) <-chan *service.Message {
+	msgChan := make(chan *service.Message)
+	go func() {
+		defer close(msgChan)
+
+		scanner := bufio.NewScanner(b.in)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		fmt.Fprintf(b.out, "Chatting with conv key %q, end a line with \\ or wrap the text in %s to send multiple lines.\n", b.opts.ConvKey, blockDelimiter)
+
+		for {
+			content, ok := readMessage(scanner, b.out)
+			if !ok {
+				return
+			}
+			if content == "" {
+				continue
+			}
+
+			msg := &service.Message{
+				Context:      ctx,
+				BotID:        b.opts.BotID,
+				Lang:         b.opts.Lang,
+				UserIdentity: b.opts.ConvKey,
+				ConvKey:      b.opts.ConvKey,
+				Content:      content,
+				DoneChan:     make(chan struct{}),
+			}
+
+			select {
+			case msgChan <- msg:
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case <-msg.DoneChan:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return msgChan
+}
+
+// readMessage reads a message from the scanner, a line ending with a
+// backslash continues on the next line, and the lines between two block
+// delimiters are read as is.
+func readMessage(scanner *bufio.Scanner, out io.Writer) (string, bool) {
+	var (
+		lines   []string
+		inBlock bool
+	)
+
+	fmt.Fprint(out, prompt)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.TrimSpace(line) == blockDelimiter:
+			if inBlock {
+				return strings.Join(lines, "\n"), true
+			}
+			inBlock = true
+		case inBlock:
+			lines = append(lines, line)
+		case strings.HasSuffix(line, `\`):
+			lines = append(lines, strings.TrimSuffix(line, `\`))
+		default:
+			lines = append(lines, line)
+			return strings.TrimSpace(strings.Join(lines, "\n")), true
+		}
+		fmt.Fprint(out, continuePrompt)
+	}
+
+	// send what is left at the end of the input
+	if content := strings.TrimSpace(strings.Join(lines, "\n")); content != "" {
+		return content, true
+	}
+	fmt.Fprintln(out)
+	return "", false
+}
+
+// HandleResult prints the reply as is, including the raw error if any since
+// it's only used locally.
+func (b *Bot) HandleResult(req *service.Message, r *service.Result) {
+	defer close(req.DoneChan)
+
+	fmt.Fprintln(b.out, r.Text())
+	if r.Err != nil {
+		fmt.Fprintf(b.out, "(error: %v)\n", r.Err)
+	}
+	if r.Err == nil && r.ConvTurn != nil && r.ConvTurn.ID != 0 {
+		fmt.Fprintf(b.out, "(turn %d, %d request tokens, %d response tokens)\n",
+			r.ConvTurn.ID, r.ConvTurn.RequestToken, r.ConvTurn.ResponseToken)
+	}
+	fmt.Fprintln(b.out)
+}
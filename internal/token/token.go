@@ -0,0 +1,75 @@
+// Package token caches the access tokens of the platform apis, which are
+// fetched by the credentials of the app and expire after a while, e.g. 2
+// hours.
+package token
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// the token is refreshed before it expires
+const refreshMargin = 5 * time.Minute
+
+// FetchFunc fetches a new token and how long it lives.
+type FetchFunc func(ctx context.Context) (token string, lifetime time.Duration, err error)
+
+// Cache keeps the token fetched until it's about to expire.
+type Cache struct {
+	fetch FetchFunc
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func NewCache(fetch FetchFunc) *Cache {
+	return &Cache{fetch: fetch}
+}
+
+// Get returns the cached token, a new one is fetched if it's expired.
+func (c *Cache) Get(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Before(c.expiry) {
+		return c.token, nil
+	}
+
+	token, lifetime, err := c.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.token = token
+	c.expiry = time.Now().Add(lifetime - refreshMargin)
+	return c.token, nil
+}
+
+// Invalidate drops the token if it's still the cached one.
+func (c *Cache) Invalidate(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == token {
+		c.token = ""
+	}
+}
+
+// Do calls the api by fn with the token, it's retried once with a new token
+// if fn reports the cached one is rejected.
+func (c *Cache) Do(ctx context.Context, fn func(token string) (rejected bool, err error)) error {
+	for attempt := 0; ; attempt++ {
+		token, err := c.Get(ctx)
+		if err != nil {
+			return fmt.Errorf("get access token error: %w", err)
+		}
+
+		rejected, err := fn(token)
+		if rejected && attempt == 0 {
+			c.Invalidate(token)
+			continue
+		}
+		return err
+	}
+}
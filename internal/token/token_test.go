@@ -0,0 +1,53 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	fetched := 0
+	c := NewCache(func(ctx context.Context) (string, time.Duration, error) {
+		fetched++
+		return strconv.Itoa(fetched), 2 * time.Hour, nil
+	})
+
+	// the cached token is used until rejected
+	var tokens []string
+	for i := 0; i < 2; i++ {
+		if err := c.Do(context.Background(), func(token string) (bool, error) {
+			tokens = append(tokens, token)
+			return false, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fetched != 1 || tokens[0] != "1" || tokens[1] != "1" {
+		t.Errorf("fetched = %d, tokens = %q", fetched, tokens)
+	}
+
+	// the rejected token is fetched again and retried only once
+	errRejected := errors.New("rejected")
+	tokens = nil
+	err := c.Do(context.Background(), func(token string) (bool, error) {
+		tokens = append(tokens, token)
+		return true, errRejected
+	})
+	if err != errRejected || len(tokens) != 2 || tokens[1] != "2" {
+		t.Errorf("Do() = %v, tokens = %q", err, tokens)
+	}
+
+	// the token about to expire is refreshed
+	c = NewCache(func(ctx context.Context) (string, time.Duration, error) {
+		fetched++
+		return strconv.Itoa(fetched), refreshMargin, nil
+	})
+	first, _ := c.Get(context.Background())
+	second, _ := c.Get(context.Background())
+	if first == second {
+		t.Errorf("expired token %s is reused", first)
+	}
+}
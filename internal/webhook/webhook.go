@@ -0,0 +1,135 @@
+// Package webhook runs the http servers of the adapters receiving the
+// messages by webhooks.
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pandodao/PAL9000/service"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	shutdownTimeout = 5 * time.Second
+	// max bytes of a request body
+	MaxBodySize = 1 << 20
+	// max jobs waiting in a queue
+	queueSize = 256
+)
+
+// Server listens when created so an address in use fails starting the
+// adapter, the requests are served after Serve.
+type Server struct {
+	listener net.Listener
+	server   *http.Server
+	logger   logrus.FieldLogger
+}
+
+func Listen(address string, logger logrus.FieldLogger) (*Server, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("net.Listen error: %w", err)
+	}
+
+	return &Server{
+		listener: l,
+		logger:   logger,
+	}, nil
+}
+
+// Addr returns the address listened on, e.g. the port picked for ":0".
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve serves the requests by handler in the background. The handler
+// matches the paths itself, so they can be reloaded without a restart.
+func (s *Server) Serve(handler http.Handler) {
+	s.server = &http.Server{Handler: handler}
+	go func() {
+		s.logger.WithField("address", s.listener.Addr().String()).Info("http server started")
+		if err := s.server.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+			s.logger.WithError(err).Error("http server stopped")
+		}
+	}()
+}
+
+// Close shuts the server down after the pending responses are written. The
+// adapters send the replies by plain requests, which are not stopped by it.
+func (s *Server) Close() error {
+	if s.server == nil {
+		return s.listener.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("server.Shutdown error: %w", err)
+	}
+	return nil
+}
+
+// ReadBody reads the request body up to MaxBodySize.
+func ReadBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	return io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodySize))
+}
+
+// Queue runs the jobs pushed by a webhook handler one by one in the order
+// they are pushed, so the handler answers the request right away while the
+// messages are still received in order.
+type Queue struct {
+	ctx  context.Context
+	jobs chan func()
+}
+
+// NewQueue runs the jobs until ctx is done.
+func NewQueue(ctx context.Context) *Queue {
+	q := &Queue{
+		ctx:  ctx,
+		jobs: make(chan func(), queueSize),
+	}
+	go func() {
+		for {
+			select {
+			case job := <-q.jobs:
+				if ctx.Err() != nil {
+					return
+				}
+				job()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return q
+}
+
+// Push adds the job, it only blocks while the queue is full. The job is
+// dropped if ctx is done.
+func (q *Queue) Push(job func()) {
+	if q.ctx.Err() != nil {
+		return
+	}
+	select {
+	case q.jobs <- job:
+	case <-q.ctx.Done():
+	}
+}
+
+// Send pushes a job sending the messages to msgChan.
+func (q *Queue) Send(msgChan chan<- *service.Message, msgs ...*service.Message) {
+	q.Push(func() {
+		for _, msg := range msgs {
+			select {
+			case msgChan <- msg:
+			case <-q.ctx.Done():
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,46 @@
+package webhook
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pandodao/PAL9000/service"
+)
+
+func TestQueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q := NewQueue(ctx)
+
+	// the handlers answer before the messages are received
+	msgChan := make(chan *service.Message)
+	for i := 0; i < 3; i++ {
+		done := make(chan struct{})
+		go func(i int) {
+			q.Send(msgChan, &service.Message{Content: strconv.Itoa(2 * i)}, &service.Message{Content: strconv.Itoa(2*i + 1)})
+			close(done)
+		}(i)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Send blocked")
+		}
+	}
+
+	for i := 0; i < 6; i++ {
+		if msg := <-msgChan; msg.Content != strconv.Itoa(i) {
+			t.Fatalf("message %d = %q", i, msg.Content)
+		}
+	}
+
+	// the jobs left are dropped once ctx is done
+	cancel()
+	q.Send(msgChan, &service.Message{Content: "dropped"})
+	select {
+	case msg := <-msgChan:
+		t.Errorf("message received after canceled: %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,175 @@
+// Package webhooktest has the helpers to test the adapters receiving the
+// messages by webhooks, the apis of the platforms are served by a stub.
+package webhooktest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pandodao/PAL9000/service"
+	"github.com/pandodao/botastic-go"
+)
+
+// how long to wait for a message or a call which may never come
+const waitTimeout = 200 * time.Millisecond
+
+// Call is a request received by the stub.
+type Call struct {
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   []byte
+}
+
+// JSON decodes the body as a json object.
+func (c Call) JSON(t *testing.T) map[string]interface{} {
+	t.Helper()
+	var v map[string]interface{}
+	if err := json.Unmarshal(c.Body, &v); err != nil {
+		t.Fatalf("%s: json.Unmarshal error: %v", c.Path, err)
+	}
+	return v
+}
+
+// Form decodes the body as a url encoded form.
+func (c Call) Form(t *testing.T) url.Values {
+	t.Helper()
+	v, err := url.ParseQuery(string(c.Body))
+	if err != nil {
+		t.Fatalf("%s: url.ParseQuery error: %v", c.Path, err)
+	}
+	return v
+}
+
+// Tokens issues the access tokens token-1, token-2 and so on, only the last
+// one is accepted.
+type Tokens struct {
+	mu sync.Mutex
+	n  int
+}
+
+// Issue issues a new token, the ones before it are rejected from now on.
+func (ts *Tokens) Issue() string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.n++
+	return "token-" + strconv.Itoa(ts.n)
+}
+
+// Valid reports whether the token is the last one issued.
+func (ts *Tokens) Valid(token string) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.n > 0 && token == "token-"+strconv.Itoa(ts.n)
+}
+
+// Stub serves the api of a platform, the calls are recorded in order.
+type Stub struct {
+	*httptest.Server
+	calls chan Call
+}
+
+// NewStub serves the routes by the patterns of http.ServeMux, the calls of
+// the other paths fail the test. It's closed when the test finishes.
+func NewStub(t *testing.T, routes map[string]http.HandlerFunc) *Stub {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected call: %s", r.URL.Path)
+		http.NotFound(w, r)
+	})
+	for pattern, h := range routes {
+		mux.HandleFunc(pattern, h)
+	}
+
+	s := &Stub{calls: make(chan Call, 256)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		s.calls <- Call{Path: r.URL.Path, Query: r.URL.Query(), Header: r.Header.Clone(), Body: body}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Next returns the next call of the path, the calls of the other paths
+// before it are skipped.
+func (s *Stub) Next(t *testing.T, path string) Call {
+	t.Helper()
+	for {
+		select {
+		case c := <-s.calls:
+			if c.Path == path {
+				return c
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s not called", path)
+		}
+	}
+}
+
+// Receive serves the request by the webhook handler, it must be answered
+// with 200. The message sent to msgChan is returned, nil if none is sent in
+// a while.
+func Receive(t *testing.T, h http.Handler, r *http.Request, msgChan <-chan *service.Message) *service.Message {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %q", w.Code, w.Body)
+	}
+
+	select {
+	case msg := <-msgChan:
+		return msg
+	case <-time.After(waitTimeout):
+		return nil
+	}
+}
+
+// MustReceive is Receive failing the test if no message is sent.
+func MustReceive(t *testing.T, h http.Handler, r *http.Request, msgChan <-chan *service.Message) *service.Message {
+	t.Helper()
+	msg := Receive(t, h, r, msgChan)
+	if msg == nil {
+		t.Fatal("message not received")
+	}
+	return msg
+}
+
+// CheckMessage compares the message received with the one wanted, nil if
+// the message should be ignored.
+func CheckMessage(t *testing.T, got, want *service.Message) {
+	t.Helper()
+	switch {
+	case want == nil && got != nil:
+		t.Errorf("unexpected message: %+v", got)
+	case want != nil && got == nil:
+		t.Error("message not received")
+	case want != nil && (got.Content != want.Content || got.ConvKey != want.ConvKey ||
+		got.UserIdentity != want.UserIdentity || got.ReplyContent != want.ReplyContent):
+		t.Errorf("message = %+v, want %+v", got, want)
+	}
+}
+
+// WriteJSON writes the json body of a stub response.
+func WriteJSON(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(body))
+}
+
+// Reply is the result of the turn answered by the text.
+func Reply(text string) *service.Result {
+	return &service.Result{
+		ConvTurn: &botastic.ConvTurn{Response: text},
+		Status:   service.TurnStatusSuccess,
+	}
+}
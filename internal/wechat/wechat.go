@@ -2,21 +2,25 @@ package wechat
 
 import (
 	"context"
+	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/xml"
-	"fmt"
-	"io"
-	"log"
 	"net/http"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pandodao/PAL9000/config"
+	"github.com/pandodao/PAL9000/internal/webhook"
 	"github.com/pandodao/PAL9000/service"
+	"github.com/sirupsen/logrus"
 )
 
+// max bytes of the content of a text reply
+const messageLimit = 2048
+
 type httpRequsetKey struct{}
 type httpResponseKey struct{}
 type rawMessageKey struct{}
@@ -31,108 +35,178 @@ type TextMessage struct {
 	MsgId        int64    `xml:"MsgId"`
 }
 
+var (
+	_ service.Adapter           = (*Bot)(nil)
+	_ service.ReloadableAdapter = (*Bot)(nil)
+	_ config.ServerConfig       = (*Config)(nil)
+)
+
+type Config struct {
+	config.GeneralConfig `yaml:",inline"`
+
+	Address string `yaml:"address"`
+	Path    string `yaml:"path"`
+	Token   string `yaml:"token"`
+}
+
+func (c *Config) ListenAddress() string {
+	return c.Address
+}
+
 type Bot struct {
-	name string
-	cfg  config.WeChatConfig
+	name   string
+	server *webhook.Server
+	logger logrus.FieldLogger
+
+	mu  sync.RWMutex
+	cfg Config
 }
 
-func New(name string, cfg config.WeChatConfig) *Bot {
-	return &Bot{
-		name: name,
-		cfg:  cfg,
+func init() {
+	service.RegisterDriver("wechat", service.Driver{
+		Config: config.Driver{
+			NewConfig: func() config.DriverConfig { return &Config{} },
+			Validate:  validate,
+		},
+		New: func(ctx context.Context, name string, cfg config.DriverConfig) (service.Adapter, error) {
+			return New(name, *cfg.(*Config))
+		},
+	})
+}
+
+func validate(cfg config.DriverConfig) []config.Problem {
+	c := cfg.(*Config)
+	var problems []config.Problem
+	if !strings.HasPrefix(c.Path, "/") {
+		problems = append(problems, config.Problem{Path: "path", Message: "path must start with /"})
+	}
+	return append(problems, config.Required(map[string]string{"token": c.Token})...)
+}
+
+func New(name string, cfg Config) (*Bot, error) {
+	logger := logrus.WithField("adapter", "wechat").WithField("name", name)
+	server, err := webhook.Listen(cfg.Address, logger)
+	if err != nil {
+		return nil, err
 	}
+
+	return &Bot{
+		name:   name,
+		server: server,
+		logger: logger,
+		cfg:    cfg,
+	}, nil
 }
 
 func (b *Bot) GetName() string {
 	return b.name
 }
 
+func (b *Bot) getConfig() Config {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.cfg
+}
+
+// Reload applies the path and token, a new address needs a restart.
+func (b *Bot) Reload(cfg config.AdapterConfig) bool {
+	c, ok := cfg.Config.(*Config)
+	if !ok {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.Address != b.cfg.Address {
+		return false
+	}
+	b.cfg = *c
+	return true
+}
+
 func (b *Bot) GetMessageChan(ctx context.Context) <-chan *service.Message {
 	msgChan := make(chan *service.Message)
-	go func() {
-		server := &http.Server{
-			Addr:    b.cfg.Address,
-			Handler: http.DefaultServeMux,
+	b.server.Serve(b.webhookHandler(ctx, msgChan))
+	return msgChan
+}
+
+// Close shuts the server down after the pending replies are written.
+func (b *Bot) Close() error {
+	return b.server.Close()
+}
+
+// validSignature reports whether the signature is of the token, timestamp and
+// nonce.
+func validSignature(token, signature, timestamp, nonce string) bool {
+	params := []string{token, timestamp, nonce}
+	sort.Strings(params)
+
+	hash := sha1.New()
+	hash.Write([]byte(strings.Join(params, "")))
+	return hmac.Equal([]byte(hex.EncodeToString(hash.Sum(nil))), []byte(signature))
+}
+
+func (b *Bot) webhookHandler(ctx context.Context, msgChan chan<- *service.Message) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// stop receiving, the server is kept running to deliver the results
+		if ctx.Err() != nil {
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
 		}
+		cfg := b.getConfig()
+		if r.URL.Path != cfg.Path {
+			http.NotFound(w, r)
+			return
+		}
+
+		r.ParseForm()
+		signature := r.Form.Get("signature")
+		timestamp := r.Form.Get("timestamp")
+		nonce := r.Form.Get("nonce")
+		echostr := r.Form.Get("echostr")
 
-		validateSignature := func(signature, timestamp, nonce string) bool {
-			params := []string{b.cfg.Token, timestamp, nonce}
-			sort.Strings(params)
-			combined := strings.Join(params, "")
+		if !validSignature(cfg.Token, signature, timestamp, nonce) {
+			http.Error(w, "Invalid signature", http.StatusForbidden)
+			return
+		}
 
-			hash := sha1.New()
-			hash.Write([]byte(combined))
-			hashStr := hex.EncodeToString(hash.Sum(nil))
+		if r.Method == "GET" {
+			w.Write([]byte(echostr))
+			return
+		}
 
-			return hashStr == signature
+		body, err := webhook.ReadBody(w, r)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
 		}
 
-		http.HandleFunc(b.cfg.Path, func(w http.ResponseWriter, r *http.Request) {
-			r.ParseForm()
-			signature := r.Form.Get("signature")
-			timestamp := r.Form.Get("timestamp")
-			nonce := r.Form.Get("nonce")
-			echostr := r.Form.Get("echostr")
-
-			if !validateSignature(signature, timestamp, nonce) {
-				http.Error(w, "Invalid signature", http.StatusForbidden)
-				return
-			}
-
-			if r.Method == "GET" {
-				w.Write([]byte(echostr))
-				return
-			}
-
-			body, err := io.ReadAll(r.Body)
-			if err != nil {
-				http.Error(w, "Failed to read request body", http.StatusBadRequest)
-				return
-			}
-			fmt.Println(string(body))
-
-			var receivedMessage TextMessage
-			err = xml.Unmarshal(body, &receivedMessage)
-			if err != nil {
-				http.Error(w, "Failed to parse request body", http.StatusBadRequest)
-				return
-			}
-
-			ctx = r.Context()
-			ctx = context.WithValue(ctx, httpRequsetKey{}, r)
-			ctx = context.WithValue(ctx, httpResponseKey{}, w)
-			ctx = context.WithValue(ctx, rawMessageKey{}, receivedMessage)
-			doneChan := make(chan struct{})
-			msgChan <- &service.Message{
-				Context:      ctx,
-				UserIdentity: receivedMessage.FromUserName,
-				ConvKey:      receivedMessage.FromUserName,
-				Content:      receivedMessage.Content,
-				DoneChan:     doneChan,
-			}
-			<-doneChan
-		})
-
-		go func() {
-			fmt.Printf("wechat HTTP server run at: %s\n", b.cfg.Address)
-			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				log.Fatalf("listen: %s\n", err)
-			}
-		}()
-
-		<-ctx.Done()
-
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		if err := server.Shutdown(ctx); err != nil {
-			log.Printf("Server forced to shutdown: %v\n", err)
-		} else {
-			log.Println("Server gracefully stopped")
+		var receivedMessage TextMessage
+		err = xml.Unmarshal(body, &receivedMessage)
+		if err != nil {
+			http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+			return
 		}
-	}()
 
-	return msgChan
+		msgCtx := r.Context()
+		msgCtx = context.WithValue(msgCtx, httpRequsetKey{}, r)
+		msgCtx = context.WithValue(msgCtx, httpResponseKey{}, w)
+		msgCtx = context.WithValue(msgCtx, rawMessageKey{}, receivedMessage)
+		doneChan := make(chan struct{})
+		select {
+		case msgChan <- &service.Message{
+			Context:      msgCtx,
+			UserIdentity: receivedMessage.FromUserName,
+			ConvKey:      receivedMessage.FromUserName,
+			Content:      receivedMessage.Content,
+			DoneChan:     doneChan,
+		}:
+		case <-ctx.Done():
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		<-doneChan
+	}
 }
 
 func (b *Bot) HandleResult(req *service.Message, r *service.Result) {
@@ -146,12 +220,12 @@ func (b *Bot) HandleResult(req *service.Message, r *service.Result) {
 	}
 	receivedMessage := req.Context.Value(rawMessageKey{}).(TextMessage)
 
-	text := ""
-	if r.Err != nil {
-		text = r.Err.Error()
-	} else {
-		text = r.ConvTurn.Response
+	// the passive reply can only carry one message
+	parts := r.Parts(service.FormatPlain, messageLimit, service.ByteLength)
+	if len(parts) > 1 {
+		b.logger.Warnf("reply is too long, %d parts dropped", len(parts)-1)
 	}
+	text := parts[0]
 
 	responseMessage := TextMessage{
 		ToUserName:   receivedMessage.FromUserName,
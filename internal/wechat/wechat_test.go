@@ -0,0 +1,19 @@
+package wechat
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNewAddressInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the bind failure fails starting the adapter instead of exiting
+	if _, err := New("test", Config{Address: l.Addr().String(), Path: "/wechat"}); err == nil {
+		t.Error("New() should fail on the address in use")
+	}
+}
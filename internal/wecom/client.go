@@ -0,0 +1,146 @@
+package wecom
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pandodao/PAL9000/internal/token"
+)
+
+// the codes of an invalid or expired access token
+var tokenErrorCodes = map[int]bool{40014: true, 42001: true}
+
+// client calls the server apis with the access token.
+type client struct {
+	baseURL string
+	corpID  string
+	secret  string
+	http    *http.Client
+	tokens  *token.Cache
+}
+
+func newClient(baseURL, corpID, secret string) *client {
+	c := &client{
+		baseURL: baseURL,
+		corpID:  corpID,
+		secret:  secret,
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+	c.tokens = token.NewCache(c.accessToken)
+	return c
+}
+
+// Error is the error response of the server apis and the robot webhook.
+type Error struct {
+	Code int    `json:"errcode"`
+	Msg  string `json:"errmsg"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("wecom error %d: %s", e.Code, e.Msg)
+}
+
+func (c *client) accessToken(ctx context.Context) (string, time.Duration, error) {
+	query := url.Values{"corpid": {c.corpID}, "corpsecret": {c.secret}}
+	var resp struct {
+		Error
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"` // seconds
+	}
+	if err := c.do(ctx, http.MethodGet, c.url("/cgi-bin/gettoken", query), nil, &resp); err != nil {
+		return "", 0, err
+	}
+	if resp.Code != 0 {
+		return "", 0, &resp.Error
+	}
+	return resp.AccessToken, time.Duration(resp.ExpiresIn) * time.Second, nil
+}
+
+func (c *client) url(path string, query url.Values) string {
+	return strings.TrimRight(c.baseURL, "/") + path + "?" + query.Encode()
+}
+
+// post posts to the api with the access token.
+func (c *client) post(ctx context.Context, path string, body interface{}) error {
+	return c.tokens.Do(ctx, func(token string) (bool, error) {
+		var resp Error
+		if err := c.do(ctx, http.MethodPost, c.url(path, url.Values{"access_token": {token}}), body, &resp); err != nil {
+			return false, err
+		}
+		if resp.Code != 0 {
+			return tokenErrorCodes[resp.Code], &resp
+		}
+		return false, nil
+	})
+}
+
+func (c *client) do(ctx context.Context, method, u string, body, result interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("wecom %s %s: %s", method, req.URL.Path, resp.Status)
+	}
+	return nil
+}
+
+// sendText sends a text message of the app to the user.
+func (c *client) sendText(ctx context.Context, agentID int64, userID, text string) error {
+	body := map[string]interface{}{
+		"touser":  userID,
+		"msgtype": "text",
+		"agentid": agentID,
+		"text":    map[string]string{"content": text},
+	}
+	return c.post(ctx, "/cgi-bin/message/send", body)
+}
+
+// sendWebhook sends a text message by the webhook of the group robot, the
+// chat id is needed if the robot is in several groups.
+func (c *client) sendWebhook(ctx context.Context, webhookURL, chatID, text string, mentioned []string) error {
+	body := map[string]interface{}{
+		"msgtype": "text",
+		"text":    map[string]interface{}{"content": text, "mentioned_list": mentioned},
+	}
+	if chatID != "" {
+		body["chatid"] = chatID
+	}
+
+	var resp Error
+	if err := c.do(ctx, http.MethodPost, webhookURL, body, &resp); err != nil {
+		return err
+	}
+	if resp.Code != 0 {
+		return &resp
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package wecom
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// the callbacks are padded to 32 bytes rather than the aes block size
+const paddingBlockSize = 32
+
+// crypter verifies and decrypts the callbacks by the msg_signature and the
+// EncodingAESKey.
+type crypter struct {
+	token string
+	key   []byte
+	// the corp id for the app callbacks, it's empty for the robot
+	receiveID string
+}
+
+func newCrypter(token, encodingAESKey, receiveID string) (*crypter, error) {
+	key, err := aesKey(encodingAESKey)
+	if err != nil {
+		return nil, err
+	}
+	return &crypter{token: token, key: key, receiveID: receiveID}, nil
+}
+
+// aesKey decodes the EncodingAESKey, it's the 32-byte key in base64 without
+// the padding.
+func aesKey(encodingAESKey string) ([]byte, error) {
+	if len(encodingAESKey) != 43 {
+		return nil, errors.New("encoding_aes_key must be 43 characters")
+	}
+	key, err := base64.StdEncoding.DecodeString(encodingAESKey + "=")
+	if err != nil {
+		return nil, fmt.Errorf("invalid encoding_aes_key: %w", err)
+	}
+	return key, nil
+}
+
+func (c *crypter) signature(timestamp, nonce, encrypted string) string {
+	params := []string{c.token, timestamp, nonce, encrypted}
+	sort.Strings(params)
+	sum := sha1.Sum([]byte(strings.Join(params, "")))
+	return hex.EncodeToString(sum[:])
+}
+
+// decrypt verifies the signature and decrypts the message, the plain text is
+// 16 random bytes, the length of the message, the message and the receive id.
+func (c *crypter) decrypt(signature, timestamp, nonce, encrypted string) ([]byte, error) {
+	if subtle.ConstantTimeCompare([]byte(c.signature(timestamp, nonce, encrypted)), []byte(signature)) != 1 {
+		return nil, errors.New("invalid signature")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("base64 decode error: %w", err)
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid encrypted data length")
+	}
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, err
+	}
+	cipher.NewCBCDecrypter(block, c.key[:aes.BlockSize]).CryptBlocks(data, data)
+
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > paddingBlockSize || pad > len(data) {
+		return nil, errors.New("invalid padding")
+	}
+	data = data[:len(data)-pad]
+	if len(data) < 20 {
+		return nil, errors.New("invalid message length")
+	}
+	n := int(binary.BigEndian.Uint32(data[16:20]))
+	if n > len(data)-20 {
+		return nil, errors.New("invalid message length")
+	}
+	msg, receiveID := data[20:20+n], string(data[20+n:])
+	if c.receiveID != "" && receiveID != c.receiveID {
+		return nil, fmt.Errorf("unexpected receive id: %s", receiveID)
+	}
+	return msg, nil
+}
@@ -0,0 +1,397 @@
+// Package wecom is the adapter of the wecom driver, it receives the messages
+// of a self-built app by the encrypted callbacks and replies by the
+// message/send api. The group robot receives the messages mentioning it in
+// the group chats and replies by its webhook.
+package wecom
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pandodao/PAL9000/config"
+	"github.com/pandodao/PAL9000/internal/webhook"
+	"github.com/pandodao/PAL9000/service"
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	_ service.Adapter           = (*Bot)(nil)
+	_ service.ReloadableAdapter = (*Bot)(nil)
+	_ config.ServerConfig       = (*Config)(nil)
+)
+
+const (
+	defaultBaseURL   = "https://qyapi.weixin.qq.com"
+	defaultPath      = "/wecom/callback"
+	defaultRobotPath = "/wecom/robot"
+	// max bytes of the content of a text message
+	messageLimit = 2048
+	// wecom retries the callbacks not answered in 5 seconds
+	msgDedupExpiration = time.Hour
+)
+
+// Config is of a self-built app, its callback url is the address and path.
+type Config struct {
+	config.GeneralConfig `yaml:",inline"`
+
+	CorpID  string `yaml:"corp_id"`
+	AgentID int64  `yaml:"agent_id"`
+	Secret  string `yaml:"secret"`
+	// the token and EncodingAESKey of the callback
+	Token          string `yaml:"token"`
+	EncodingAESKey string `yaml:"encoding_aes_key"`
+	Address        string `yaml:"address"` // e.g. :8080
+	Path           string `yaml:"path"`    // defaults to /wecom/callback
+	// the group robot, it's served by the same address
+	Robot *RobotConfig `yaml:"robot"`
+	// user ids or group chat ids allowed to talk to the bot
+	Whitelist []string `yaml:"whitelist"`
+	// defaults to https://qyapi.weixin.qq.com
+	BaseURL string `yaml:"base_url"`
+}
+
+// RobotConfig is of the callback of a group robot.
+type RobotConfig struct {
+	Token          string `yaml:"token"`
+	EncodingAESKey string `yaml:"encoding_aes_key"`
+	Path           string `yaml:"path"` // defaults to /wecom/robot
+}
+
+func (r *RobotConfig) path() string {
+	if r.Path == "" {
+		return defaultRobotPath
+	}
+	return r.Path
+}
+
+func (c *Config) ListenAddress() string {
+	return c.Address
+}
+
+func init() {
+	service.RegisterDriver("wecom", service.Driver{
+		Config: config.Driver{
+			NewConfig: func() config.DriverConfig {
+				return &Config{Path: defaultPath, BaseURL: defaultBaseURL}
+			},
+			Validate: validate,
+		},
+		New: func(ctx context.Context, name string, cfg config.DriverConfig) (service.Adapter, error) {
+			return New(ctx, name, *cfg.(*Config))
+		},
+	})
+}
+
+func validate(cfg config.DriverConfig) []config.Problem {
+	c := cfg.(*Config)
+	problems := config.Required(map[string]string{
+		"corp_id": c.CorpID,
+		"secret":  c.Secret,
+		"address": c.Address,
+	})
+	if c.AgentID == 0 {
+		problems = append(problems, config.Problem{Path: "agent_id", Message: "agent_id is required"})
+	}
+	callback := func(prefix, token, encodingAESKey, path string) {
+		for _, p := range config.Required(map[string]string{"token": token}) {
+			p.Path = prefix + p.Path
+			problems = append(problems, p)
+		}
+		if _, err := aesKey(encodingAESKey); err != nil {
+			problems = append(problems, config.Problem{Path: prefix + "encoding_aes_key", Message: err.Error()})
+		}
+		if !strings.HasPrefix(path, "/") {
+			problems = append(problems, config.Problem{Path: prefix + "path", Message: "path must start with /"})
+		}
+	}
+	callback("", c.Token, c.EncodingAESKey, c.Path)
+	if r := c.Robot; r != nil {
+		callback("robot.", r.Token, r.EncodingAESKey, r.path())
+		if r.path() == c.Path {
+			problems = append(problems, config.Problem{Path: "robot.path", Message: "path is already used by the app"})
+		}
+	}
+	return problems
+}
+
+type replyKey struct{}
+
+// reply is where the reply goes, by the webhook if it's from the robot
+type reply struct {
+	userID     string
+	chatID     string
+	webhookURL string
+}
+
+// the callback body, the message is encrypted
+type envelope struct {
+	Encrypt string `xml:"Encrypt"`
+}
+
+type appMessage struct {
+	FromUserName string `xml:"FromUserName"`
+	MsgType      string `xml:"MsgType"`
+	Content      string `xml:"Content"`
+	MsgID        string `xml:"MsgId"`
+}
+
+type robotMessage struct {
+	WebhookURL string `xml:"WebhookUrl"`
+	ChatID     string `xml:"ChatId"`
+	ChatType   string `xml:"ChatType"` // single or group
+	From       struct {
+		UserID string `xml:"UserId"`
+	} `xml:"From"`
+	MsgType string `xml:"MsgType"`
+	Text    struct {
+		Content string `xml:"Content"`
+	} `xml:"Text"`
+	MsgID string `xml:"MsgId"`
+}
+
+type Bot struct {
+	name   string
+	server *webhook.Server
+	client *client
+	msgs   *cache.Cache
+	logger logrus.FieldLogger
+
+	mu  sync.RWMutex
+	cfg Config
+}
+
+func New(ctx context.Context, name string, cfg Config) (*Bot, error) {
+	c := newClient(cfg.BaseURL, cfg.CorpID, cfg.Secret)
+	if _, err := c.tokens.Get(ctx); err != nil {
+		return nil, fmt.Errorf("get access token error: %w", err)
+	}
+
+	logger := logrus.WithField("adapter", "wecom").WithField("name", name)
+	server, err := webhook.Listen(cfg.Address, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Bot{
+		name:   name,
+		server: server,
+		client: c,
+		msgs:   cache.New(msgDedupExpiration, 10*time.Minute),
+		logger: logger,
+		cfg:    cfg,
+	}, nil
+}
+
+func (b *Bot) GetName() string {
+	return b.name
+}
+
+func (b *Bot) getConfig() Config {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.cfg
+}
+
+// Reload applies the callbacks, agent id and whitelist, a new corp, secret
+// or address needs a restart.
+func (b *Bot) Reload(cfg config.AdapterConfig) bool {
+	c, ok := cfg.Config.(*Config)
+	if !ok {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.CorpID != b.cfg.CorpID || c.Secret != b.cfg.Secret || c.Address != b.cfg.Address || c.BaseURL != b.cfg.BaseURL {
+		return false
+	}
+	b.cfg = *c
+	return true
+}
+
+func (b *Bot) GetMessageChan(ctx context.Context) <-chan *service.Message {
+	msgChan := make(chan *service.Message)
+	b.server.Serve(b.callbackHandler(ctx, msgChan))
+	return msgChan
+}
+
+// Close shuts the server down after the pending callbacks are answered.
+func (b *Bot) Close() error {
+	return b.server.Close()
+}
+
+func (b *Bot) callbackHandler(ctx context.Context, msgChan chan<- *service.Message) http.HandlerFunc {
+	// the callbacks are answered right away, the messages are handed off
+	// after them in order
+	queue := webhook.NewQueue(ctx)
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := b.getConfig()
+		var (
+			c   *crypter
+			err error
+		)
+		switch {
+		case r.URL.Path == cfg.Path:
+			c, err = newCrypter(cfg.Token, cfg.EncodingAESKey, cfg.CorpID)
+		case cfg.Robot != nil && r.URL.Path == cfg.Robot.path():
+			c, err = newCrypter(cfg.Robot.Token, cfg.Robot.EncodingAESKey, "")
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		query := r.URL.Query()
+		signature, timestamp, nonce := query.Get("msg_signature"), query.Get("timestamp"), query.Get("nonce")
+		// the url verification
+		if r.Method == http.MethodGet {
+			echo, err := c.decrypt(signature, timestamp, nonce, query.Get("echostr"))
+			if err != nil {
+				http.Error(w, "Invalid echostr", http.StatusForbidden)
+				return
+			}
+			w.Write(echo)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if ctx.Err() != nil {
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := webhook.ReadBody(w, r)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		var env envelope
+		if err := xml.Unmarshal(body, &env); err != nil {
+			http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+			return
+		}
+		data, err := c.decrypt(signature, timestamp, nonce, env.Encrypt)
+		if err != nil {
+			b.logger.WithError(err).Warn("invalid callback")
+			http.Error(w, "Invalid callback", http.StatusForbidden)
+			return
+		}
+
+		var msg *service.Message
+		if c.receiveID == "" {
+			msg = b.robotMessage(data)
+		} else {
+			msg = b.appMessage(data)
+		}
+		// the reply is sent by the api, the callback is answered empty
+		if msg != nil {
+			queue.Send(msgChan, msg)
+		}
+	}
+}
+
+func (b *Bot) appMessage(data []byte) *service.Message {
+	var m appMessage
+	if err := xml.Unmarshal(data, &m); err != nil {
+		b.logger.WithError(err).Warn("invalid app message")
+		return nil
+	}
+	if m.MsgType != "text" || !b.allowed(m.FromUserName, "") || b.duplicate(m.MsgID) {
+		return nil
+	}
+
+	return &service.Message{
+		Context:      context.WithValue(context.Background(), replyKey{}, reply{userID: m.FromUserName}),
+		UserIdentity: m.FromUserName,
+		ConvKey:      m.FromUserName,
+		Content:      strings.TrimSpace(m.Content),
+	}
+}
+
+func (b *Bot) robotMessage(data []byte) *service.Message {
+	var m robotMessage
+	if err := xml.Unmarshal(data, &m); err != nil {
+		b.logger.WithError(err).Warn("invalid robot message")
+		return nil
+	}
+	if m.MsgType != "text" || !b.allowed(m.From.UserID, m.ChatID) || b.duplicate(m.MsgID) {
+		return nil
+	}
+
+	content := strings.TrimSpace(m.Text.Content)
+	// the robot is only called when it's mentioned in the group, the
+	// mention leads the content
+	if m.ChatType == "group" && strings.HasPrefix(content, "@") {
+		_, content, _ = strings.Cut(content, " ")
+	}
+	convKey := m.ChatID
+	if convKey == "" {
+		convKey = m.From.UserID
+	}
+
+	r := reply{userID: m.From.UserID, chatID: m.ChatID, webhookURL: m.WebhookURL}
+	return &service.Message{
+		Context:      context.WithValue(context.Background(), replyKey{}, r),
+		UserIdentity: m.From.UserID,
+		ConvKey:      convKey,
+		Content:      strings.TrimSpace(content),
+	}
+}
+
+// duplicate reports whether the message is a retry of a received one, the
+// messages without an id are never deduped.
+func (b *Bot) duplicate(msgID string) bool {
+	return msgID != "" && b.msgs.Add(msgID, true, cache.DefaultExpiration) != nil
+}
+
+func (b *Bot) allowed(userID, chatID string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if len(b.cfg.Whitelist) == 0 {
+		return true
+	}
+	for _, id := range b.cfg.Whitelist {
+		if id == userID || (chatID != "" && id == chatID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bot) HandleResult(req *service.Message, r *service.Result) {
+	if r.Err != nil && r.IgnoreIfError {
+		return
+	}
+
+	to := req.Context.Value(replyKey{}).(reply)
+	agentID := b.getConfig().AgentID
+	for i, text := range r.Parts(service.FormatPlain, messageLimit, service.ByteLength) {
+		var err error
+		if to.webhookURL != "" {
+			// mention the user once in the group
+			var mentioned []string
+			if i == 0 && to.chatID != "" {
+				mentioned = []string{to.userID}
+			}
+			err = b.client.sendWebhook(context.Background(), to.webhookURL, to.chatID, text, mentioned)
+		} else {
+			err = b.client.sendText(context.Background(), agentID, to.userID, text)
+		}
+		if err != nil {
+			b.logger.WithError(err).Error("send message error")
+			return
+		}
+	}
+}
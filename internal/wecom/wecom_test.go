@@ -0,0 +1,323 @@
+package wecom
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/pandodao/PAL9000/internal/webhook/webhooktest"
+	"github.com/pandodao/PAL9000/service"
+)
+
+const (
+	appKey   = "abcdefghijklmnopqrstuvwxyz0123456789ABCDEFG"
+	robotKey = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789abcdefg"
+)
+
+// newStub serves the server apis and the robot webhook.
+func newStub(t *testing.T, ts *webhooktest.Tokens) *webhooktest.Stub {
+	return webhooktest.NewStub(t, map[string]http.HandlerFunc{
+		"/cgi-bin/gettoken": func(w http.ResponseWriter, r *http.Request) {
+			webhooktest.WriteJSON(w, `{"errcode":0,"errmsg":"ok","access_token":"`+ts.Issue()+`","expires_in":7200}`)
+		},
+		"/cgi-bin/message/send": func(w http.ResponseWriter, r *http.Request) {
+			if !ts.Valid(r.URL.Query().Get("access_token")) {
+				webhooktest.WriteJSON(w, `{"errcode":40014,"errmsg":"invalid access_token"}`)
+				return
+			}
+			webhooktest.WriteJSON(w, `{"errcode":0,"errmsg":"ok"}`)
+		},
+		"/cgi-bin/webhook/send": func(w http.ResponseWriter, r *http.Request) {
+			webhooktest.WriteJSON(w, `{"errcode":0,"errmsg":"ok"}`)
+		},
+	})
+}
+
+// newBot runs the app and the robot callbacks against the stub.
+func newBot(t *testing.T, stub *webhooktest.Stub) (*Bot, http.Handler, chan *service.Message) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	b, err := New(ctx, "test", Config{
+		CorpID:         "corp",
+		AgentID:        1000002,
+		Secret:         "secret",
+		Token:          "token",
+		EncodingAESKey: appKey,
+		Address:        "127.0.0.1:0",
+		Path:           defaultPath,
+		Robot:          &RobotConfig{Token: "rtoken", EncodingAESKey: robotKey},
+		BaseURL:        stub.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	msgChan := make(chan *service.Message)
+	return b, b.callbackHandler(ctx, msgChan), msgChan
+}
+
+func encrypt(t *testing.T, encodingAESKey, receiveID string, msg []byte) string {
+	key, err := aesKey(encodingAESKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := append(bytes.Repeat([]byte("r"), 16), 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(plain[16:], uint32(len(msg)))
+	plain = append(append(plain, msg...), receiveID...)
+	pad := paddingBlockSize - len(plain)%paddingBlockSize
+	plain = append(plain, bytes.Repeat([]byte{byte(pad)}, pad)...)
+
+	block, _ := aes.NewCipher(key)
+	cipher.NewCBCEncrypter(block, key[:aes.BlockSize]).CryptBlocks(plain, plain)
+	return base64.StdEncoding.EncodeToString(plain)
+}
+
+func signedURL(c *crypter, path, encrypted string, query url.Values) string {
+	query.Set("timestamp", "1700000000")
+	query.Set("nonce", "n1")
+	query.Set("msg_signature", c.signature("1700000000", "n1", encrypted))
+	return path + "?" + query.Encode()
+}
+
+// callback is an app or robot callback of the message signed by the crypter
+// of the target.
+type callback struct {
+	robot bool
+	// the crypter signing it, the one of the target if nil
+	signer *crypter
+	msg    string
+}
+
+func (c callback) request(t *testing.T) *http.Request {
+	path, token, key, receiveID := defaultPath, "token", appKey, "corp"
+	if c.robot {
+		path, token, key, receiveID = defaultRobotPath, "rtoken", robotKey, ""
+	}
+	signer := c.signer
+	if signer == nil {
+		signer, _ = newCrypter(token, key, receiveID)
+	}
+
+	encrypted := encrypt(t, key, receiveID, []byte(c.msg))
+	body := "<xml><ToUserName>corp</ToUserName><Encrypt>" + encrypted + "</Encrypt></xml>"
+	return httptest.NewRequest(http.MethodPost, signedURL(signer, path, encrypted, url.Values{}), strings.NewReader(body))
+}
+
+func appXML(id, msgType, content string) string {
+	return "<xml><FromUserName>zhangsan</FromUserName><MsgType>" + msgType + "</MsgType><Content>" + content +
+		"</Content><MsgId>" + id + "</MsgId></xml>"
+}
+
+func robotXML(webhookURL, chatType, content string) string {
+	chatID := ""
+	if chatType == "group" {
+		chatID = "wrk1"
+	}
+	return "<xml><WebhookUrl>" + webhookURL + "</WebhookUrl><ChatId>" + chatID + "</ChatId><ChatType>" + chatType +
+		"</ChatType><From><UserId>lisi</UserId></From><MsgType>text</MsgType><Text><Content>" + content +
+		"</Content></Text><MsgId>2</MsgId></xml>"
+}
+
+func TestSignature(t *testing.T) {
+	app, _ := newCrypter("token", appKey, "corp")
+	robot, _ := newCrypter("rtoken", robotKey, "")
+	echo := encrypt(t, appKey, "corp", []byte("hello"))
+
+	cases := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{
+			name:   "url verification",
+			req:    httptest.NewRequest(http.MethodGet, signedURL(app, defaultPath, echo, url.Values{"echostr": {echo}}), nil),
+			status: http.StatusOK,
+		},
+		{
+			name:   "url verification signed by the robot",
+			req:    httptest.NewRequest(http.MethodGet, signedURL(robot, defaultPath, echo, url.Values{"echostr": {echo}}), nil),
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "callback signed by the robot",
+			req:    callback{signer: robot, msg: appXML("1", "text", "hi")}.request(t),
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "unknown path",
+			req:    httptest.NewRequest(http.MethodPost, "/other", nil),
+			status: http.StatusNotFound,
+		},
+	}
+
+	_, h, _ := newBot(t, newStub(t, &webhooktest.Tokens{}))
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, c.req)
+			if w.Code != c.status {
+				t.Errorf("status = %d, want %d", w.Code, c.status)
+			}
+			if c.status == http.StatusOK && w.Body.String() != "hello" {
+				t.Errorf("body = %q", w.Body)
+			}
+		})
+	}
+}
+
+func TestMessage(t *testing.T) {
+	cases := []struct {
+		name     string
+		callback callback
+		// nil if the message is ignored
+		want *service.Message
+	}{
+		{
+			name:     "app text",
+			callback: callback{msg: appXML("1", "text", " hi ")},
+			want:     &service.Message{Content: "hi", ConvKey: "zhangsan", UserIdentity: "zhangsan"},
+		},
+		{
+			name:     "app image",
+			callback: callback{msg: appXML("1", "image", "")},
+		},
+		{
+			name:     "robot mentioned in the group",
+			callback: callback{robot: true, msg: robotXML("", "group", "@PAL what's up")},
+			want:     &service.Message{Content: "what's up", ConvKey: "wrk1", UserIdentity: "lisi"},
+		},
+		{
+			name:     "robot in the single chat",
+			callback: callback{robot: true, msg: robotXML("", "single", "@home")},
+			want:     &service.Message{Content: "@home", ConvKey: "lisi", UserIdentity: "lisi"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, h, msgChan := newBot(t, newStub(t, &webhooktest.Tokens{}))
+			webhooktest.CheckMessage(t, webhooktest.Receive(t, h, c.callback.request(t), msgChan), c.want)
+		})
+	}
+}
+
+func TestDedup(t *testing.T) {
+	_, h, msgChan := newBot(t, newStub(t, &webhooktest.Tokens{}))
+
+	msg := appXML("1", "text", "hi")
+	webhooktest.MustReceive(t, h, callback{msg: msg}.request(t), msgChan)
+	if msg := webhooktest.Receive(t, h, callback{msg: msg}.request(t), msgChan); msg != nil {
+		t.Errorf("retried message received: %+v", msg)
+	}
+
+	// the messages without an id are not taken for retries
+	msg = appXML("", "text", "hi")
+	for i := 0; i < 2; i++ {
+		if webhooktest.Receive(t, h, callback{msg: msg}.request(t), msgChan) == nil {
+			t.Errorf("message %d without an id not received", i)
+		}
+	}
+}
+
+func TestHandleResult(t *testing.T) {
+	ts := &webhooktest.Tokens{}
+	stub := newStub(t, ts)
+	b, h, msgChan := newBot(t, stub)
+
+	msg := webhooktest.MustReceive(t, h, callback{msg: appXML("1", "text", "hi")}.request(t), msgChan)
+	send := func() (token, content string) {
+		call := stub.Next(t, "/cgi-bin/message/send")
+		body := call.JSON(t)
+		if body["touser"] != "zhangsan" || body["agentid"] != float64(1000002) {
+			t.Errorf("sent = %v", body)
+		}
+		content, _ = body["text"].(map[string]interface{})["content"].(string)
+		return call.Query.Get("access_token"), content
+	}
+
+	// the token fetched by New is cached
+	for i := 0; i < 2; i++ {
+		b.HandleResult(msg, webhooktest.Reply("**yes**"))
+		if token, content := send(); token != "token-1" || content != "yes" {
+			t.Errorf("sent = %s %q", token, content)
+		}
+	}
+
+	// and fetched again once rejected
+	ts.Issue()
+	b.HandleResult(msg, webhooktest.Reply("again"))
+	for _, want := range []string{"token-1", "token-3"} {
+		if token, content := send(); token != want || content != "again" {
+			t.Errorf("sent = %s %q, want %s", token, content, want)
+		}
+	}
+
+	// the robot replies by the webhook of the message
+	msg = webhooktest.MustReceive(t, h, callback{robot: true, msg: robotXML(stub.URL+"/cgi-bin/webhook/send?key=k", "group", "@PAL hi")}.request(t), msgChan)
+	b.HandleResult(msg, webhooktest.Reply("fine"))
+	body := stub.Next(t, "/cgi-bin/webhook/send").JSON(t)
+	text := body["text"].(map[string]interface{})
+	if body["chatid"] != "wrk1" || text["content"] != "fine" || len(text["mentioned_list"].([]interface{})) != 1 {
+		t.Errorf("sent = %v", body)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := func(robot *RobotConfig) *Config {
+		return &Config{CorpID: "corp", AgentID: 1, Secret: "secret", Token: "token", EncodingAESKey: appKey,
+			Address: ":8080", Path: defaultPath, Robot: robot}
+	}
+	cases := []struct {
+		name string
+		cfg  *Config
+		want []string
+	}{
+		{name: "app", cfg: cfg(nil)},
+		{name: "robot", cfg: cfg(&RobotConfig{Token: "rtoken", EncodingAESKey: robotKey})},
+		{
+			name: "robot token missing",
+			cfg:  cfg(&RobotConfig{EncodingAESKey: robotKey}),
+			want: []string{"robot.token: token is required"},
+		},
+		{
+			name: "robot path of the app",
+			cfg:  cfg(&RobotConfig{Token: "rtoken", EncodingAESKey: robotKey, Path: defaultPath}),
+			want: []string{"robot.path: path is already used by the app"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var got []string
+			for _, p := range validate(c.cfg) {
+				got = append(got, p.String())
+			}
+			if strings.Join(got, "\n") != strings.Join(c.want, "\n") {
+				t.Errorf("validate() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	c, err := newCrypter("token", appKey, "corp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := encrypt(t, appKey, "other", []byte("hello"))
+	if _, err := c.decrypt(c.signature("1", "2", encrypted), "1", "2", encrypted); err == nil {
+		t.Error("decrypted the message of another corp")
+	}
+	if _, err := newCrypter("token", "short", ""); err == nil {
+		t.Error("invalid encoding_aes_key accepted")
+	}
+}
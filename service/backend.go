@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pandodao/PAL9000/config"
+	"github.com/pandodao/botastic-go"
+)
+
+// Backend is the LLM service the handler talks to. The botastic types are
+// used as the common data model, backends other than botastic fill in the
+// fields they know about.
+type Backend interface {
+	CreateConversation(ctx context.Context, req botastic.CreateConversationRequest) (*botastic.Conversation, error)
+	// PostMessage adds a turn to the conversation, the returned turn may be
+	// still pending. Backends may update conv, it is saved to the store after
+	// the turn is done.
+	PostMessage(ctx context.Context, conv *botastic.Conversation, content string) (*botastic.ConvTurn, error)
+	// GetReply returns the turn, blocks until it is processed if block is true.
+	GetReply(ctx context.Context, conv *botastic.Conversation, turnID uint64, block bool) (*botastic.ConvTurn, error)
+}
+
+// StatusError is returned by the http based backends for non 2xx responses.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status code: %d, body: %s", e.StatusCode, e.Body)
+}
+
+func newBackend(cfg config.GeneralConfig) Backend {
+	if cfg.Backend != nil && cfg.Backend.Driver == "openai" {
+		return newOpenAIBackend(*cfg.Backend.OpenAI)
+	}
+
+	return newBotasticBackend(cfg.Botastic)
+}
+
+type botasticBackend struct {
+	client *botastic.Client
+}
+
+func newBotasticBackend(cfg *config.BotasticConfig) *botasticBackend {
+	if cfg == nil {
+		cfg = &config.BotasticConfig{}
+	}
+
+	return &botasticBackend{
+		client: botastic.New(cfg.AppId, "", botastic.WithDebug(cfg.Debug), botastic.WithHost(cfg.Host)),
+	}
+}
+
+func (b *botasticBackend) CreateConversation(ctx context.Context, req botastic.CreateConversationRequest) (*botastic.Conversation, error) {
+	return b.client.CreateConversation(ctx, req)
+}
+
+func (b *botasticBackend) PostMessage(ctx context.Context, conv *botastic.Conversation, content string) (*botastic.ConvTurn, error) {
+	return b.client.PostToConversation(ctx, botastic.PostToConversationPayloadRequest{
+		ConversationID: conv.ID,
+		Content:        content,
+		Category:       "plain-text",
+	})
+}
+
+func (b *botasticBackend) GetReply(ctx context.Context, conv *botastic.Conversation, turnID uint64, block bool) (*botastic.ConvTurn, error) {
+	return b.client.GetConvTurn(ctx, conv.ID, turnID, block)
+}
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// LengthFunc measures a text the way a platform counts its message length.
+type LengthFunc func(s string) int
+
+var (
+	RuneLength LengthFunc = utf8.RuneCountInString
+	ByteLength LengthFunc = func(s string) int { return len(s) }
+	// UTF16Length counts UTF-16 code units, which is how telegram counts.
+	UTF16Length LengthFunc = func(s string) int { return len(utf16.Encode([]rune(s))) }
+)
+
+// max length of the "(i/n)" marker appended to each part
+const partMarkerReserve = len("\n(999/999)")
+
+var sentenceRegex = regexp.MustCompile(`[^.!?。！？；;]+[.!?。！？；;]+["'”’)）]*\s*`)
+
+// SplitText splits text into parts no longer than limit measured by length.
+// It splits on paragraphs first, then lines, sentences, words and runes, a
+// code block is kept in one part if possible, otherwise every part of it is
+// wrapped in its own fences. If numbered is true and there are more than one
+// part, a "(i/n)" marker is appended to each part.
+func SplitText(text string, limit int, length LengthFunc, numbered bool) []string {
+	if limit <= 0 || length(text) <= limit {
+		return []string{text}
+	}
+
+	if numbered && limit > partMarkerReserve*2 {
+		limit -= partMarkerReserve
+	}
+
+	var parts []string
+	for _, part := range packPieces(splitBlocks(text), "\n\n", limit, length, func(block string) []string {
+		return splitBlock(block, limit, length)
+	}) {
+		if part = strings.TrimRight(strings.TrimLeft(part, "\n"), " \t\n"); part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	if numbered && len(parts) > 1 {
+		for i := range parts {
+			parts[i] += fmt.Sprintf("\n(%d/%d)", i+1, len(parts))
+		}
+	}
+	return parts
+}
+
+// packPieces joins the pieces with sep greedily into parts within limit, the
+// pieces longer than limit are split by splitPiece.
+func packPieces(pieces []string, sep string, limit int, length LengthFunc, splitPiece func(string) []string) []string {
+	var (
+		parts []string
+		cur   string
+	)
+	for _, p := range pieces {
+		if length(p) > limit {
+			if cur != "" {
+				parts = append(parts, cur)
+				cur = ""
+			}
+			parts = append(parts, splitPiece(p)...)
+			continue
+		}
+
+		switch {
+		case cur == "":
+			cur = p
+		case length(cur+sep+p) <= limit:
+			cur += sep + p
+		default:
+			parts = append(parts, cur)
+			cur = p
+		}
+	}
+	if cur != "" {
+		parts = append(parts, cur)
+	}
+	return parts
+}
+
+// splitBlocks splits text into paragraphs and fenced code blocks.
+func splitBlocks(text string) []string {
+	var (
+		blocks []string
+		cur    []string
+		fence  string
+	)
+	flush := func() {
+		if len(cur) > 0 {
+			blocks = append(blocks, strings.Join(cur, "\n"))
+			cur = nil
+		}
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case fence != "":
+			cur = append(cur, line)
+			if closesFence(trimmed, fence) {
+				fence = ""
+				flush()
+			}
+		case codeFence(trimmed) != "":
+			flush()
+			fence = codeFence(trimmed)
+			cur = append(cur, line)
+		case trimmed == "":
+			flush()
+		default:
+			cur = append(cur, line)
+		}
+	}
+	flush()
+	return blocks
+}
+
+func splitBlock(block string, limit int, length LengthFunc) []string {
+	trimmed := strings.TrimSpace(block)
+	if codeFence(trimmed) != "" {
+		return splitCodeBlock(trimmed, limit, length)
+	}
+
+	return packPieces(strings.Split(block, "\n"), "\n", limit, length, func(line string) []string {
+		return splitLine(line, limit, length)
+	})
+}
+
+// splitCodeBlock splits a fenced code block by lines and wraps every part in
+// the fences, so each part is still a valid code block.
+func splitCodeBlock(block string, limit int, length LengthFunc) []string {
+	lines := strings.Split(block, "\n")
+	header := lines[0]
+	closing := codeFence(header)
+	body := lines[1:]
+	if len(body) > 0 && closesFence(strings.TrimSpace(body[len(body)-1]), closing) {
+		body = body[:len(body)-1]
+	}
+
+	opening, ending := header+"\n", "\n"+closing
+	available := limit - length(opening) - length(ending)
+	if available <= 0 {
+		return splitRunes(block, limit, length)
+	}
+
+	parts := packPieces(body, "\n", available, length, func(line string) []string {
+		return splitRunes(line, available, length)
+	})
+	for i, p := range parts {
+		parts[i] = opening + p + ending
+	}
+	return parts
+}
+
+// codeFence returns the run of backticks or tildes opening a fenced code
+// block, it's empty if the line doesn't open one.
+func codeFence(line string) string {
+	if !strings.HasPrefix(line, "```") && !strings.HasPrefix(line, "~~~") {
+		return ""
+	}
+	n := len(line) - len(strings.TrimLeft(line, line[:1]))
+	return line[:n]
+}
+
+// closesFence reports whether the line closes the code block opened by the
+// fence, the closing fence is at least as long as it.
+func closesFence(line, fence string) bool {
+	return len(line) >= len(fence) && strings.Trim(line, fence[:1]) == ""
+}
+
+func splitLine(line string, limit int, length LengthFunc) []string {
+	var (
+		sentences []string
+		last      int
+	)
+	for _, loc := range sentenceRegex.FindAllStringIndex(line, -1) {
+		sentences = append(sentences, line[last:loc[1]])
+		last = loc[1]
+	}
+	if last < len(line) {
+		sentences = append(sentences, line[last:])
+	}
+
+	return packPieces(sentences, "", limit, length, func(sentence string) []string {
+		words := strings.SplitAfter(sentence, " ")
+		return packPieces(words, "", limit, length, func(word string) []string {
+			return splitRunes(word, limit, length)
+		})
+	})
+}
+
+// splitRunes is the last resort, it splits s on rune boundaries.
+func splitRunes(s string, limit int, length LengthFunc) []string {
+	var (
+		parts  []string
+		cur    strings.Builder
+		curLen int
+	)
+	for _, r := range s {
+		n := length(string(r))
+		if cur.Len() > 0 && curLen+n > limit {
+			parts = append(parts, cur.String())
+			cur.Reset()
+			curLen = 0
+		}
+		cur.WriteRune(r)
+		curLen += n
+	}
+	if cur.Len() > 0 {
+		parts = append(parts, cur.String())
+	}
+	return parts
+}
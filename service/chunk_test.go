@@ -0,0 +1,86 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitText(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		limit    int
+		numbered bool
+		want     []string
+	}{
+		{
+			name:  "short text is kept",
+			input: "hello world",
+			limit: 20,
+			want:  []string{"hello world"},
+		},
+		{
+			name:  "paragraphs",
+			input: "first paragraph\n\nsecond paragraph\n\nthird",
+			limit: 35,
+			want:  []string{"first paragraph\n\nsecond paragraph", "third"},
+		},
+		{
+			name:  "sentences",
+			input: "One sentence. Another sentence! The last one?",
+			limit: 30,
+			want:  []string{"One sentence.", "Another sentence!", "The last one?"},
+		},
+		{
+			name:  "code block is kept in one part",
+			input: "intro\n\n```go\nfmt.Println(1)\n```\n\noutro",
+			limit: 30,
+			want:  []string{"intro", "```go\nfmt.Println(1)\n```", "outro"},
+		},
+		{
+			name:  "long code block is fenced per part",
+			input: "```go\nline1()\nline2()\nline3()\n```",
+			limit: 25,
+			want:  []string{"```go\nline1()\nline2()\n```", "```go\nline3()\n```"},
+		},
+		{
+			name:  "longer fence is kept per part",
+			input: "````md\n```\nx\n```\n````",
+			limit: 20,
+			want:  []string{"````md\n```\nx\n````", "````md\n```\n````"},
+		},
+		{
+			name:     "numbered",
+			input:    strings.Repeat("a", 30) + "\n\n" + strings.Repeat("b", 30),
+			limit:    45,
+			numbered: true,
+			want:     []string{strings.Repeat("a", 30) + "\n(1/2)", strings.Repeat("b", 30) + "\n(2/2)"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := SplitText(c.input, c.limit, RuneLength, c.numbered)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("SplitText() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSplitTextRuneBoundaries(t *testing.T) {
+	input := strings.Repeat("这是一段没有标点的很长的中文", 20)
+	for _, length := range []LengthFunc{ByteLength, RuneLength, UTF16Length} {
+		parts := SplitText(input, 50, length, false)
+		if strings.Join(parts, "") != input {
+			t.Fatal("parts should add up to the input")
+		}
+		for _, p := range parts {
+			if !utf8.ValidString(p) || length(p) > 50 {
+				t.Fatalf("invalid part %q, length %d", p, length(p))
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pandodao/PAL9000/store"
+)
+
+// CommandFunc handles a chat command, args are the words following the
+// command name. The returned text is replied to the user.
+type CommandFunc func(ctx context.Context, h *Handler, m *Message, args []string) (string, error)
+
+type Command struct {
+	Name        string // without the leading slash
+	Usage       string // e.g. "/lang <code>", defaults to "/<name>"
+	Description string
+	Func        CommandFunc
+}
+
+// CommandProvider is implemented by adapters that bring their own commands,
+// they are registered when the handler is created.
+type CommandProvider interface {
+	Commands() []Command
+}
+
+type commandRouter struct {
+	mu       sync.RWMutex
+	commands map[string]Command
+	names    []string
+}
+
+func newCommandRouter() *commandRouter {
+	return &commandRouter{
+		commands: make(map[string]Command),
+	}
+}
+
+func (r *commandRouter) register(cmd Command) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name := strings.ToLower(cmd.Name)
+	if cmd.Usage == "" {
+		cmd.Usage = "/" + name
+	}
+	if _, ok := r.commands[name]; !ok {
+		r.names = append(r.names, name)
+	}
+	r.commands[name] = cmd
+}
+
+// match returns the command the content invokes, "/cmd@botname" is accepted
+// for group chats of telegram.
+func (r *commandRouter) match(content string) (Command, []string, bool) {
+	fields := strings.Fields(content)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return Command{}, nil, false
+	}
+
+	name := strings.TrimPrefix(fields[0], "/")
+	if idx := strings.Index(name, "@"); idx >= 0 {
+		name = name[:idx]
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cmd, ok := r.commands[strings.ToLower(name)]
+	return cmd, fields[1:], ok
+}
+
+func (r *commandRouter) help() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	lines := make([]string, 0, len(r.names))
+	for _, name := range r.names {
+		cmd := r.commands[name]
+		lines = append(lines, fmt.Sprintf("%s - %s", cmd.Usage, cmd.Description))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// RegisterCommand adds a chat command, a command with the same name replaces
+// the existing one, including the built-ins.
+func (h *Handler) RegisterCommand(cmd Command) {
+	h.commands.register(cmd)
+}
+
+func (h *Handler) registerBuiltinCommands() {
+	h.RegisterCommand(Command{
+		Name:        "help",
+		Description: "list the available commands",
+		Func: func(ctx context.Context, h *Handler, m *Message, args []string) (string, error) {
+			return h.commands.help(), nil
+		},
+	})
+	h.RegisterCommand(Command{
+		Name:        "reset",
+		Description: "start a new conversation",
+		Func: func(ctx context.Context, h *Handler, m *Message, args []string) (string, error) {
+			if err := h.ResetConversation(m.ConvKey); err != nil {
+				return "", err
+			}
+			return "The conversation has been reset.", nil
+		},
+	})
+	h.RegisterCommand(Command{
+		Name:        "lang",
+		Usage:       "/lang <code>",
+		Description: "switch the language of the bot, e.g. /lang zh",
+		Func: func(ctx context.Context, h *Handler, m *Message, args []string) (string, error) {
+			if len(args) != 1 {
+				return "Usage: /lang <code>", nil
+			}
+
+			if err := h.updatePrefs(m.ConvKey, func(p *store.Prefs) { p.Lang = args[0] }); err != nil {
+				return "", err
+			}
+			if err := h.ResetConversation(m.ConvKey); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("Language switched to %s.", args[0]), nil
+		},
+	})
+	h.RegisterCommand(Command{
+		Name:        "bot",
+		Usage:       "/bot <id>",
+		Description: "switch to another bot, e.g. /bot 3",
+		Func: func(ctx context.Context, h *Handler, m *Message, args []string) (string, error) {
+			if len(args) != 1 {
+				return "Usage: /bot <id>", nil
+			}
+			botID, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil || botID == 0 {
+				return "Usage: /bot <id>", nil
+			}
+
+			if err := h.updatePrefs(m.ConvKey, func(p *store.Prefs) { p.BotID = botID }); err != nil {
+				return "", err
+			}
+			if err := h.ResetConversation(m.ConvKey); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("Bot switched to %d.", botID), nil
+		},
+	})
+}
+
+// updatePrefs changes the prefs of the conversation key, they are kept in
+// the store along with the conversation.
+func (h *Handler) updatePrefs(convKey string, fn func(p *store.Prefs)) error {
+	p, err := h.store.GetPrefs(convKey)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		p = &store.Prefs{}
+	}
+	fn(p)
+	return h.store.SetPrefs(convKey, *p, h.idleTimeout())
+}
+
+func (h *Handler) applyPrefs(m *Message) {
+	p, err := h.store.GetPrefs(m.ConvKey)
+	if err != nil {
+		h.logger.WithError(err).Error("get prefs error")
+		return
+	}
+	if p == nil {
+		return
+	}
+
+	if p.BotID != 0 {
+		m.BotID = p.BotID
+	}
+	if p.Lang != "" {
+		m.Lang = p.Lang
+	}
+}
@@ -0,0 +1,35 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCommandRouterMatch(t *testing.T) {
+	r := newCommandRouter()
+	r.register(Command{Name: "lang"})
+
+	cases := []struct {
+		content string
+		ok      bool
+		args    []string
+	}{
+		{content: "/lang zh", ok: true, args: []string{"zh"}},
+		{content: "/LANG@pal9000_bot  en ", ok: true, args: []string{"en"}},
+		{content: "/unknown", ok: false},
+		{content: "what is /lang", ok: false},
+		{content: "", ok: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.content, func(t *testing.T) {
+			cmd, args, ok := r.match(c.content)
+			if ok != c.ok {
+				t.Fatalf("match(%q) ok = %v, want %v", c.content, ok, c.ok)
+			}
+			if ok && (cmd.Name != "lang" || !reflect.DeepEqual(args, c.args)) {
+				t.Errorf("match(%q) = %s %v, want lang %v", c.content, cmd.Name, args, c.args)
+			}
+		})
+	}
+}
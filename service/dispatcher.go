@@ -0,0 +1,84 @@
+package service
+
+import "sync"
+
+const defaultConcurrency = 10
+
+// dispatcher runs jobs of different keys in parallel, bounded by the
+// concurrency limit, while jobs sharing the same key run one by one in the
+// order they were dispatched.
+type dispatcher struct {
+	wg sync.WaitGroup
+
+	mu     sync.Mutex
+	sem    chan struct{}
+	queues map[string][]func()
+}
+
+func newDispatcher(concurrency int) *dispatcher {
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	return &dispatcher{
+		sem:    make(chan struct{}, concurrency),
+		queues: make(map[string][]func()),
+	}
+}
+
+func (d *dispatcher) dispatch(key string, job func()) {
+	d.wg.Add(1)
+
+	d.mu.Lock()
+	if q, ok := d.queues[key]; ok {
+		// a worker is already running for this key, it will pick the job up
+		d.queues[key] = append(q, job)
+		d.mu.Unlock()
+		return
+	}
+	d.queues[key] = nil
+	d.mu.Unlock()
+
+	go d.run(key, job)
+}
+
+func (d *dispatcher) run(key string, job func()) {
+	for {
+		// release the same semaphore even if it's replaced meanwhile
+		d.mu.Lock()
+		sem := d.sem
+		d.mu.Unlock()
+
+		sem <- struct{}{}
+		job()
+		<-sem
+		d.wg.Done()
+
+		d.mu.Lock()
+		q := d.queues[key]
+		if len(q) == 0 {
+			delete(d.queues, key)
+			d.mu.Unlock()
+			return
+		}
+		job, d.queues[key] = q[0], q[1:]
+		d.mu.Unlock()
+	}
+}
+
+// setConcurrency changes the concurrency limit, the running jobs are not
+// counted by the new limit.
+func (d *dispatcher) setConcurrency(concurrency int) {
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	d.mu.Lock()
+	d.sem = make(chan struct{}, concurrency)
+	d.mu.Unlock()
+}
+
+// wait blocks until all dispatched jobs are done.
+func (d *dispatcher) wait() {
+	d.wg.Wait()
+}
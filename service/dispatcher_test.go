@@ -0,0 +1,61 @@
+package service
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatcherKeepsOrderPerKey(t *testing.T) {
+	d := newDispatcher(4)
+
+	var mu sync.Mutex
+	got := map[string][]int{}
+	for i := 0; i < 50; i++ {
+		i := i
+		for _, key := range []string{"a", "b", "c"} {
+			key := key
+			d.dispatch(key, func() {
+				mu.Lock()
+				got[key] = append(got[key], i)
+				mu.Unlock()
+			})
+		}
+	}
+	d.wait()
+
+	for key, seq := range got {
+		if len(seq) != 50 {
+			t.Fatalf("key %s: got %d jobs, want 50", key, len(seq))
+		}
+		for i, v := range seq {
+			if v != i {
+				t.Fatalf("key %s: job %d ran at position %d", key, v, i)
+			}
+		}
+	}
+}
+
+func TestDispatcherRunsKeysInParallel(t *testing.T) {
+	d := newDispatcher(2)
+
+	release := make(chan struct{})
+	started := make(chan string, 2)
+	for _, key := range []string{"a", "b"} {
+		key := key
+		d.dispatch(key, func() {
+			started <- key
+			<-release
+		})
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("jobs of different keys should run in parallel")
+		}
+	}
+	close(release)
+	d.wait()
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/pandodao/PAL9000/config"
+)
+
+// AdapterFactory creates the adapter of the driver config decoded by the
+// registered config driver, ctx is canceled when the adapter is stopped.
+type AdapterFactory func(ctx context.Context, name string, cfg config.DriverConfig) (Adapter, error)
+
+// Driver is an adapter driver, the packages of the adapters register it in
+// init so a driver is added by importing its package.
+type Driver struct {
+	// Config decodes and checks the section of the driver.
+	Config config.Driver
+	New    AdapterFactory
+}
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]AdapterFactory)
+)
+
+// RegisterDriver makes the adapter driver available by the name, it panics
+// if called twice for the same name.
+func RegisterDriver(name string, d Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	if d.New == nil {
+		panic("service: RegisterDriver factory is nil")
+	}
+	if _, dup := drivers[name]; dup {
+		panic("service: RegisterDriver called twice for driver " + name)
+	}
+	config.RegisterDriver(name, d.Config)
+	drivers[name] = d.New
+}
+
+// NewAdapter creates the adapter by the registered driver.
+func NewAdapter(ctx context.Context, name string, cfg config.AdapterConfig) (Adapter, error) {
+	driversMu.RLock()
+	factory, ok := drivers[cfg.Driver]
+	driversMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("invalid driver: %s", cfg.Driver)
+	}
+	if cfg.Config == nil {
+		return nil, fmt.Errorf("%s config not found", cfg.Driver)
+	}
+	return factory(ctx, name, cfg.Config)
+}
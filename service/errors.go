@@ -0,0 +1,204 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/pandodao/botastic-go"
+)
+
+// ErrorKind classifies the errors of handling a message, adapters show a
+// user facing message per kind instead of the raw error.
+type ErrorKind string
+
+const (
+	ErrorKindUnknown             ErrorKind = "unknown"
+	ErrorKindUpstreamUnavailable ErrorKind = "upstream_unavailable"
+	ErrorKindRateLimited         ErrorKind = "rate_limited"
+	ErrorKindTimeout             ErrorKind = "timeout"
+	ErrorKindNotAllowed          ErrorKind = "not_allowed"
+	ErrorKindInvalidInput        ErrorKind = "invalid_input"
+)
+
+// Error is an error of a known kind, the sentinel errors below match any
+// error of the same kind with errors.Is.
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+var (
+	ErrUpstreamUnavailable = &Error{Kind: ErrorKindUpstreamUnavailable}
+	ErrRateLimited         = &Error{Kind: ErrorKindRateLimited}
+	ErrTimeout             = &Error{Kind: ErrorKindTimeout}
+	ErrNotAllowed          = &Error{Kind: ErrorKindNotAllowed}
+	ErrInvalidInput        = &Error{Kind: ErrorKindInvalidInput}
+)
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return string(e.Kind)
+	}
+	return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Err == nil && t.Kind == e.Kind
+}
+
+// wrapError attaches the kind to err, errors that already have a kind are
+// returned as is.
+func wrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Kind: errorKind(err), Err: err}
+}
+
+func errorKind(err error) ErrorKind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+
+	var be botastic.Error
+	if errors.As(err, &be) {
+		return statusKind(be.StatusCode)
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return statusKind(se.StatusCode)
+	}
+
+	var te *TurnError
+	if errors.As(err, &te) {
+		return ErrorKindUpstreamUnavailable
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorKindTimeout
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		if ne.Timeout() {
+			return ErrorKindTimeout
+		}
+		return ErrorKindUpstreamUnavailable
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrorKindUpstreamUnavailable
+	}
+
+	return ErrorKindUnknown
+}
+
+func statusKind(code int) ErrorKind {
+	switch {
+	case code == http.StatusTooManyRequests:
+		return ErrorKindRateLimited
+	case code == http.StatusGatewayTimeout:
+		return ErrorKindTimeout
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return ErrorKindNotAllowed
+	case code >= http.StatusInternalServerError:
+		return ErrorKindUpstreamUnavailable
+	case code >= http.StatusBadRequest:
+		return ErrorKindInvalidInput
+	}
+	return ErrorKindUnknown
+}
+
+// defaultErrorMessages are the built-in user facing messages, indexed by kind
+// and language.
+var defaultErrorMessages = map[ErrorKind]map[string]string{
+	ErrorKindUnknown: {
+		"en": "Sorry, something went wrong. Please try again later.",
+		"zh": "抱歉，出了点问题，请稍后再试。",
+	},
+	ErrorKindUpstreamUnavailable: {
+		"en": "Sorry, the bot is unavailable right now. Please try again later.",
+		"zh": "抱歉，机器人暂时不可用，请稍后再试。",
+	},
+	ErrorKindRateLimited: {
+		"en": "Too many requests, please slow down and try again later.",
+		"zh": "请求太频繁了，请稍后再试。",
+	},
+	ErrorKindTimeout: {
+		"en": "The bot is still thinking, please try again later.",
+		"zh": "机器人还在思考中，请稍后再试。",
+	},
+	ErrorKindNotAllowed: {
+		"en": "Sorry, you are not allowed to talk to this bot.",
+		"zh": "抱歉，你没有权限和这个机器人对话。",
+	},
+	ErrorKindInvalidInput: {
+		"en": "Sorry, I can't handle this message.",
+		"zh": "抱歉，我无法处理这条消息。",
+	},
+}
+
+// errorMessage renders the user facing message of err in lang, configured
+// messages take precedence over the built-in ones. The messages are
+// text/template templates with .Kind and .Lang.
+func (h *Handler) errorMessage(err error, lang string) string {
+	kind := errorKind(err)
+	tpl := lookupMessage(h.getConfig().Options.ErrorMessages[string(kind)], lang)
+	if tpl == "" {
+		tpl = lookupMessage(defaultErrorMessages[kind], lang)
+	}
+	if tpl == "" {
+		tpl = lookupMessage(defaultErrorMessages[ErrorKindUnknown], lang)
+	}
+
+	t, err := template.New("error").Parse(tpl)
+	if err != nil {
+		h.logger.WithError(err).WithField("template", tpl).Error("parse error message template error")
+		return tpl
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, map[string]string{
+		"Kind": string(kind),
+		"Lang": lang,
+	}); err != nil {
+		h.logger.WithError(err).WithField("template", tpl).Error("execute error message template error")
+		return tpl
+	}
+	return buf.String()
+}
+
+// lookupMessage finds the message of lang, falling back to the base language
+// ("zh" for "zh-CN"), then "default" and "en".
+func lookupMessage(messages map[string]string, lang string) string {
+	if len(messages) == 0 {
+		return ""
+	}
+
+	keys := []string{lang}
+	if idx := strings.IndexAny(lang, "-_"); idx > 0 {
+		keys = append(keys, lang[:idx])
+	}
+	keys = append(keys, "default", "en")
+	for _, k := range keys {
+		if msg, ok := messages[k]; ok && msg != "" {
+			return msg
+		}
+	}
+	return ""
+}
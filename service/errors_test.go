@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/pandodao/PAL9000/config"
+	"github.com/pandodao/botastic-go"
+	"github.com/sirupsen/logrus"
+)
+
+func TestErrorKind(t *testing.T) {
+	cases := []struct {
+		err  error
+		want error
+	}{
+		{err: botastic.Error{StatusCode: 429}, want: ErrRateLimited},
+		{err: botastic.Error{StatusCode: 503}, want: ErrUpstreamUnavailable},
+		{err: botastic.Error{StatusCode: 403}, want: ErrNotAllowed},
+		{err: botastic.Error{StatusCode: 400}, want: ErrInvalidInput},
+		{err: fmt.Errorf("wrapped: %w", context.DeadlineExceeded), want: ErrTimeout},
+		{err: ErrTurnTimeout, want: ErrTimeout},
+		{err: &TurnError{TurnID: 1, Status: TurnStatusError}, want: ErrUpstreamUnavailable},
+	}
+
+	for _, c := range cases {
+		t.Run(c.err.Error(), func(t *testing.T) {
+			err := wrapError(c.err)
+			if !errors.Is(err, c.want) {
+				t.Errorf("wrapError(%v) = %v, want kind %v", c.err, err, c.want)
+			}
+			if !errors.Is(err, c.err) && !errors.As(err, new(botastic.Error)) {
+				t.Errorf("wrapError(%v) should keep the raw error", c.err)
+			}
+		})
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	h := &Handler{
+		cfg: config.GeneralConfig{
+			Options: &config.GeneralOptionsConfig{
+				ErrorMessages: map[string]map[string]string{
+					"rate_limited": {
+						"ja":      "しばらくしてから再試行してください ({{.Kind}})",
+						"default": "slow down ({{.Lang}})",
+					},
+				},
+			},
+		},
+		logger: logrus.NewEntry(logrus.New()),
+	}
+
+	cases := []struct {
+		err  error
+		lang string
+		want string
+	}{
+		{err: ErrRateLimited, lang: "ja-JP", want: "しばらくしてから再試行してください (rate_limited)"},
+		{err: ErrRateLimited, lang: "zh", want: "slow down (zh)"},
+		{err: ErrTimeout, lang: "zh-CN", want: defaultErrorMessages[ErrorKindTimeout]["zh"]},
+		{err: errors.New("boom"), lang: "fr", want: defaultErrorMessages[ErrorKindUnknown]["en"]},
+	}
+
+	for _, c := range cases {
+		if got := h.errorMessage(c.err, c.lang); got != c.want {
+			t.Errorf("errorMessage(%v, %s) = %q, want %q", c.err, c.lang, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package service
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The markdown subset the bots usually answer with: paragraphs, headings,
+// fenced code blocks, lists, quotes and rules, with bold, italic,
+// strikethrough, inline code and links inside.
+
+type BlockKind int
+
+const (
+	BlockParagraph BlockKind = iota
+	BlockHeading
+	BlockCode
+	BlockList
+	BlockQuote
+	BlockRule
+)
+
+type InlineKind int
+
+const (
+	InlineText InlineKind = iota
+	InlineBold
+	InlineItalic
+	InlineStrike
+	InlineCode
+	InlineLink
+)
+
+type Document struct {
+	Blocks []*Block
+}
+
+type Block struct {
+	Kind    BlockKind
+	Level   int      // level of a heading
+	Lang    string   // language of a code block
+	Code    string   // content of a code block
+	Inlines []Inline // content of a paragraph, heading or quote
+	Items   []ListItem
+}
+
+type ListItem struct {
+	Level   int // nesting level, starts from 0
+	Ordered bool
+	Number  int
+	Inlines []Inline
+}
+
+type Inline struct {
+	Kind     InlineKind
+	Text     string // content of text and code
+	URL      string // target of a link
+	Children []Inline
+}
+
+var (
+	headingRegex  = regexp.MustCompile(`^(#{1,6})\s+(.*?)(\s+#+)?\s*$`)
+	ruleRegex     = regexp.MustCompile(`^([-*_])(\s*[-*_]){2,}$`)
+	listItemRegex = regexp.MustCompile(`^(\s*)([-*+]|\d{1,9}[.)])\s+(.*)$`)
+)
+
+// IsPlain reports whether the document is plain text without any formatting.
+func (d *Document) IsPlain() bool {
+	for _, b := range d.Blocks {
+		if b.Kind != BlockParagraph {
+			return false
+		}
+		for _, in := range b.Inlines {
+			if in.Kind != InlineText {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ParseMarkdown parses the markdown subset, anything it doesn't understand is
+// kept as text.
+func ParseMarkdown(s string) *Document {
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	doc := &Document{}
+
+	for i := 0; i < len(lines); {
+		trimmed := strings.TrimSpace(lines[i])
+		switch {
+		case trimmed == "":
+			i++
+		case isFence(trimmed):
+			var b *Block
+			b, i = parseCodeBlock(lines, i)
+			doc.Blocks = append(doc.Blocks, b)
+		case headingRegex.MatchString(trimmed):
+			m := headingRegex.FindStringSubmatch(trimmed)
+			doc.Blocks = append(doc.Blocks, &Block{
+				Kind:    BlockHeading,
+				Level:   len(m[1]),
+				Inlines: parseInlines(m[2]),
+			})
+			i++
+		case ruleRegex.MatchString(trimmed):
+			doc.Blocks = append(doc.Blocks, &Block{Kind: BlockRule})
+			i++
+		case strings.HasPrefix(trimmed, ">"):
+			var quote []string
+			for ; i < len(lines); i++ {
+				t := strings.TrimSpace(lines[i])
+				if !strings.HasPrefix(t, ">") {
+					break
+				}
+				quote = append(quote, strings.TrimSpace(strings.TrimPrefix(t, ">")))
+			}
+			doc.Blocks = append(doc.Blocks, &Block{
+				Kind:    BlockQuote,
+				Inlines: parseInlines(strings.Join(quote, "\n")),
+			})
+		case listItemRegex.MatchString(lines[i]):
+			var b *Block
+			b, i = parseList(lines, i)
+			doc.Blocks = append(doc.Blocks, b)
+		default:
+			var para []string
+			for ; i < len(lines) && !isBlockStart(lines[i]); i++ {
+				para = append(para, strings.TrimSpace(lines[i]))
+			}
+			doc.Blocks = append(doc.Blocks, &Block{
+				Kind:    BlockParagraph,
+				Inlines: parseInlines(strings.Join(para, "\n")),
+			})
+		}
+	}
+
+	return doc
+}
+
+func isFence(trimmed string) bool {
+	return strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~")
+}
+
+// isBlockStart reports whether the line ends a paragraph.
+func isBlockStart(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" ||
+		isFence(trimmed) ||
+		headingRegex.MatchString(trimmed) ||
+		ruleRegex.MatchString(trimmed) ||
+		strings.HasPrefix(trimmed, ">") ||
+		listItemRegex.MatchString(line)
+}
+
+func parseCodeBlock(lines []string, i int) (*Block, int) {
+	header := strings.TrimSpace(lines[i])
+	fence := header[:3]
+	b := &Block{
+		Kind: BlockCode,
+		Lang: strings.TrimSpace(strings.TrimLeft(header, fence[:1])),
+	}
+
+	var code []string
+	for i++; i < len(lines); i++ {
+		t := strings.TrimSpace(lines[i])
+		if strings.HasPrefix(t, fence) && strings.Trim(t, fence[:1]) == "" {
+			i++
+			break
+		}
+		code = append(code, lines[i])
+	}
+	b.Code = strings.Join(code, "\n")
+	return b, i
+}
+
+func parseList(lines []string, i int) (*Block, int) {
+	b := &Block{Kind: BlockList}
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if m := listItemRegex.FindStringSubmatch(line); m != nil && !ruleRegex.MatchString(strings.TrimSpace(line)) {
+			indent := strings.ReplaceAll(m[1], "\t", "    ")
+			item := ListItem{
+				Level:   len(indent) / 2,
+				Inlines: parseInlines(m[3]),
+			}
+			if n, err := strconv.Atoi(strings.TrimRight(m[2], ".)")); err == nil {
+				item.Ordered = true
+				item.Number = n
+			}
+			b.Items = append(b.Items, item)
+			continue
+		}
+
+		// an indented line continues the last item
+		if strings.TrimSpace(line) != "" && (line[0] == ' ' || line[0] == '\t') && !isBlockStart(line) {
+			last := &b.Items[len(b.Items)-1]
+			last.Inlines = append(last.Inlines, Inline{Kind: InlineText, Text: "\n"})
+			last.Inlines = append(last.Inlines, parseInlines(strings.TrimSpace(line))...)
+			continue
+		}
+		break
+	}
+	return b, i
+}
+
+func parseInlines(s string) []Inline {
+	var (
+		out  []Inline
+		text strings.Builder
+	)
+	flush := func() {
+		if text.Len() > 0 {
+			out = append(out, Inline{Kind: InlineText, Text: text.String()})
+			text.Reset()
+		}
+	}
+	emit := func(in Inline) {
+		flush()
+		out = append(out, in)
+	}
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && isASCIIPunct(s[i+1]):
+			text.WriteByte(s[i+1])
+			i += 2
+			continue
+		case c == '`':
+			n := 1
+			for i+n < len(s) && s[i+n] == '`' {
+				n++
+			}
+			delim := s[i : i+n]
+			if end := strings.Index(s[i+n:], delim); end > 0 {
+				emit(Inline{Kind: InlineCode, Text: strings.TrimSpace(s[i+n : i+n+end])})
+				i += n + end + n
+				continue
+			}
+			text.WriteString(delim)
+			i += n
+			continue
+		case c == '[':
+			if label, url, n, ok := parseLink(s[i:]); ok {
+				emit(Inline{Kind: InlineLink, URL: url, Children: parseInlines(label)})
+				i += n
+				continue
+			}
+		case strings.HasPrefix(s[i:], "**") || strings.HasPrefix(s[i:], "__"):
+			if inner, n, ok := parseDelimited(s, i, s[i:i+2]); ok {
+				emit(Inline{Kind: InlineBold, Children: parseInlines(inner)})
+				i += n
+				continue
+			}
+		case strings.HasPrefix(s[i:], "~~"):
+			if inner, n, ok := parseDelimited(s, i, "~~"); ok {
+				emit(Inline{Kind: InlineStrike, Children: parseInlines(inner)})
+				i += n
+				continue
+			}
+		case c == '*' || c == '_':
+			if inner, n, ok := parseDelimited(s, i, s[i:i+1]); ok {
+				emit(Inline{Kind: InlineItalic, Children: parseInlines(inner)})
+				i += n
+				continue
+			}
+		}
+
+		text.WriteByte(c)
+		i++
+	}
+	flush()
+	return out
+}
+
+// parseDelimited parses the span s[i:] wrapped in delim, it returns the inner
+// text and the length of the span. Underscores only count at word boundaries
+// so snake_case stays as is.
+func parseDelimited(s string, i int, delim string) (string, int, bool) {
+	start := i + len(delim)
+	if start >= len(s) || s[start] == ' ' || s[start] == '\n' {
+		return "", 0, false
+	}
+	if delim[0] == '_' && i > 0 && isWordByte(s, i-1) {
+		return "", 0, false
+	}
+
+	for j := start + 1; j+len(delim) <= len(s); j++ {
+		if s[j:j+len(delim)] != delim || s[j-1] == ' ' || s[j-1] == '\\' {
+			continue
+		}
+		// a single * or _ must not be part of a double one
+		if len(delim) == 1 && j+1 < len(s) && s[j+1] == delim[0] {
+			j++
+			continue
+		}
+		end := j + len(delim)
+		if delim[0] == '_' && end < len(s) && isWordByte(s, end) {
+			continue
+		}
+		return s[start:j], end - i, true
+	}
+	return "", 0, false
+}
+
+// parseLink parses "[label](url)" at the start of s.
+func parseLink(s string) (string, string, int, bool) {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\n':
+			return "", "", 0, false
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth > 0 {
+				continue
+			}
+			if i+1 >= len(s) || s[i+1] != '(' {
+				return "", "", 0, false
+			}
+			end := strings.IndexByte(s[i+2:], ')')
+			if end < 0 {
+				return "", "", 0, false
+			}
+			url := strings.Trim(strings.TrimSpace(s[i+2:i+2+end]), "<>")
+			if url == "" || strings.ContainsAny(url, " \n") {
+				return "", "", 0, false
+			}
+			return s[1:i], url, i + 2 + end + 1, true
+		}
+	}
+	return "", "", 0, false
+}
+
+func isASCIIPunct(c byte) bool {
+	return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
+
+func isWordByte(s string, i int) bool {
+	r, _ := utf8.DecodeRuneInString(s[i:])
+	if r == utf8.RuneError && i > 0 {
+		r, _ = utf8.DecodeLastRuneInString(s[:i+1])
+	}
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,235 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fox-one/pkg/uuid"
+	"github.com/pandodao/PAL9000/config"
+	"github.com/pandodao/botastic-go"
+)
+
+const (
+	defaultOpenAIMaxHistory = 10
+	defaultOpenAITimeout    = 60 * time.Second
+)
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []openAIMessage `json:"messages"`
+	Stream   bool            `json:"stream,omitempty"`
+}
+
+// openAIChatChunk is an event of a streamed chat completion.
+type openAIChatChunk struct {
+	Choices []struct {
+		Delta openAIMessage `json:"delta"`
+	} `json:"choices"`
+}
+
+type openAIChatResponse struct {
+	Choices []struct {
+		Message openAIMessage `json:"message"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// openAIBackend talks to an OpenAI compatible chat completions API. The API
+// is stateless, so the history is kept in botastic.Conversation.History and
+// persisted by the store.
+type openAIBackend struct {
+	cfg    config.OpenAIConfig
+	client *http.Client
+
+	turnID uint64
+}
+
+func newOpenAIBackend(cfg config.OpenAIConfig) *openAIBackend {
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultOpenAITimeout
+	}
+	if cfg.MaxHistory == 0 {
+		cfg.MaxHistory = defaultOpenAIMaxHistory
+	}
+
+	return &openAIBackend{
+		cfg:    cfg,
+		client: &http.Client{Timeout: timeout},
+		turnID: uint64(time.Now().UnixNano()),
+	}
+}
+
+func (b *openAIBackend) CreateConversation(ctx context.Context, req botastic.CreateConversationRequest) (*botastic.Conversation, error) {
+	return &botastic.Conversation{
+		ID:           uuid.New(),
+		Bot:          &botastic.Bot{ID: req.BotID},
+		UserIdentity: req.UserIdentity,
+		Lang:         req.Lang,
+	}, nil
+}
+
+func (b *openAIBackend) PostMessage(ctx context.Context, conv *botastic.Conversation, content string) (*botastic.ConvTurn, error) {
+	resp, err := b.chat(ctx, b.buildRequest(conv, content))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("no choices in chat completion response")
+	}
+
+	turn := b.addTurn(conv, content, resp.Choices[0].Message.Content)
+	turn.RequestToken = resp.Usage.PromptTokens
+	turn.ResponseToken = resp.Usage.CompletionTokens
+	return turn, nil
+}
+
+func (b *openAIBackend) PostMessageStream(ctx context.Context, conv *botastic.Conversation, content string, onUpdate func(text string)) (*botastic.ConvTurn, error) {
+	req := b.buildRequest(conv, content)
+	req.Stream = true
+	body, err := b.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var text strings.Builder
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk openAIChatChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal error: %w", err)
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		text.WriteString(chunk.Choices[0].Delta.Content)
+		onUpdate(text.String())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return b.addTurn(conv, content, text.String()), nil
+}
+
+// addTurn records a finished turn in the history of the conversation.
+func (b *openAIBackend) addTurn(conv *botastic.Conversation, content, response string) *botastic.ConvTurn {
+	now := time.Now()
+	turn := &botastic.ConvTurn{
+		ID:             atomic.AddUint64(&b.turnID, 1),
+		ConversationID: conv.ID,
+		UserIdentity:   conv.UserIdentity,
+		Request:        content,
+		Response:       strings.TrimSpace(response),
+		Status:         int(TurnStatusSuccess),
+		CreatedAt:      &now,
+		UpdatedAt:      &now,
+	}
+	if conv.Bot != nil {
+		turn.BotID = conv.Bot.ID
+	}
+
+	conv.History = append(conv.History, turn)
+	if n := len(conv.History) - b.cfg.MaxHistory; n > 0 && b.cfg.MaxHistory > 0 {
+		conv.History = conv.History[n:]
+	}
+	return turn
+}
+
+// GetReply only finds the turns kept in the history, PostMessage returns the
+// turns completed so they are never polled.
+func (b *openAIBackend) GetReply(ctx context.Context, conv *botastic.Conversation, turnID uint64, block bool) (*botastic.ConvTurn, error) {
+	for _, turn := range conv.History {
+		if turn.ID == turnID {
+			return turn, nil
+		}
+	}
+
+	return nil, fmt.Errorf("turn not found: %d", turnID)
+}
+
+func (b *openAIBackend) buildRequest(conv *botastic.Conversation, content string) openAIChatRequest {
+	req := openAIChatRequest{Model: b.cfg.Model}
+	if b.cfg.SystemPrompt != "" {
+		req.Messages = append(req.Messages, openAIMessage{Role: "system", Content: b.cfg.SystemPrompt})
+	}
+	for _, turn := range conv.History {
+		req.Messages = append(req.Messages,
+			openAIMessage{Role: "user", Content: turn.Request},
+			openAIMessage{Role: "assistant", Content: turn.Response},
+		)
+	}
+	req.Messages = append(req.Messages, openAIMessage{Role: "user", Content: content})
+	return req
+}
+
+func (b *openAIBackend) chat(ctx context.Context, req openAIChatRequest) (*openAIChatResponse, error) {
+	body, err := b.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var result openAIChatResponse
+	if err := json.NewDecoder(body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("json.Decode error: %w", err)
+	}
+	return &result, nil
+}
+
+// do sends the chat completion request and returns the response body.
+func (b *openAIBackend) do(ctx context.Context, req openAIChatRequest) (io.ReadCloser, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	url := strings.TrimRight(b.cfg.BaseURL, "/") + "/chat/completions"
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if b.cfg.APIKey != "" {
+		r.Header.Set("Authorization", "Bearer "+b.cfg.APIKey)
+	}
+
+	resp, err := b.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	return resp.Body, nil
+}
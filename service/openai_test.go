@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pandodao/PAL9000/config"
+	"github.com/pandodao/botastic-go"
+)
+
+func TestOpenAIBackend(t *testing.T) {
+	var got openAIChatRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" || r.Header.Get("Authorization") != "Bearer key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"pong"}}]}`))
+	}))
+	defer srv.Close()
+
+	b := newOpenAIBackend(config.OpenAIConfig{
+		BaseURL:      srv.URL + "/v1/",
+		APIKey:       "key",
+		Model:        "test",
+		SystemPrompt: "be nice",
+		MaxHistory:   1,
+	})
+
+	ctx := context.Background()
+	conv, _ := b.CreateConversation(ctx, botastic.CreateConversationRequest{UserIdentity: "u"})
+	for _, content := range []string{"ping 1", "ping 2", "ping 3"} {
+		turn, err := b.PostMessage(ctx, conv, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if turn.Response != "pong" || TurnStatus(turn.Status) != TurnStatusSuccess {
+			t.Fatalf("PostMessage() = %+v", turn)
+		}
+	}
+
+	// system prompt, one turn of history and the new message
+	want := []string{"be nice", "ping 2", "pong", "ping 3"}
+	if len(got.Messages) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(got.Messages), len(want))
+	}
+	for i, m := range got.Messages {
+		if m.Content != want[i] {
+			t.Errorf("message %d = %q, want %q", i, m.Content, want[i])
+		}
+	}
+
+	b.cfg.APIKey = "wrong"
+	_, err := b.PostMessage(ctx, conv, "ping")
+	if errorKind(err) != ErrorKindNotAllowed {
+		t.Errorf("PostMessage() error = %v, want not allowed", err)
+	}
+}
+
+func TestOpenAIBackendStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, delta := range []string{"Hel", "lo", "!"} {
+			w.Write([]byte(`data: {"choices":[{"delta":{"content":"` + delta + `"}}]}` + "\n\n"))
+		}
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer srv.Close()
+
+	b := newOpenAIBackend(config.OpenAIConfig{BaseURL: srv.URL, Model: "test"})
+	conv, _ := b.CreateConversation(context.Background(), botastic.CreateConversationRequest{})
+
+	var updates []string
+	turn, err := b.PostMessageStream(context.Background(), conv, "hi", func(text string) {
+		updates = append(updates, text)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"Hel", "Hello", "Hello!"}
+	if len(updates) != len(want) {
+		t.Fatalf("got updates %v, want %v", updates, want)
+	}
+	for i := range want {
+		if updates[i] != want[i] {
+			t.Fatalf("got updates %v, want %v", updates, want)
+		}
+	}
+	if turn.Response != "Hello!" || len(conv.History) != 1 {
+		t.Errorf("PostMessageStream() = %+v, history %d", turn, len(conv.History))
+	}
+}
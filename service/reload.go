@@ -0,0 +1,42 @@
+package service
+
+import (
+	"reflect"
+
+	"github.com/pandodao/PAL9000/config"
+)
+
+// ReloadableAdapter is implemented by adapters which can apply a changed
+// config without reconnecting, e.g. a new whitelist.
+type ReloadableAdapter interface {
+	// Reload applies the config, it returns false if the change can't be
+	// applied live and the adapter has to be restarted, e.g. a new token.
+	Reload(cfg config.AdapterConfig) bool
+}
+
+// UpdateConfig applies the general config to the running handler, the
+// messages being handled keep using the old one.
+func (h *Handler) UpdateConfig(cfg config.GeneralConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !reflect.DeepEqual(cfg.Backend, h.cfg.Backend) || !reflect.DeepEqual(cfg.Botastic, h.cfg.Botastic) {
+		h.backend = newBackend(cfg)
+	}
+	if h.dispatcher != nil && cfg.Options.Concurrency != h.cfg.Options.Concurrency {
+		h.dispatcher.setConcurrency(cfg.Options.Concurrency)
+	}
+	h.cfg = cfg
+}
+
+func (h *Handler) getConfig() config.GeneralConfig {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.cfg
+}
+
+func (h *Handler) getBackend() Backend {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.backend
+}
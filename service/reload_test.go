@@ -0,0 +1,33 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/pandodao/PAL9000/config"
+)
+
+func TestHandlerUpdateConfig(t *testing.T) {
+	cfg := config.GeneralConfig{
+		Options:  &config.GeneralOptionsConfig{Concurrency: 2},
+		Bot:      &config.BotConfig{BotID: 1},
+		Botastic: &config.BotasticConfig{AppId: "app", Host: "http://localhost"},
+	}
+	h := &Handler{cfg: cfg, backend: newBackend(cfg), dispatcher: newDispatcher(2)}
+	backend := h.getBackend()
+
+	// options only, the backend is kept
+	cfg.Options = &config.GeneralOptionsConfig{Concurrency: 5, ShowTyping: true}
+	h.UpdateConfig(cfg)
+	if h.getBackend() != backend {
+		t.Error("backend should be kept")
+	}
+	if !h.getConfig().Options.ShowTyping || cap(h.dispatcher.sem) != 5 {
+		t.Error("options should be applied")
+	}
+
+	cfg.Backend = &config.BackendConfig{Driver: "openai", OpenAI: &config.OpenAIConfig{BaseURL: "http://localhost", Model: "m"}}
+	h.UpdateConfig(cfg)
+	if _, ok := h.getBackend().(*openAIBackend); !ok {
+		t.Errorf("backend should be replaced, got %T", h.getBackend())
+	}
+}
@@ -0,0 +1,295 @@
+package service
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// Format is the message format of a platform the replies are rendered to.
+type Format int
+
+const (
+	// FormatPlain drops all the formatting, for platforms like wechat.
+	FormatPlain Format = iota
+	// FormatMarkdown is CommonMark, e.g. mixin PLAIN_POST messages.
+	FormatMarkdown
+	// FormatDiscord is the markdown flavor of discord, it has no headings.
+	FormatDiscord
+	// FormatTelegramHTML is the HTML parse mode of telegram, matrix supports
+	// the tags as well.
+	FormatTelegramHTML
+	// FormatSlack is the mrkdwn of slack, it has no headings or escaping
+	// other than &, < and >.
+	FormatSlack
+)
+
+type RenderOptions struct {
+	// FormatLinks surrounds the bare links in the text with spaces, so the
+	// clients won't take the characters around as part of them.
+	FormatLinks bool
+}
+
+// FormatText renders the markdown text in format and splits it into parts
+// within limit measured by length. The text is split before rendering so the
+// formatting is never broken across parts.
+func FormatText(text string, format Format, opts RenderOptions, limit int, length LengthFunc, numbered bool) []string {
+	if numbered && limit > partMarkerReserve*2 {
+		limit -= partMarkerReserve
+	}
+
+	parts := renderChunks(text, format, opts, limit, length)
+	if len(parts) == 0 {
+		parts = []string{""}
+	}
+
+	if numbered && len(parts) > 1 {
+		for i := range parts {
+			parts[i] += fmt.Sprintf("\n(%d/%d)", i+1, len(parts))
+		}
+	}
+	return parts
+}
+
+func renderChunks(text string, format Format, opts RenderOptions, limit int, length LengthFunc) []string {
+	var parts []string
+	for _, chunk := range SplitText(text, limit, length, false) {
+		rendered := Render(ParseMarkdown(chunk), format, opts)
+		if rendered == "" {
+			continue
+		}
+		if limit <= 0 || length(rendered) <= limit {
+			parts = append(parts, rendered)
+			continue
+		}
+
+		// the markup and escaping make it longer, split the chunk smaller
+		smaller := length(chunk)*limit/length(rendered) - 1
+		if smaller <= 0 {
+			parts = append(parts, rendered)
+			continue
+		}
+		parts = append(parts, renderChunks(chunk, format, opts, smaller, length)...)
+	}
+	return parts
+}
+
+// Render renders the document in format.
+func Render(doc *Document, format Format, opts RenderOptions) string {
+	r := &renderer{format: format, opts: opts}
+	blocks := make([]string, 0, len(doc.Blocks))
+	for _, b := range doc.Blocks {
+		if s := r.block(b); s != "" {
+			blocks = append(blocks, s)
+		}
+	}
+	return strings.Join(blocks, "\n\n")
+}
+
+type renderer struct {
+	format Format
+	opts   RenderOptions
+}
+
+func (r *renderer) block(b *Block) string {
+	switch b.Kind {
+	case BlockHeading:
+		text := r.inlines(b.Inlines)
+		switch r.format {
+		case FormatMarkdown:
+			return strings.Repeat("#", b.Level) + " " + text
+		case FormatDiscord:
+			return "**" + text + "**"
+		case FormatSlack:
+			return "*" + text + "*"
+		case FormatTelegramHTML:
+			return "<b>" + text + "</b>"
+		}
+		return text
+	case BlockCode:
+		return r.codeBlock(b)
+	case BlockList:
+		return r.list(b)
+	case BlockQuote:
+		text := r.inlines(b.Inlines)
+		if r.format == FormatTelegramHTML {
+			return "<blockquote>" + text + "</blockquote>"
+		}
+		return "> " + strings.ReplaceAll(text, "\n", "\n> ")
+	case BlockRule:
+		if r.format == FormatMarkdown {
+			return "---"
+		}
+		return "———"
+	}
+	return r.inlines(b.Inlines)
+}
+
+func (r *renderer) codeBlock(b *Block) string {
+	switch r.format {
+	case FormatPlain:
+		return b.Code
+	case FormatTelegramHTML:
+		if b.Lang != "" {
+			return fmt.Sprintf(`<pre><code class="language-%s">%s</code></pre>`, html.EscapeString(b.Lang), html.EscapeString(b.Code))
+		}
+		return "<pre>" + html.EscapeString(b.Code) + "</pre>"
+	case FormatSlack:
+		// no language in slack
+		return "```\n" + slackEscaper.Replace(b.Code) + "\n```"
+	}
+
+	// the fence must be longer than any backticks inside
+	fence := "```"
+	for strings.Contains(b.Code, fence) {
+		fence += "`"
+	}
+	return fence + b.Lang + "\n" + b.Code + "\n" + fence
+}
+
+func (r *renderer) list(b *Block) string {
+	lines := make([]string, 0, len(b.Items))
+	for _, item := range b.Items {
+		bullet := "-"
+		if r.format == FormatPlain || r.format == FormatTelegramHTML || r.format == FormatSlack {
+			bullet = "•"
+		}
+		if item.Ordered {
+			bullet = fmt.Sprintf("%d.", item.Number)
+		}
+
+		indent := strings.Repeat("  ", item.Level)
+		text := r.inlines(item.Inlines)
+		text = strings.ReplaceAll(text, "\n", "\n"+indent+strings.Repeat(" ", len(bullet)+1))
+		lines = append(lines, indent+bullet+" "+text)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r *renderer) inlines(ins []Inline) string {
+	var b strings.Builder
+	for _, in := range ins {
+		b.WriteString(r.inline(in))
+	}
+	return b.String()
+}
+
+func (r *renderer) inline(in Inline) string {
+	switch in.Kind {
+	case InlineText:
+		return r.text(in.Text)
+	case InlineCode:
+		return r.code(in.Text)
+	case InlineLink:
+		return r.link(in)
+	}
+
+	children := r.inlines(in.Children)
+	var tag, delim string
+	switch in.Kind {
+	case InlineBold:
+		tag, delim = "b", "**"
+	case InlineItalic:
+		tag, delim = "i", "*"
+	case InlineStrike:
+		tag, delim = "s", "~~"
+	}
+
+	switch r.format {
+	case FormatPlain:
+		return children
+	case FormatTelegramHTML:
+		return "<" + tag + ">" + children + "</" + tag + ">"
+	case FormatSlack:
+		delim = delim[:1]
+		if in.Kind == InlineItalic {
+			delim = "_"
+		}
+	}
+	return delim + children + delim
+}
+
+func (r *renderer) code(s string) string {
+	switch r.format {
+	case FormatPlain:
+		return s
+	case FormatTelegramHTML:
+		return "<code>" + html.EscapeString(s) + "</code>"
+	case FormatSlack:
+		s = slackEscaper.Replace(s)
+	}
+
+	delim := "`"
+	for strings.Contains(s, delim) {
+		delim += "`"
+	}
+	if len(delim) > 1 {
+		return delim + " " + s + " " + delim
+	}
+	return delim + s + delim
+}
+
+func (r *renderer) link(in Inline) string {
+	label := r.inlines(in.Children)
+	switch r.format {
+	case FormatPlain:
+		if label == in.URL {
+			return in.URL
+		}
+		return label + " (" + in.URL + ")"
+	case FormatTelegramHTML:
+		return `<a href="` + html.EscapeString(in.URL) + `">` + label + "</a>"
+	case FormatSlack:
+		return "<" + slackEscaper.Replace(in.URL) + "|" + strings.ReplaceAll(label, "|", "¦") + ">"
+	}
+	return "[" + label + "](" + strings.ReplaceAll(in.URL, ")", "%29") + ")"
+}
+
+// text escapes the text, the bare links in it are kept as is so the clients
+// can still recognize them.
+func (r *renderer) text(s string) string {
+	if r.opts.FormatLinks {
+		s = formatLink(s)
+	}
+
+	var (
+		b    strings.Builder
+		last int
+	)
+	for _, loc := range linkRegex.FindAllStringIndex(s, -1) {
+		b.WriteString(r.escape(s[last:loc[0]]))
+		if r.format == FormatTelegramHTML || r.format == FormatSlack {
+			b.WriteString(r.escape(s[loc[0]:loc[1]]))
+		} else {
+			b.WriteString(s[loc[0]:loc[1]])
+		}
+		last = loc[1]
+	}
+	b.WriteString(r.escape(s[last:]))
+	return b.String()
+}
+
+var (
+	markdownEscaper = strings.NewReplacer(
+		`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`,
+		"<", `\<`, ">", `\>`, "~", `\~`, "|", `\|`,
+	)
+	discordEscaper = strings.NewReplacer(
+		`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "~", `\~`, "|", `\|`,
+	)
+	slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+)
+
+func (r *renderer) escape(s string) string {
+	switch r.format {
+	case FormatMarkdown:
+		return markdownEscaper.Replace(s)
+	case FormatDiscord:
+		return discordEscaper.Replace(s)
+	case FormatTelegramHTML:
+		return html.EscapeString(s)
+	case FormatSlack:
+		return slackEscaper.Replace(s)
+	}
+	return s
+}
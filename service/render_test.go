@@ -0,0 +1,85 @@
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+const renderInput = "# Title\n\nSome **bold**, *italic*, ~~gone~~ and `a<b>` text with snake_case_name.\n\n" +
+	"- one\n- [two](https://example.com/a_b)\n  1. nested\n\n```go\nif a < b && c {\n}\n```\n\n> quoted"
+
+func TestRender(t *testing.T) {
+	cases := []struct {
+		format Format
+		want   string
+	}{
+		{
+			format: FormatPlain,
+			want: "Title\n\nSome bold, italic, gone and a<b> text with snake_case_name.\n\n" +
+				"• one\n• two (https://example.com/a_b)\n  1. nested\n\nif a < b && c {\n}\n\n> quoted",
+		},
+		{
+			format: FormatMarkdown,
+			want: "# Title\n\nSome **bold**, *italic*, ~~gone~~ and `a<b>` text with snake\\_case\\_name.\n\n" +
+				"- one\n- [two](https://example.com/a_b)\n  1. nested\n\n```go\nif a < b && c {\n}\n```\n\n> quoted",
+		},
+		{
+			format: FormatDiscord,
+			want: "**Title**\n\nSome **bold**, *italic*, ~~gone~~ and `a<b>` text with snake\\_case\\_name.\n\n" +
+				"- one\n- [two](https://example.com/a_b)\n  1. nested\n\n```go\nif a < b && c {\n}\n```\n\n> quoted",
+		},
+		{
+			format: FormatTelegramHTML,
+			want: "<b>Title</b>\n\nSome <b>bold</b>, <i>italic</i>, <s>gone</s> and <code>a&lt;b&gt;</code> text with snake_case_name.\n\n" +
+				"• one\n• <a href=\"https://example.com/a_b\">two</a>\n  1. nested\n\n" +
+				"<pre><code class=\"language-go\">if a &lt; b &amp;&amp; c {\n}</code></pre>\n\n<blockquote>quoted</blockquote>",
+		},
+		{
+			format: FormatSlack,
+			want: "*Title*\n\nSome *bold*, _italic_, ~gone~ and `a&lt;b&gt;` text with snake_case_name.\n\n" +
+				"• one\n• <https://example.com/a_b|two>\n  1. nested\n\n```\nif a &lt; b &amp;&amp; c {\n}\n```\n\n> quoted",
+		},
+	}
+
+	doc := ParseMarkdown(renderInput)
+	for _, c := range cases {
+		if got := Render(doc, c.format, RenderOptions{}); got != c.want {
+			t.Errorf("Render(%d) =\n%s\nwant\n%s", c.format, got, c.want)
+		}
+	}
+}
+
+func TestRenderBareLinks(t *testing.T) {
+	doc := ParseMarkdown("see:https://example.com/a_b_c")
+	if got := Render(doc, FormatMarkdown, RenderOptions{FormatLinks: true}); got != "see: https://example.com/a_b_c" {
+		t.Errorf("got %q", got)
+	}
+	if got := Render(doc, FormatTelegramHTML, RenderOptions{}); got != "see:https://example.com/a_b_c" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestDocumentIsPlain(t *testing.T) {
+	if !ParseMarkdown("just text, 1 * 2 = 2\n\nand a_b").IsPlain() {
+		t.Error("plain text should be plain")
+	}
+	if ParseMarkdown("some `code`").IsPlain() {
+		t.Error("inline code is not plain")
+	}
+}
+
+func TestFormatTextEscapedWithinLimit(t *testing.T) {
+	text := strings.Repeat("a < b & c > d. ", 40)
+	parts := FormatText(text, FormatTelegramHTML, RenderOptions{}, 100, UTF16Length, true)
+	if len(parts) < 2 {
+		t.Fatalf("expected several parts, got %d", len(parts))
+	}
+	for _, p := range parts {
+		if n := UTF16Length(p); n > 100 {
+			t.Errorf("part is too long, %d: %q", n, p)
+		}
+		if strings.Contains(p, "< ") {
+			t.Errorf("part is not escaped: %q", p)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pandodao/PAL9000/config"
+	"github.com/pandodao/botastic-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultInitialBackoff = 500 * time.Millisecond
+	defaultMaxBackoff     = 10 * time.Second
+)
+
+// retryableKinds are the kinds of transient errors, they can be listed in
+// retry_on.
+var retryableKinds = []ErrorKind{
+	ErrorKindUpstreamUnavailable,
+	ErrorKindRateLimited,
+	ErrorKindTimeout,
+}
+
+func isRetryable(cfg config.RetryConfig, err error) bool {
+	kind := errorKind(err)
+	transient := false
+	for _, k := range retryableKinds {
+		if k == kind {
+			transient = true
+			break
+		}
+	}
+	if !transient {
+		return false
+	}
+
+	if len(cfg.RetryOn) == 0 {
+		return true
+	}
+	for _, k := range cfg.RetryOn {
+		if ErrorKind(k) == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the wait before the next attempt, it doubles after every
+// attempt and is randomized between half and the full value.
+func backoff(cfg config.RetryConfig, attempt int) time.Duration {
+	d := time.Duration(cfg.InitialBackoff) * time.Millisecond
+	if d <= 0 {
+		d = defaultInitialBackoff
+	}
+	max := time.Duration(cfg.MaxBackoff) * time.Millisecond
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// notAccepted reports whether the request surely failed before the server
+// accepted it: the connection was never made, or it was rejected by 429 or
+// 503 without a body. A timeout or any other error may come after the
+// request is processed.
+func notAccepted(err error) bool {
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "dial" {
+		return true
+	}
+
+	rejected := func(code int) bool {
+		return code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable
+	}
+	var be botastic.Error
+	if errors.As(err, &be) {
+		return rejected(be.StatusCode) && be.Code == 0 && strings.TrimSpace(be.Msg) == ""
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return rejected(se.StatusCode) && strings.TrimSpace(se.Body) == ""
+	}
+	return false
+}
+
+// retry calls fn until it succeeds, the error isn't retryable, the attempts
+// are used up or ctx is done.
+func (h *Handler) retry(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	return h.retryIf(ctx, op, nil, fn)
+}
+
+// retryPost is retry for the requests that must not be sent twice, they are
+// only retried if the failed attempt was not accepted by the server.
+func (h *Handler) retryPost(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	return h.retryIf(ctx, op, notAccepted, fn)
+}
+
+// retryIf is retry with an extra condition on the retryable errors, it's
+// ignored if nil.
+func (h *Handler) retryIf(ctx context.Context, op string, cond func(err error) bool, fn func(ctx context.Context) error) error {
+	cfg := h.getConfig().Options.Retry
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= cfg.MaxAttempts || !isRetryable(cfg, err) || (cond != nil && !cond(err)) {
+			return err
+		}
+
+		wait := backoff(cfg, attempt)
+		h.logger.WithError(err).WithFields(logrus.Fields{
+			"op":      op,
+			"attempt": attempt,
+			"wait":    wait,
+		}).Warn("retrying")
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pandodao/PAL9000/config"
+	"github.com/pandodao/botastic-go"
+	"github.com/sirupsen/logrus"
+)
+
+func TestBackoff(t *testing.T) {
+	cfg := config.RetryConfig{InitialBackoff: 100, MaxBackoff: 1000}
+	cases := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{attempt: 1, max: 100 * time.Millisecond},
+		{attempt: 2, max: 200 * time.Millisecond},
+		{attempt: 3, max: 400 * time.Millisecond},
+		{attempt: 10, max: time.Second},
+	}
+
+	for _, c := range cases {
+		for i := 0; i < 20; i++ {
+			got := backoff(cfg, c.attempt)
+			if got < c.max/2 || got > c.max {
+				t.Fatalf("backoff(%d) = %s, want between %s and %s", c.attempt, got, c.max/2, c.max)
+			}
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	h := &Handler{
+		cfg: config.GeneralConfig{
+			Options: &config.GeneralOptionsConfig{
+				Retry: config.RetryConfig{
+					MaxAttempts:    3,
+					InitialBackoff: 1,
+					MaxBackoff:     1,
+					RetryOn:        []string{string(ErrorKindUpstreamUnavailable)},
+				},
+			},
+		},
+		logger: logrus.NewEntry(logrus.New()),
+	}
+
+	cases := []struct {
+		name     string
+		err      error
+		attempts int
+	}{
+		{name: "server error", err: botastic.Error{StatusCode: 502}, attempts: 3},
+		{name: "rate limited is not listed", err: botastic.Error{StatusCode: 429}, attempts: 1},
+		{name: "bad request", err: botastic.Error{StatusCode: 400}, attempts: 1},
+		{name: "unknown error", err: errors.New("unknown"), attempts: 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			attempts := 0
+			err := h.retry(context.Background(), "test", func(ctx context.Context) error {
+				attempts++
+				return c.err
+			})
+			if err != c.err {
+				t.Errorf("retry() error = %v, want %v", err, c.err)
+			}
+			if attempts != c.attempts {
+				t.Errorf("retry() attempts = %d, want %d", attempts, c.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryPost(t *testing.T) {
+	h := &Handler{
+		cfg: config.GeneralConfig{
+			Options: &config.GeneralOptionsConfig{
+				Retry: config.RetryConfig{MaxAttempts: 3, InitialBackoff: 1, MaxBackoff: 1},
+			},
+		},
+		logger: logrus.NewEntry(logrus.New()),
+	}
+
+	cases := []struct {
+		name     string
+		err      error
+		attempts int
+	}{
+		{name: "dial error", err: &url.Error{Op: "Post", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, attempts: 3},
+		{name: "rate limited without body", err: botastic.Error{StatusCode: 429}, attempts: 3},
+		{name: "unavailable without body", err: &StatusError{StatusCode: 503}, attempts: 3},
+		{name: "unavailable with body", err: &StatusError{StatusCode: 503, Body: `{"error":"overloaded"}`}, attempts: 1},
+		{name: "bad gateway", err: botastic.Error{StatusCode: 502}, attempts: 1},
+		{name: "timeout", err: context.DeadlineExceeded, attempts: 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			attempts := 0
+			h.retryPost(context.Background(), "test", func(ctx context.Context) error {
+				attempts++
+				return c.err
+			})
+			if attempts != c.attempts {
+				t.Errorf("retryPost() attempts = %d, want %d", attempts, c.attempts)
+			}
+		})
+	}
+}
@@ -2,9 +2,12 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pandodao/PAL9000/config"
 	"github.com/pandodao/PAL9000/store"
@@ -12,22 +15,38 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	defaultShutdownGracePeriod = 30 * time.Second
+	// max time to wait for the results of the canceled messages
+	canceledDeliveryTimeout = 5 * time.Second
+)
+
 var (
 	linkRegex = regexp.MustCompile(`https?:\/\/(www\.)?[-a-zA-Z0-9@:%._\+~#=]{1,256}\.[a-zA-Z0-9()]{1,6}\b([-a-zA-Z0-9()@:%_\+.~#?&//=]*)`)
 )
 
 type Adapter interface {
 	GetName() string
+	// GetMessageChan starts receiving messages until ctx is done, the
+	// adapter must still be able to deliver the results after that.
 	GetMessageChan(ctx context.Context) <-chan *Message
 	HandleResult(message *Message, result *Result)
+	// Close releases the resources after all the results are delivered.
+	Close() error
 }
 
 type Handler struct {
-	cfg     config.GeneralConfig
-	client  *botastic.Client
+	// cfg, backend and dispatcher are replaced by UpdateConfig
+	mu         sync.RWMutex
+	cfg        config.GeneralConfig
+	backend    Backend
+	dispatcher *dispatcher
+
 	store   store.Store
 	adapter Adapter
 	logger  *logrus.Entry
+
+	commands *commandRouter
 }
 
 type Message struct {
@@ -44,69 +63,227 @@ type Message struct {
 }
 
 type Result struct {
-	ConvTurn      *botastic.ConvTurn
+	ConvTurn *botastic.ConvTurn
+	// Status of the turn, TurnStatusPending with ErrTurnTimeout means the bot
+	// is still thinking, TurnStatusError with a *TurnError means it failed.
+	Status TurnStatus
+	// Err is the raw error for logging, ErrorText is the user facing message
+	// of it.
 	Err           error
+	ErrorText     string
 	IgnoreIfError bool
+	// StreamMessageID is the id of the placeholder sent by a StreamingAdapter,
+	// the adapter should edit it with the final text instead of sending a new
+	// message.
+	StreamMessageID string
+	// NumberParts appends "(i/n)" to each part if the reply is split.
+	NumberParts bool
+	// FormatLinks surrounds the bare links with spaces when rendering.
+	FormatLinks bool
+}
+
+// Text returns the text to reply, the user facing error message if failed.
+func (r *Result) Text() string {
+	if r.Err != nil {
+		return r.ErrorText
+	}
+	if r.ConvTurn == nil {
+		return ""
+	}
+	return r.ConvTurn.Response
+}
+
+// Parts returns the text to reply rendered in the format of the platform and
+// split into parts within its message length limit.
+func (r *Result) Parts(format Format, limit int, length LengthFunc) []string {
+	return FormatText(r.Text(), format, RenderOptions{FormatLinks: r.FormatLinks}, limit, length, r.NumberParts)
 }
 
 func NewHandler(cfg config.GeneralConfig, store store.Store, adapter Adapter) *Handler {
-	client := botastic.New(cfg.Botastic.AppId, "", botastic.WithDebug(cfg.Botastic.Debug), botastic.WithHost(cfg.Botastic.Host))
-	return &Handler{
-		cfg:     cfg,
-		client:  client,
-		store:   store,
-		adapter: adapter,
-		logger:  logrus.WithField("adapter", fmt.Sprintf("%T", adapter)).WithField("component", "service").WithField("adapter_name", adapter.GetName()),
+	h := &Handler{
+		cfg:      cfg,
+		backend:  newBackend(cfg),
+		store:    store,
+		adapter:  adapter,
+		logger:   logrus.WithField("adapter", fmt.Sprintf("%T", adapter)).WithField("component", "service").WithField("adapter_name", adapter.GetName()),
+		commands: newCommandRouter(),
 	}
+
+	h.registerBuiltinCommands()
+	if p, ok := adapter.(CommandProvider); ok {
+		for _, cmd := range p.Commands() {
+			h.RegisterCommand(cmd)
+		}
+	}
+
+	return h
 }
 
+// Start handles the messages of the adapter until ctx is done, then it stops
+// receiving and waits for the messages being handled within the shutdown
+// grace period before returning.
 func (h *Handler) Start(ctx context.Context) error {
+	// the messages being handled outlive ctx for the grace period
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+
 	msgChan := h.adapter.GetMessageChan(ctx)
+	d := newDispatcher(h.getConfig().Options.Concurrency)
+	h.mu.Lock()
+	h.dispatcher = d
+	h.mu.Unlock()
 
 	for {
 		select {
-		case msg := <-msgChan:
+		case msg, ok := <-msgChan:
+			if !ok {
+				// the adapter has no more messages
+				h.drain(d, cancelWork)
+				return nil
+			}
 			h.logger.WithField("msg", msg).Info("received message")
+			cfg := h.getConfig()
 			if msg.BotID == 0 {
-				msg.BotID = h.cfg.Bot.BotID
+				msg.BotID = cfg.Bot.BotID
 			}
 			if msg.Lang == "" {
-				msg.Lang = h.cfg.Bot.Lang
+				msg.Lang = cfg.Bot.Lang
 			}
 
-			turn, err := h.handleMessage(ctx, msg)
-			h.logger.WithFields(logrus.Fields{
-				"turn":       turn,
-				"result_err": err,
-			}).Info("handled message")
-			h.adapter.HandleResult(msg, &Result{
-				ConvTurn:      turn,
-				IgnoreIfError: h.cfg.Options.IgnoreIfError,
-				Err:           err,
+			d.dispatch(msg.ConvKey, func() {
+				h.process(workCtx, msg)
 			})
 		case <-ctx.Done():
+			h.drain(d, cancelWork)
 			return ctx.Err()
 		}
 	}
 }
 
-func (h *Handler) handleMessage(ctx context.Context, m *Message) (*botastic.ConvTurn, error) {
+// drain waits for the dispatched messages, the ones still being handled
+// after the grace period are canceled.
+func (h *Handler) drain(d *dispatcher, cancel context.CancelFunc) {
+	done := make(chan struct{})
+	go func() {
+		d.wait()
+		close(done)
+	}()
+
+	grace := time.Duration(h.getConfig().Options.ShutdownGracePeriod) * time.Second
+	if grace <= 0 {
+		grace = defaultShutdownGracePeriod
+	}
+
+	select {
+	case <-done:
+		return
+	case <-time.After(grace):
+		h.logger.Warn("shutdown grace period expired, canceling the messages left")
+		cancel()
+	}
+
+	// the canceled messages still deliver their results
+	select {
+	case <-done:
+	case <-time.After(canceledDeliveryTimeout):
+		h.logger.Error("messages are not finished after canceled")
+	}
+}
+
+func (h *Handler) process(ctx context.Context, msg *Message) {
+	h.applyPrefs(msg)
+
+	if cmd, args, ok := h.commands.match(msg.Content); ok {
+		h.handleCommand(ctx, msg, cmd, args)
+		return
+	}
+
+	stopTyping := h.startTyping(ctx, msg)
+	st := h.newStreamer(msg)
+	turn, err := h.handleMessage(ctx, msg, st.onUpdate())
+	stopTyping()
+	err = wrapError(err)
+	h.logger.WithFields(logrus.Fields{
+		"turn":       turn,
+		"result_err": err,
+	}).Info("handled message")
+	opts := h.getConfig().Options
+	r := &Result{
+		ConvTurn:      turn,
+		IgnoreIfError: opts.IgnoreIfError,
+		Err:           err,
+		NumberParts:   opts.NumberParts,
+		FormatLinks:   opts.FormatLinks,
+	}
+	if err != nil {
+		r.ErrorText = h.errorMessage(err, msg.Lang)
+	}
+	if turn != nil {
+		r.Status = TurnStatus(turn.Status)
+	}
+	r.StreamMessageID = st.messageID()
+	h.adapter.HandleResult(msg, r)
+}
+
+func (h *Handler) handleCommand(ctx context.Context, msg *Message, cmd Command, args []string) {
+	text, err := cmd.Func(ctx, h, msg, args)
+	h.logger.WithFields(logrus.Fields{
+		"command":    cmd.Name,
+		"args":       args,
+		"result_err": err,
+	}).Info("handled command")
+
+	opts := h.getConfig().Options
+	r := &Result{
+		IgnoreIfError: opts.IgnoreIfError,
+		Err:           wrapError(err),
+		NumberParts:   opts.NumberParts,
+		FormatLinks:   opts.FormatLinks,
+	}
+	if err != nil {
+		r.ErrorText = h.errorMessage(err, msg.Lang)
+	} else {
+		r.ConvTurn = &botastic.ConvTurn{
+			Response: text,
+			Status:   int(TurnStatusSuccess),
+		}
+		r.Status = TurnStatusSuccess
+	}
+	h.adapter.HandleResult(msg, r)
+}
+
+// handleMessage gets the reply of the message, onUpdate receives the partial
+// replies if it isn't nil and the backend supports streaming.
+func (h *Handler) handleMessage(ctx context.Context, m *Message, onUpdate func(text string)) (*botastic.ConvTurn, error) {
+	// an empty message neither starts a conversation nor reaches the backend
+	if strings.TrimSpace(m.Content) == "" {
+		return nil, &Error{Kind: ErrorKindInvalidInput, Err: errors.New("empty message")}
+	}
+
+	if timeout := h.getConfig().Options.Retry.Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
+
 	conv, err := h.store.GetConversationByKey(m.ConvKey)
 	if err != nil {
 		return nil, err
 	}
 
 	if conv == nil {
-		conv, err = h.client.CreateConversation(ctx, botastic.CreateConversationRequest{
-			BotID:        m.BotID,
-			UserIdentity: m.UserIdentity,
-			Lang:         m.Lang,
-		})
-		if err != nil {
+		if err := h.retry(ctx, "CreateConversation", func(ctx context.Context) error {
+			conv, err = h.getBackend().CreateConversation(ctx, botastic.CreateConversationRequest{
+				BotID:        m.BotID,
+				UserIdentity: m.UserIdentity,
+				Lang:         m.Lang,
+			})
+			return err
+		}); err != nil {
 			return nil, err
 		}
 
-		if err := h.store.SetConversation(m.ConvKey, conv); err != nil {
+		if err := h.store.SetConversation(m.ConvKey, conv, h.idleTimeout()); err != nil {
 			return nil, err
 		}
 	}
@@ -117,31 +294,47 @@ func (h *Handler) handleMessage(ctx context.Context, m *Message) (*botastic.Conv
 	}
 	content += m.Content
 
-	convTurn, err := h.client.PostToConversation(ctx, botastic.PostToConversationPayloadRequest{
-		ConversationID: conv.ID,
-		Content:        content,
-		Category:       "plain-text",
-	})
-	if err != nil {
+	// a post that may have created the turn is not retried, the message
+	// must not be posted twice
+	var convTurn *botastic.ConvTurn
+	if err := h.retryPost(ctx, "PostToConversation", func(ctx context.Context) error {
+		if sb, ok := h.getBackend().(StreamingBackend); ok && onUpdate != nil {
+			convTurn, err = sb.PostMessageStream(ctx, conv, content, onUpdate)
+		} else {
+			convTurn, err = h.getBackend().PostMessage(ctx, conv, content)
+		}
+		return err
+	}); err != nil {
 		return nil, err
 	}
 
-	turn, err := h.client.GetConvTurn(ctx, conv.ID, convTurn.ID, true)
-	if err != nil {
-		// TODO: retry
-		return nil, err
-	}
-	if turn.Status != 2 {
-		return nil, fmt.Errorf("unexpected status: %d", turn.Status)
+	turn := convTurn
+	if TurnStatus(turn.Status) != TurnStatusSuccess {
+		// the turn is posted, only poll it from now on to avoid posting twice
+		turn, err = h.pollTurn(ctx, conv, convTurn.ID)
+		if err != nil {
+			return turn, err
+		}
 	}
 
-	if h.cfg.Options.FormatLinks && turn.Response != "" {
-		turn.Response = formatLink(turn.Response)
+	// save the conversation updated by the backend and refresh its idle timeout
+	if err := h.store.SetConversation(m.ConvKey, conv, h.idleTimeout()); err != nil {
+		h.logger.WithError(err).Error("refresh conversation error")
 	}
 
 	return turn, nil
 }
 
+// ResetConversation drops the conversation of the key, the next message of
+// the key starts a new botastic conversation.
+func (h *Handler) ResetConversation(convKey string) error {
+	return h.store.DeleteConversation(convKey)
+}
+
+func (h *Handler) idleTimeout() time.Duration {
+	return time.Duration(h.getConfig().Options.ConversationIdleTimeout) * time.Second
+}
+
 func formatLink(str string) string {
 	isSpace := func(c byte) bool {
 		return c == ' ' || c == '\t' || c == '\n' || c == '\r'
@@ -1,6 +1,12 @@
 package service
 
-import "testing"
+import (
+	"context"
+	"testing"
+
+	"github.com/pandodao/PAL9000/config"
+	"github.com/pandodao/PAL9000/store"
+)
 
 func TestFormatLink(t *testing.T) {
 	cases := []struct {
@@ -34,3 +40,20 @@ func TestFormatLink(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleEmptyMessage(t *testing.T) {
+	s, _ := store.NewMemoryProvider().Namespace("test")
+	h := &Handler{
+		cfg:   config.GeneralConfig{Options: &config.GeneralOptionsConfig{}},
+		store: s,
+	}
+
+	// rejected before a conversation is created, the handler has no backend
+	_, err := h.handleMessage(context.Background(), &Message{ConvKey: "key", Content: " \n"}, nil)
+	if kind := errorKind(err); kind != ErrorKindInvalidInput {
+		t.Errorf("error kind = %s, want %s", kind, ErrorKindInvalidInput)
+	}
+	if conv, _ := s.GetConversationByKey("key"); conv != nil {
+		t.Errorf("conversation created: %+v", conv)
+	}
+}
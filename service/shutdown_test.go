@@ -0,0 +1,45 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pandodao/PAL9000/config"
+	"github.com/sirupsen/logrus"
+)
+
+func TestHandlerDrain(t *testing.T) {
+	h := &Handler{
+		cfg:    config.GeneralConfig{Options: &config.GeneralOptionsConfig{ShutdownGracePeriod: 1}},
+		logger: logrus.WithField("test", "drain"),
+	}
+
+	// the messages finished within the grace period are not canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	d := newDispatcher(2)
+	d.dispatch("a", func() { time.Sleep(100 * time.Millisecond) })
+	h.drain(d, cancel)
+	if ctx.Err() != nil {
+		t.Error("ctx should not be canceled")
+	}
+
+	// the ones left are canceled after the grace period and still finish
+	ctx, cancel = context.WithCancel(context.Background())
+	d = newDispatcher(2)
+	finished := make(chan struct{})
+	d.dispatch("b", func() {
+		<-ctx.Done()
+		close(finished)
+	})
+	start := time.Now()
+	h.drain(d, cancel)
+	select {
+	case <-finished:
+	default:
+		t.Fatal("message should be finished")
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("drain returned before the grace period: %v", elapsed)
+	}
+}
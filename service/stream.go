@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pandodao/botastic-go"
+)
+
+const defaultStreamEditInterval = time.Second
+
+// StreamingBackend is implemented by backends that can deliver the reply
+// incrementally, onUpdate is called with the text received so far.
+type StreamingBackend interface {
+	PostMessageStream(ctx context.Context, conv *botastic.Conversation, content string, onUpdate func(text string)) (*botastic.ConvTurn, error)
+}
+
+// StreamingAdapter is implemented by adapters that can edit a sent message.
+// The handler sends the partial reply as a placeholder and edits it while the
+// reply streams in, the final text is delivered by HandleResult with
+// Result.StreamMessageID set.
+type StreamingAdapter interface {
+	// SendPlaceholder sends text as the reply and returns the id of the sent
+	// message.
+	SendPlaceholder(m *Message, text string) (string, error)
+	// EditMessage replaces the text of the message sent by SendPlaceholder.
+	EditMessage(m *Message, id string, text string) error
+}
+
+// streamer throttles the edits of the placeholder to respect the rate limits
+// of the platforms, the updates in between are dropped since every update
+// carries the whole text so far.
+type streamer struct {
+	adapter  StreamingAdapter
+	msg      *Message
+	h        *Handler
+	interval time.Duration
+
+	mu       sync.Mutex
+	id       string
+	failed   bool
+	lastEdit time.Time
+	lastText string
+}
+
+func (h *Handler) newStreamer(msg *Message) *streamer {
+	if !h.getConfig().Options.Stream {
+		return nil
+	}
+	if _, ok := h.getBackend().(StreamingBackend); !ok {
+		return nil
+	}
+	adapter, ok := h.adapter.(StreamingAdapter)
+	if !ok {
+		return nil
+	}
+
+	interval := time.Duration(h.getConfig().Options.StreamEditInterval) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultStreamEditInterval
+	}
+
+	return &streamer{
+		adapter:  adapter,
+		msg:      msg,
+		h:        h,
+		interval: interval,
+	}
+}
+
+func (s *streamer) update(text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failed || text == "" || text == s.lastText || time.Since(s.lastEdit) < s.interval {
+		return
+	}
+
+	var err error
+	if s.id == "" {
+		s.id, err = s.adapter.SendPlaceholder(s.msg, text)
+	} else {
+		err = s.adapter.EditMessage(s.msg, s.id, text)
+	}
+	if err != nil {
+		// the final text is still delivered by HandleResult, give up streaming
+		// if even the placeholder couldn't be sent
+		s.h.logger.WithError(err).Error("stream update error")
+		s.failed = s.id == ""
+		return
+	}
+
+	s.lastEdit = time.Now()
+	s.lastText = text
+}
+
+// messageID returns the id of the placeholder, empty if nothing was sent.
+func (s *streamer) messageID() string {
+	if s == nil {
+		return ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id
+}
+
+func (s *streamer) onUpdate() func(string) {
+	if s == nil {
+		return nil
+	}
+	return s.update
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type fakeStreamingAdapter struct {
+	sent   []string
+	edited []string
+}
+
+func (a *fakeStreamingAdapter) SendPlaceholder(m *Message, text string) (string, error) {
+	a.sent = append(a.sent, text)
+	return "1", nil
+}
+
+func (a *fakeStreamingAdapter) EditMessage(m *Message, id string, text string) error {
+	a.edited = append(a.edited, text)
+	return nil
+}
+
+func TestStreamerThrottlesEdits(t *testing.T) {
+	adapter := &fakeStreamingAdapter{}
+	s := &streamer{
+		adapter:  adapter,
+		h:        &Handler{logger: logrus.NewEntry(logrus.New())},
+		interval: 50 * time.Millisecond,
+	}
+
+	s.update("a")
+	s.update("ab") // dropped, too soon after the placeholder
+	time.Sleep(60 * time.Millisecond)
+	s.update("abc")
+	s.update("abc")
+
+	if len(adapter.sent) != 1 || adapter.sent[0] != "a" {
+		t.Errorf("sent %v, want [a]", adapter.sent)
+	}
+	if len(adapter.edited) != 1 || adapter.edited[0] != "abc" {
+		t.Errorf("edited %v, want [abc]", adapter.edited)
+	}
+	if s.messageID() != "1" {
+		t.Errorf("messageID() = %q, want 1", s.messageID())
+	}
+}
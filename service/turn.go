@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pandodao/botastic-go"
+)
+
+const (
+	defaultTurnTimeout      = 2 * time.Minute
+	defaultTurnPollInterval = time.Second
+)
+
+// TurnStatus is the status of a botastic conversation turn.
+type TurnStatus int
+
+const (
+	TurnStatusInit TurnStatus = iota
+	TurnStatusPending
+	TurnStatusSuccess
+	TurnStatusError
+)
+
+func (s TurnStatus) String() string {
+	switch s {
+	case TurnStatusInit:
+		return "init"
+	case TurnStatusPending:
+		return "pending"
+	case TurnStatusSuccess:
+		return "success"
+	case TurnStatusError:
+		return "error"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// ErrTurnTimeout means the turn is still being processed when the turn
+// timeout is reached, it is of ErrorKindTimeout.
+var ErrTurnTimeout = &Error{Kind: ErrorKindTimeout, Err: errors.New("turn is still being processed")}
+
+// TurnError is returned when botastic failed to process the turn.
+type TurnError struct {
+	TurnID uint64
+	Status TurnStatus
+}
+
+func (e *TurnError) Error() string {
+	return fmt.Sprintf("turn %d failed, status: %s", e.TurnID, e.Status)
+}
+
+// pollTurn waits until the turn is processed, it returns ErrTurnTimeout
+// together with the last fetched turn if the turn is still pending when the
+// turn timeout is reached. The error of ctx is returned if it's done first.
+func (h *Handler) pollTurn(ctx context.Context, conv *botastic.Conversation, turnID uint64) (*botastic.ConvTurn, error) {
+	timeout := time.Duration(h.getConfig().Options.TurnTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTurnTimeout
+	}
+	interval := time.Duration(h.getConfig().Options.TurnPollInterval) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultTurnPollInterval
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	pending := &botastic.ConvTurn{
+		ID:             turnID,
+		ConversationID: conv.ID,
+		Status:         int(TurnStatusPending),
+	}
+	// the turn timeout is reached only if the parent is still alive, e.g.
+	// not canceled at the end of the shutdown grace period
+	stopped := func() (*botastic.ConvTurn, error) {
+		if err := parent.Err(); err != nil {
+			return nil, err
+		}
+		return pending, ErrTurnTimeout
+	}
+	for {
+		var turn *botastic.ConvTurn
+		err := h.retry(ctx, "GetConvTurn", func(ctx context.Context) error {
+			var err error
+			turn, err = h.getBackend().GetReply(ctx, conv, turnID, true)
+			return err
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return stopped()
+			}
+			return nil, err
+		}
+
+		switch TurnStatus(turn.Status) {
+		case TurnStatusSuccess:
+			return turn, nil
+		case TurnStatusInit, TurnStatusPending:
+			pending = turn
+		default:
+			return turn, &TurnError{TurnID: turn.ID, Status: TurnStatus(turn.Status)}
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return stopped()
+		}
+	}
+}
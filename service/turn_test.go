@@ -0,0 +1,44 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pandodao/PAL9000/config"
+	"github.com/pandodao/botastic-go"
+	"github.com/sirupsen/logrus"
+)
+
+// pendingBackend never finishes the turns.
+type pendingBackend struct {
+	Backend
+}
+
+func (pendingBackend) GetReply(ctx context.Context, conv *botastic.Conversation, turnID uint64, block bool) (*botastic.ConvTurn, error) {
+	return &botastic.ConvTurn{ID: turnID, Status: int(TurnStatusPending)}, nil
+}
+
+func TestPollTurnStopped(t *testing.T) {
+	h := &Handler{
+		cfg: config.GeneralConfig{
+			Options: &config.GeneralOptionsConfig{TurnTimeout: 1, TurnPollInterval: 10},
+		},
+		backend: pendingBackend{},
+		logger:  logrus.NewEntry(logrus.New()),
+	}
+	conv := &botastic.Conversation{ID: "conv"}
+
+	turn, err := h.pollTurn(context.Background(), conv, 1)
+	if err != ErrTurnTimeout || turn == nil || turn.ID != 1 {
+		t.Errorf("turn timeout: pollTurn() = %+v, %v", turn, err)
+	}
+
+	// canceled at the end of the shutdown grace period
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := h.pollTurn(ctx, conv, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled: pollTurn() error = %v, want %v", err, context.Canceled)
+	}
+}
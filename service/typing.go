@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+// TypingAdapter is implemented by adapters that can show the user the bot is
+// working on the message, e.g. a typing indicator.
+type TypingAdapter interface {
+	SendTyping(m *Message) error
+	// TypingInterval is how often the indicator is refreshed while waiting
+	// for the reply, zero means it is only sent once.
+	TypingInterval() time.Duration
+}
+
+// startTyping keeps sending the typing indicator until the returned function
+// is called.
+func (h *Handler) startTyping(ctx context.Context, msg *Message) func() {
+	adapter, ok := h.adapter.(TypingAdapter)
+	if !ok || !h.getConfig().Options.ShowTyping {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		interval := adapter.TypingInterval()
+		for {
+			if err := adapter.SendTyping(msg); err != nil {
+				h.logger.WithError(err).Error("send typing error")
+			}
+			if interval <= 0 {
+				return
+			}
+
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,178 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pandodao/botastic-go"
+	bolt "go.etcd.io/bbolt"
+)
+
+var _ Store = (*BoltStore)(nil)
+
+// BoltProvider keeps the conversations of every adapter in one bbolt database
+// file, using a bucket per adapter name.
+type BoltProvider struct {
+	db *bolt.DB
+}
+
+func NewBoltProvider(path string) (*BoltProvider, error) {
+	if path == "" {
+		return nil, fmt.Errorf("bolt store path is empty")
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("bolt.Open error: %w", err)
+	}
+
+	return &BoltProvider{db: db}, nil
+}
+
+func (p *BoltProvider) Namespace(name string) (Store, error) {
+	bucket := []byte(name)
+	if err := p.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("create bucket error, name: %s, err: %w", name, err)
+	}
+
+	return &BoltStore{
+		db:     p.db,
+		bucket: bucket,
+	}, nil
+}
+
+func (p *BoltProvider) Close() error {
+	return p.db.Close()
+}
+
+type BoltStore struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+// boltRecord is the value stored in the bucket, ExpiresAt is a unix
+// timestamp and zero means the record never expires.
+type boltRecord struct {
+	Conversation *botastic.Conversation `json:"conversation"`
+	Prefs        *Prefs                 `json:"prefs,omitempty"`
+	ExpiresAt    int64                  `json:"expires_at"`
+}
+
+func (r *boltRecord) expired() bool {
+	return r.ExpiresAt > 0 && time.Now().Unix() >= r.ExpiresAt
+}
+
+func (s *BoltStore) get(key string) (*boltRecord, error) {
+	var record boltRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(s.bucket).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+
+		return json.Unmarshal(data, &record)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if record.expired() {
+		// the record may be written again since it's read, it's deleted only
+		// if it's still expired
+		record = boltRecord{}
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(s.bucket)
+			data := b.Get([]byte(key))
+			if data == nil {
+				return nil
+			}
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if record.expired() {
+				record = boltRecord{}
+				return b.Delete([]byte(key))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &record, nil
+}
+
+// update modifies the record of the key in a transaction, the record is
+// deleted if it has neither a conversation nor prefs.
+func (s *BoltStore) update(key string, fn func(r *boltRecord)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		var record boltRecord
+		if data := b.Get([]byte(key)); data != nil {
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if record.expired() {
+				record = boltRecord{}
+			}
+		}
+
+		fn(&record)
+		if record.Conversation == nil && record.Prefs == nil {
+			return b.Delete([]byte(key))
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+func expiresAt(ttl time.Duration) int64 {
+	if ttl > 0 {
+		return time.Now().Add(ttl).Unix()
+	}
+	return 0
+}
+
+func (s *BoltStore) GetConversationByKey(key string) (*botastic.Conversation, error) {
+	record, err := s.get(key)
+	if err != nil {
+		return nil, err
+	}
+	return record.Conversation, nil
+}
+
+func (s *BoltStore) SetConversation(key string, conv *botastic.Conversation, ttl time.Duration) error {
+	return s.update(key, func(r *boltRecord) {
+		r.Conversation = conv
+		r.ExpiresAt = expiresAt(ttl)
+	})
+}
+
+func (s *BoltStore) DeleteConversation(key string) error {
+	return s.update(key, func(r *boltRecord) {
+		r.Conversation = nil
+	})
+}
+
+func (s *BoltStore) GetPrefs(key string) (*Prefs, error) {
+	record, err := s.get(key)
+	if err != nil {
+		return nil, err
+	}
+	return record.Prefs, nil
+}
+
+func (s *BoltStore) SetPrefs(key string, prefs Prefs, ttl time.Duration) error {
+	return s.update(key, func(r *boltRecord) {
+		r.Prefs = &prefs
+		r.ExpiresAt = expiresAt(ttl)
+	})
+}
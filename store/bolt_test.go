@@ -0,0 +1,76 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pandodao/botastic-go"
+)
+
+func TestBoltStoreNamespaces(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	p, err := NewBoltProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, _ := p.Namespace("a")
+	b, _ := p.Namespace("b")
+	if err := a.SetConversation("key", &botastic.Conversation{ID: "conv-a"}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if conv, _ := b.GetConversationByKey("key"); conv != nil {
+		t.Fatalf("namespace b should not see conversations of a, got %s", conv.ID)
+	}
+
+	// conversations survive reopening the database
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p, err = NewBoltProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	a, _ = p.Namespace("a")
+	conv, err := a.GetConversationByKey("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conv == nil || conv.ID != "conv-a" {
+		t.Fatalf("GetConversationByKey() = %v, want conv-a", conv)
+	}
+}
+
+func TestBoltStoreExpiration(t *testing.T) {
+	p, err := NewBoltProvider(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	s, _ := p.Namespace("a")
+	// expiry is stored with second precision, so this is already expired
+	if err := s.SetConversation("expired", &botastic.Conversation{ID: "1"}, time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	if conv, _ := s.GetConversationByKey("expired"); conv != nil {
+		t.Fatal("expired conversation should be dropped")
+	}
+	if err := s.SetConversation("alive", &botastic.Conversation{ID: "2"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if conv, _ := s.GetConversationByKey("alive"); conv == nil {
+		t.Fatal("conversation within its ttl should be kept")
+	}
+
+	if err := s.DeleteConversation("alive"); err != nil {
+		t.Fatal(err)
+	}
+	if conv, _ := s.GetConversationByKey("alive"); conv != nil {
+		t.Fatal("deleted conversation should be gone")
+	}
+}
@@ -1,38 +1,160 @@
 package store
 
 import (
+	"fmt"
 	"sync"
+	"time"
 
+	"github.com/pandodao/PAL9000/config"
 	"github.com/pandodao/botastic-go"
+	"github.com/patrickmn/go-cache"
 )
 
 type Store interface {
 	GetConversationByKey(key string) (*botastic.Conversation, error)
-	SetConversation(key string, conv *botastic.Conversation) error
+	// SetConversation stores the conversation of the key, it expires after
+	// ttl unless it is set again. zero ttl means never expire.
+	SetConversation(key string, conv *botastic.Conversation, ttl time.Duration) error
+	// DeleteConversation drops the conversation of the key, the prefs of the
+	// key are kept.
+	DeleteConversation(key string) error
+	// GetPrefs returns nil if the key has no prefs.
+	GetPrefs(key string) (*Prefs, error)
+	// SetPrefs stores the prefs of the key, they share the ttl with the
+	// conversation and setting either of them refreshes it.
+	SetPrefs(key string, prefs Prefs, ttl time.Duration) error
+}
+
+// Prefs are the bot and language chosen by /bot and /lang for a conversation
+// key, they override the configured ones.
+type Prefs struct {
+	BotID uint64 `json:"bot_id,omitempty"`
+	Lang  string `json:"lang,omitempty"`
+}
+
+// Provider is shared by all adapters and hands out one Store per adapter name,
+// so the conversation keys of different adapters never collide.
+type Provider interface {
+	Namespace(name string) (Store, error)
+	Close() error
+}
+
+func Open(cfg config.StoreConfig) (Provider, error) {
+	switch cfg.Driver {
+	case "", "memory":
+		return NewMemoryProvider(), nil
+	case "bolt":
+		return NewBoltProvider(cfg.Path)
+	default:
+		return nil, fmt.Errorf("invalid store driver: %s", cfg.Driver)
+	}
+}
+
+type MemoryProvider struct {
+	lock   sync.Mutex
+	stores map[string]*MemoryStore
+}
+
+func NewMemoryProvider() *MemoryProvider {
+	return &MemoryProvider{
+		stores: make(map[string]*MemoryStore),
+	}
+}
+
+func (p *MemoryProvider) Namespace(name string) (Store, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	s, ok := p.stores[name]
+	if !ok {
+		s = NewMemoryStore()
+		p.stores[name] = s
+	}
+	return s, nil
+}
+
+func (p *MemoryProvider) Close() error {
+	return nil
 }
 
 type MemoryStore struct {
-	convLock sync.Mutex
-	convMap  map[string]*botastic.Conversation
+	// guards the read-modify-write of the records
+	mu        sync.Mutex
+	convCache *cache.Cache
+}
+
+// memoryRecord is the cached value of a key, like the record of the bolt
+// store.
+type memoryRecord struct {
+	conv  *botastic.Conversation
+	prefs *Prefs
 }
 
 func NewMemoryStore() *MemoryStore {
 	return &MemoryStore{
-		convMap: make(map[string]*botastic.Conversation),
+		convCache: cache.New(cache.NoExpiration, 10*time.Minute),
 	}
 }
 
+func (s *MemoryStore) get(key string) memoryRecord {
+	if v, ok := s.convCache.Get(key); ok {
+		return v.(memoryRecord)
+	}
+	return memoryRecord{}
+}
+
 func (s *MemoryStore) GetConversationByKey(key string) (*botastic.Conversation, error) {
-	s.convLock.Lock()
-	defer s.convLock.Unlock()
+	return s.get(key).conv, nil
+}
 
-	return s.convMap[key], nil
+func (s *MemoryStore) SetConversation(key string, conv *botastic.Conversation, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.get(key)
+	r.conv = conv
+	s.set(key, r, ttl)
+	return nil
 }
 
-func (s *MemoryStore) SetConversation(key string, conv *botastic.Conversation) error {
-	s.convLock.Lock()
-	defer s.convLock.Unlock()
+func (s *MemoryStore) DeleteConversation(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	s.convMap[key] = conv
+	v, exp, ok := s.convCache.GetWithExpiration(key)
+	if !ok {
+		return nil
+	}
+	prefs := v.(memoryRecord).prefs
+	ttl := time.Duration(0) // never expire
+	if !exp.IsZero() {
+		ttl = time.Until(exp)
+	}
+	if prefs == nil || ttl < 0 {
+		s.convCache.Delete(key)
+		return nil
+	}
+	s.set(key, memoryRecord{prefs: prefs}, ttl)
 	return nil
 }
+
+func (s *MemoryStore) GetPrefs(key string) (*Prefs, error) {
+	return s.get(key).prefs, nil
+}
+
+func (s *MemoryStore) SetPrefs(key string, prefs Prefs, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.get(key)
+	r.prefs = &prefs
+	s.set(key, r, ttl)
+	return nil
+}
+
+func (s *MemoryStore) set(key string, r memoryRecord, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = cache.NoExpiration
+	}
+	s.convCache.Set(key, r, ttl)
+}
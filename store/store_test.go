@@ -0,0 +1,52 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pandodao/botastic-go"
+)
+
+func TestStorePrefs(t *testing.T) {
+	bp, err := NewBoltProvider(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bp.Close()
+
+	for name, p := range map[string]Provider{"memory": NewMemoryProvider(), "bolt": bp} {
+		t.Run(name, func(t *testing.T) {
+			s, _ := p.Namespace("a")
+			if prefs, _ := s.GetPrefs("key"); prefs != nil {
+				t.Fatalf("GetPrefs() = %+v, want nil", prefs)
+			}
+
+			if err := s.SetConversation("key", &botastic.Conversation{ID: "1"}, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.SetPrefs("key", Prefs{Lang: "zh"}, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			// the prefs outlive the reset of the conversation
+			if err := s.DeleteConversation("key"); err != nil {
+				t.Fatal(err)
+			}
+			if conv, _ := s.GetConversationByKey("key"); conv != nil {
+				t.Fatal("deleted conversation should be gone")
+			}
+			if prefs, _ := s.GetPrefs("key"); prefs == nil || prefs.Lang != "zh" {
+				t.Fatalf("GetPrefs() = %+v, want zh", prefs)
+			}
+
+			// and expire like the conversations
+			if err := s.SetPrefs("expired", Prefs{BotID: 1}, time.Nanosecond); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(time.Millisecond)
+			if prefs, _ := s.GetPrefs("expired"); prefs != nil {
+				t.Fatalf("expired prefs = %+v, want nil", prefs)
+			}
+		})
+	}
+}